@@ -0,0 +1,508 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// The version byte that prefixes all records encoded with the BinaryCodec. JSON
+// payloads always start with '{' or whitespace so the version byte can also be
+// used to detect the encoding of stored records.
+const binaryCodecVersion byte = 0x01
+
+// Wire types for encoded fields.
+const (
+	wireVarint byte = 0
+	wireBytes  byte = 2
+)
+
+// Field numbers used by the binary encoding. Fields with a zero value are omitted.
+// New fields must always be assigned a new number so that older decoders can skip them.
+const (
+	fieldTimestamp       = 1
+	fieldTraceId         = 2
+	fieldTraceUUID       = 3
+	fieldCorrelationId   = 4
+	fieldCorrelationUUID = 5
+	fieldTypeEnum        = 6
+	fieldType            = 7
+	fieldFrom            = 8
+	fieldTo              = 9
+	fieldHost            = 10
+	fieldDuration        = 11
+	fieldError           = 12
+	fieldKind            = 13
+	fieldTagKey          = 14
+	fieldTagValue        = 15
+	fieldErrorCode       = 16
+	fieldErrorCategory   = 17
+	fieldErrorMessage    = 18
+	fieldPayloadSize     = 19
+	fieldPayloadHash     = 20
+	fieldPayloadPreview  = 21
+)
+
+// Enum values for the well-known trace types.
+const (
+	typeEnumRequest  = 1
+	typeEnumResponse = 2
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("tracer: unsupported binary record version")
+	ErrMalformedRecord    = errors.New("tracer: malformed binary record")
+)
+
+// The Codec interface is implemented by objects that can serialize trace records.
+type Codec interface {
+	// The content type for payloads generated by this codec.
+	ContentType() string
+
+	// Encode a trace record.
+	Marshal(rec *Record) ([]byte, error)
+
+	// Decode a trace record.
+	Unmarshal(data []byte, rec *Record) error
+}
+
+var (
+	// The JSON codec is the default codec used by storage engines.
+	JSONCodec Codec = jsonCodec{}
+
+	// The binary codec uses a compact, length-prefixed varint format.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+type jsonCodec struct{}
+
+// The content type for payloads generated by this codec.
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+// Encode a trace record as JSON.
+func (jsonCodec) Marshal(rec *Record) ([]byte, error) {
+	return json.Marshal(rec)
+}
+
+// Decode a JSON trace record.
+func (jsonCodec) Unmarshal(data []byte, rec *Record) error {
+	return json.Unmarshal(data, rec)
+}
+
+type binaryCodec struct{}
+
+// The content type for payloads generated by this codec.
+func (binaryCodec) ContentType() string {
+	return "application/x-tracer-record"
+}
+
+// Encode a trace record using the binary format.
+func (binaryCodec) Marshal(rec *Record) ([]byte, error) {
+	enc := recordEncoder{buf: make([]byte, 1, 128)}
+	enc.buf[0] = binaryCodecVersion
+	enc.encode(rec)
+	return enc.buf, nil
+}
+
+// Decode a binary trace record.
+func (binaryCodec) Unmarshal(data []byte, rec *Record) error {
+	if len(data) == 0 {
+		return ErrMalformedRecord
+	}
+	if data[0] != binaryCodecVersion {
+		return ErrUnsupportedVersion
+	}
+	dec := recordDecoder{buf: data[1:]}
+	return dec.decode(rec)
+}
+
+// Decode a record that was encoded by any of the supported codecs. The encoding
+// is detected by inspecting the first byte of the payload.
+func UnmarshalRecord(data []byte, rec *Record) error {
+	return codecFor(data).Unmarshal(data, rec)
+}
+
+// Detect the codec that was used for encoding a payload.
+func codecFor(data []byte) Codec {
+	if len(data) > 0 && data[0] == binaryCodecVersion {
+		return BinaryCodec
+	}
+	return JSONCodec
+}
+
+// Encode a trace using the supplied codec. JSON traces are encoded as a JSON
+// array; binary traces are encoded as a version byte followed by a sequence of
+// uvarint length-prefixed records.
+func MarshalTrace(codec Codec, trace Trace) ([]byte, error) {
+	if codec == JSONCodec {
+		return json.Marshal(trace)
+	}
+
+	buf := make([]byte, 1, 1+64*len(trace))
+	buf[0] = binaryCodecVersion
+	for index := range trace {
+		data, err := codec.Marshal(&trace[index])
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// Decode a trace that was encoded with MarshalTrace by any of the supported codecs.
+func UnmarshalTrace(data []byte) (Trace, error) {
+	if len(data) == 0 {
+		return make(Trace, 0), nil
+	}
+	if data[0] != binaryCodecVersion {
+		trace := make(Trace, 0)
+		err := json.Unmarshal(data, &trace)
+		return trace, err
+	}
+
+	trace := make(Trace, 0)
+	data = data[1:]
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, ErrMalformedRecord
+		}
+		data = data[n:]
+
+		var rec Record
+		err := UnmarshalRecord(data[:size], &rec)
+		if err != nil {
+			return nil, err
+		}
+		trace = append(trace, rec)
+		data = data[size:]
+	}
+	return trace, nil
+}
+
+// The recordEncoder serializes records using the binary format. If a string table
+// is attached, string fields are written as varint references to the table instead
+// of being inlined.
+type recordEncoder struct {
+	buf     []byte
+	strings *stringTable
+}
+
+func (e *recordEncoder) encode(rec *Record) {
+	if !rec.Timestamp.IsZero() {
+		e.writeKey(fieldTimestamp, wireVarint)
+		e.buf = binary.AppendVarint(e.buf, rec.Timestamp.UnixNano())
+	}
+	e.writeId(fieldTraceId, fieldTraceUUID, rec.TraceId)
+	e.writeId(fieldCorrelationId, fieldCorrelationUUID, rec.CorrelationId)
+	switch rec.Type {
+	case Request:
+		e.writeVarint(fieldTypeEnum, typeEnumRequest)
+	case Response:
+		e.writeVarint(fieldTypeEnum, typeEnumResponse)
+	default:
+		e.writeString(fieldType, string(rec.Type))
+	}
+	e.writeString(fieldFrom, rec.From)
+	e.writeString(fieldTo, rec.To)
+	e.writeString(fieldHost, rec.Host)
+	e.writeVarint(fieldDuration, uint64(rec.Duration))
+	e.writeString(fieldError, rec.Error)
+	e.writeString(fieldKind, string(rec.Kind))
+	if rec.ErrorInfo != nil {
+		e.writeString(fieldErrorCode, rec.ErrorInfo.Code)
+		e.writeString(fieldErrorCategory, string(rec.ErrorInfo.Category))
+		e.writeString(fieldErrorMessage, rec.ErrorInfo.Message)
+	}
+	e.writeVarint(fieldPayloadSize, uint64(rec.PayloadSize))
+	e.writeString(fieldPayloadHash, rec.PayloadHash)
+	e.writeString(fieldPayloadPreview, rec.PayloadPreview)
+
+	// Tags are written as key/value field pairs sorted by key so that the
+	// encoding of a record is deterministic.
+	if len(rec.Tags) > 0 {
+		keys := make([]string, 0, len(rec.Tags))
+		for key := range rec.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			e.writeTag(fieldTagKey, key)
+			e.writeTag(fieldTagValue, rec.Tags[key])
+		}
+	}
+}
+
+func (e *recordEncoder) writeKey(field int, wireType byte) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *recordEncoder) writeVarint(field int, val uint64) {
+	if val == 0 {
+		return
+	}
+	e.writeKey(field, wireVarint)
+	e.buf = binary.AppendUvarint(e.buf, val)
+}
+
+func (e *recordEncoder) writeBytes(field int, val []byte) {
+	e.writeKey(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(val)))
+	e.buf = append(e.buf, val...)
+}
+
+func (e *recordEncoder) writeString(field int, val string) {
+	if val == "" {
+		return
+	}
+	if e.strings != nil {
+		e.writeKey(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, uint64(e.strings.index(val)))
+		return
+	}
+	e.writeBytes(field, []byte(val))
+}
+
+// Write a tag key or value. Unlike regular string fields, empty values are
+// also written so that keys and values always appear in pairs.
+func (e *recordEncoder) writeTag(field int, val string) {
+	if e.strings != nil {
+		e.writeKey(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, uint64(e.strings.index(val)))
+		return
+	}
+	e.writeBytes(field, []byte(val))
+}
+
+// Write an identifier. Canonical UUIDs are packed into 16 raw bytes; any other
+// value is written as a regular string.
+func (e *recordEncoder) writeId(strField, uuidField int, val string) {
+	if val == "" {
+		return
+	}
+	if packed, ok := packUUID(val); ok {
+		e.writeBytes(uuidField, packed)
+		return
+	}
+	e.writeString(strField, val)
+}
+
+// The recordDecoder parses records serialized by the recordEncoder.
+type recordDecoder struct {
+	buf     []byte
+	strings []string
+
+	// The last decoded tag key.
+	tagKey string
+}
+
+func (d *recordDecoder) decode(rec *Record) error {
+	for len(d.buf) > 0 {
+		key, err := d.readUvarint()
+		if err != nil {
+			return err
+		}
+		field, wireType := int(key>>3), byte(key&0x7)
+
+		switch wireType {
+		case wireVarint:
+			if field == fieldTimestamp {
+				val, n := binary.Varint(d.buf)
+				if n <= 0 {
+					return ErrMalformedRecord
+				}
+				d.buf = d.buf[n:]
+				rec.Timestamp = time.Unix(0, val)
+				continue
+			}
+
+			val, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			switch field {
+			case fieldTypeEnum:
+				switch val {
+				case typeEnumRequest:
+					rec.Type = Request
+				case typeEnumResponse:
+					rec.Type = Response
+				}
+			case fieldDuration:
+				rec.Duration = int64(val)
+			case fieldPayloadSize:
+				rec.PayloadSize = int64(val)
+			default:
+				// String table reference
+				if d.strings == nil || val >= uint64(len(d.strings)) {
+					if isStringField(field) {
+						return ErrMalformedRecord
+					}
+					continue
+				}
+				d.setString(rec, field, d.strings[val])
+			}
+		case wireBytes:
+			val, err := d.readChunk()
+			if err != nil {
+				return err
+			}
+
+			switch field {
+			case fieldTraceUUID:
+				rec.TraceId = unpackUUID(val)
+			case fieldCorrelationUUID:
+				rec.CorrelationId = unpackUUID(val)
+			default:
+				d.setString(rec, field, string(val))
+			}
+		default:
+			return ErrMalformedRecord
+		}
+	}
+
+	return nil
+}
+
+func (d *recordDecoder) readUvarint() (uint64, error) {
+	val, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, ErrMalformedRecord
+	}
+	d.buf = d.buf[n:]
+	return val, nil
+}
+
+// Read a uvarint length-prefixed chunk of bytes.
+func (d *recordDecoder) readChunk() ([]byte, error) {
+	size, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)) < size {
+		return nil, ErrMalformedRecord
+	}
+	val := d.buf[:size]
+	d.buf = d.buf[size:]
+	return val, nil
+}
+
+// Assign a string value to a record field. Unknown fields are ignored.
+func (d *recordDecoder) setString(rec *Record, field int, val string) {
+	switch field {
+	case fieldTraceId:
+		rec.TraceId = val
+	case fieldCorrelationId:
+		rec.CorrelationId = val
+	case fieldType:
+		rec.Type = TraceType(val)
+	case fieldFrom:
+		rec.From = val
+	case fieldTo:
+		rec.To = val
+	case fieldHost:
+		rec.Host = val
+	case fieldError:
+		rec.Error = val
+	case fieldKind:
+		rec.Kind = Kind(val)
+	case fieldPayloadHash:
+		rec.PayloadHash = val
+	case fieldPayloadPreview:
+		rec.PayloadPreview = val
+	case fieldErrorCode:
+		d.errorInfo(rec).Code = val
+	case fieldErrorCategory:
+		d.errorInfo(rec).Category = ErrorCategory(val)
+	case fieldErrorMessage:
+		d.errorInfo(rec).Message = val
+	case fieldTagKey:
+		d.tagKey = val
+	case fieldTagValue:
+		if rec.Tags == nil {
+			rec.Tags = make(map[string]string)
+		}
+		rec.Tags[d.tagKey] = val
+	}
+}
+
+// Get the ErrorInfo of a record, allocating it if required.
+func (d *recordDecoder) errorInfo(rec *Record) *ErrorInfo {
+	if rec.ErrorInfo == nil {
+		rec.ErrorInfo = &ErrorInfo{}
+	}
+	return rec.ErrorInfo
+}
+
+func isStringField(field int) bool {
+	switch field {
+	case fieldTraceId, fieldCorrelationId, fieldType, fieldFrom, fieldTo, fieldHost, fieldError, fieldKind, fieldTagKey, fieldTagValue,
+		fieldErrorCode, fieldErrorCategory, fieldErrorMessage, fieldPayloadHash, fieldPayloadPreview:
+		return true
+	}
+	return false
+}
+
+// A stringTable assigns sequential indices to unique strings.
+type stringTable struct {
+	values  []string
+	indices map[string]int
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{
+		values:  make([]string, 0),
+		indices: make(map[string]int),
+	}
+}
+
+func (t *stringTable) index(val string) int {
+	index, exists := t.indices[val]
+	if !exists {
+		index = len(t.values)
+		t.indices[val] = index
+		t.values = append(t.values, val)
+	}
+	return index
+}
+
+// Pack a canonical (lower-case, dash-separated) UUID string into 16 bytes.
+func packUUID(val string) ([]byte, bool) {
+	if len(val) != 36 || val[8] != '-' || val[13] != '-' || val[18] != '-' || val[23] != '-' {
+		return nil, false
+	}
+	packed := make([]byte, 16)
+	hexVal := val[0:8] + val[9:13] + val[14:18] + val[19:23] + val[24:]
+	_, err := hex.Decode(packed, []byte(hexVal))
+	if err != nil {
+		return nil, false
+	}
+
+	// Only pack lower-case UUIDs so that decoding yields the original value
+	if unpackUUID(packed) != val {
+		return nil, false
+	}
+	return packed, true
+}
+
+// Unpack a 16-byte UUID into its canonical string representation.
+func unpackUUID(val []byte) string {
+	if len(val) != 16 {
+		return hex.EncodeToString(val)
+	}
+	out := make([]byte, 36)
+	hex.Encode(out[0:8], val[0:4])
+	hex.Encode(out[9:13], val[4:6])
+	hex.Encode(out[14:18], val[6:8])
+	hex.Encode(out[19:23], val[8:10])
+	hex.Encode(out[24:], val[10:])
+	out[8], out[13], out[18], out[23] = '-', '-', '-', '-'
+	return string(out)
+}
@@ -0,0 +1,134 @@
+package tracer_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func testRecords() tracer.Trace {
+	now := time.Unix(0, time.Now().UnixNano())
+	traceId := "0f3ac0ef-5282-41aa-b7b7-ed45c4100186"
+	return tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.test.api", To: "com.test.add/4", Host: "arakis", Timestamp: now, TraceId: traceId, CorrelationId: "02376452-2c22-4cd9-8b58-5eeade37c3d8", PayloadSize: 16, PayloadHash: "9f86d081884c7d65", PayloadPreview: "{\"a\":1,\"b\":3}"},
+		tracer.Record{Type: tracer.Request, From: "com.test.add/4", To: "com.test.add/2", Host: "arakis", Timestamp: now.Add(time.Millisecond), TraceId: traceId, CorrelationId: "afc4c75b-7562-4fba-8df4-360346a73175"},
+		tracer.Record{Type: tracer.Response, From: "com.test.add/2", To: "com.test.add/4", Host: "arakis", Timestamp: now.Add(2 * time.Millisecond), TraceId: traceId, CorrelationId: "afc4c75b-7562-4fba-8df4-360346a73175", Duration: 1226606, Kind: tracer.Client},
+		tracer.Record{Type: tracer.Response, From: "com.test.add/4", To: "com.test.api", Host: "arakis", Timestamp: now.Add(3 * time.Millisecond), TraceId: traceId, CorrelationId: "02376452-2c22-4cd9-8b58-5eeade37c3d8", Duration: 4880111, Error: "timeout", ErrorInfo: &tracer.ErrorInfo{Code: "TIMEOUT", Category: tracer.CategoryTimeout, Message: "timeout"}},
+		tracer.Record{Type: tracer.TraceType("CUSTOM"), From: "svc", TraceId: "not-a-uuid", CorrelationId: "C0FFEE00-0000-0000-0000-000000000000", Tags: map[string]string{"region": "eu-west-1", "user": "", "tenant": "acme"}},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []tracer.Codec{tracer.JSONCodec, tracer.BinaryCodec}
+
+	for _, codec := range codecs {
+		for index, rec := range testRecords() {
+			data, err := codec.Marshal(&rec)
+			if err != nil {
+				t.Fatalf("[%s: case %d] error encoding record: %v", codec.ContentType(), index, err)
+			}
+
+			var decoded tracer.Record
+			err = tracer.UnmarshalRecord(data, &decoded)
+			if err != nil {
+				t.Fatalf("[%s: case %d] error decoding record: %v", codec.ContentType(), index, err)
+			}
+
+			if !decoded.Timestamp.Equal(rec.Timestamp) {
+				t.Fatalf("[%s: case %d] expected timestamp %v; got %v", codec.ContentType(), index, rec.Timestamp, decoded.Timestamp)
+			}
+			decoded.Timestamp = rec.Timestamp
+			if !reflect.DeepEqual(rec, decoded) {
+				t.Fatalf("[%s: case %d] expected decoded record to be %v; got %v", codec.ContentType(), index, rec, decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecErrors(t *testing.T) {
+	var rec tracer.Record
+
+	err := tracer.BinaryCodec.Unmarshal([]byte{}, &rec)
+	if err != tracer.ErrMalformedRecord {
+		t.Fatalf("expected error %v; got %v", tracer.ErrMalformedRecord, err)
+	}
+
+	err = tracer.BinaryCodec.Unmarshal([]byte{0x7f}, &rec)
+	if err != tracer.ErrUnsupportedVersion {
+		t.Fatalf("expected error %v; got %v", tracer.ErrUnsupportedVersion, err)
+	}
+
+	data, _ := tracer.BinaryCodec.Marshal(&testRecords()[0])
+	err = tracer.BinaryCodec.Unmarshal(data[:len(data)-3], &rec)
+	if err != tracer.ErrMalformedRecord {
+		t.Fatalf("expected error %v for truncated record; got %v", tracer.ErrMalformedRecord, err)
+	}
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	records := testRecords()
+	codecs := []tracer.Codec{tracer.JSONCodec, tracer.BinaryCodec}
+
+	for _, codec := range codecs {
+		data, err := tracer.MarshalTrace(codec, records)
+		if err != nil {
+			t.Fatalf("[%s] error encoding trace: %v", codec.ContentType(), err)
+		}
+
+		trace, err := tracer.UnmarshalTrace(data)
+		if err != nil {
+			t.Fatalf("[%s] error decoding trace: %v", codec.ContentType(), err)
+		}
+
+		l, _ := json.Marshal(records)
+		r, _ := json.Marshal(trace)
+		if string(l) != string(r) {
+			t.Fatalf("[%s] expected decoded trace to be %v; got %v", codec.ContentType(), records, trace)
+		}
+	}
+}
+
+func TestBinaryCodecSize(t *testing.T) {
+	for index, rec := range testRecords() {
+		jsonData, _ := tracer.JSONCodec.Marshal(&rec)
+		binData, _ := tracer.BinaryCodec.Marshal(&rec)
+		if len(binData) >= len(jsonData) {
+			t.Fatalf("[case %d] expected binary encoding (%d bytes) to be smaller than json encoding (%d bytes)", index, len(binData), len(jsonData))
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec tracer.Codec) {
+	records := testRecords()[:4]
+
+	var size int
+	for _, rec := range records {
+		data, _ := codec.Marshal(&rec)
+		size += len(data)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := records[i%len(records)]
+		data, err := codec.Marshal(&rec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = tracer.UnmarshalRecord(data, &rec)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size)/float64(len(records)), "bytes/record")
+}
+
+func BenchmarkJSONCodec(b *testing.B) {
+	benchmarkCodec(b, tracer.JSONCodec)
+}
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	benchmarkCodec(b, tracer.BinaryCodec)
+}
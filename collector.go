@@ -1,6 +1,10 @@
 package tracer
 
-import "time"
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
 
 type Collector struct {
 	// A set of tokens for bounding the number of concurrent trace records that can be handled
@@ -15,6 +19,12 @@ type Collector struct {
 	// This method is invoked when a trace is received. This method is
 	// stubbed when running unit tests.
 	OnTraceAdded func(rec *Record)
+
+	// The processors that are applied to each trace record before it is stored.
+	processors []Processor
+
+	// A timeout for storing a trace record. A value of 0 indicates no timeout.
+	storeTimeout time.Duration
 }
 
 // Create a new collector using the supplied storage and allocate a processing queue with depth equal
@@ -45,7 +55,25 @@ func (c *Collector) Add(rec *Record) bool {
 				c.tokens <- token
 			}()
 
-			c.Storage.Store(rec, c.tracettl)
+			// Run the processor chain on a copy of the record so processors
+			// can safely modify it
+			if len(c.processors) > 0 {
+				rec = rec.clone()
+				for _, processor := range c.processors {
+					if !processor.Process(rec) {
+						return
+					}
+				}
+			}
+
+			ctxStorage, isCtxStorage := c.Storage.(ContextStorage)
+			if c.storeTimeout > 0 && isCtxStorage {
+				ctx, cancel := context.WithTimeout(context.Background(), c.storeTimeout)
+				ctxStorage.StoreContext(ctx, rec, c.tracettl)
+				cancel()
+			} else {
+				c.Storage.Store(rec, c.tracettl)
+			}
 			if c.OnTraceAdded != nil {
 				c.OnTraceAdded(rec)
 			}
@@ -56,3 +84,23 @@ func (c *Collector) Add(rec *Record) bool {
 		return false
 	}
 }
+
+// Append a list of processors to the collector processor chain. Processors are
+// invoked in the order they were added before each trace record is stored. If a
+// processor drops a record, the remaining processors are not invoked and the record
+// is discarded.
+//
+// This method is not safe for concurrent use and should be invoked before adding
+// any trace records to the collector.
+func (c *Collector) Use(processors ...Processor) {
+	c.processors = append(c.processors, processors...)
+}
+
+// Set a timeout for storing each trace record. The timeout only applies to storage
+// engines that implement the ContextStorage interface. Other engines cannot abort a
+// pending store operation so their records are stored without a timeout; this
+// ensures that the queue size always bounds the number of pending store operations.
+// A value of 0 (the default) disables the timeout.
+func (c *Collector) SetStoreTimeout(timeout time.Duration) {
+	c.storeTimeout = timeout
+}
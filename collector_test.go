@@ -1,6 +1,7 @@
 package tracer_test
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -116,3 +117,77 @@ func TestCollectorQueueOverrun(t *testing.T) {
 	// Unblock trace 1
 	wait <- struct{}{}
 }
+
+func TestCollectorProcessors(t *testing.T) {
+	collector, err := tracer.NewCollector(storage.Memory, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	defer collector.Storage.Close()
+
+	var mutex sync.Mutex
+	var order []string
+	invoked := func(name string) []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if name != "" {
+			order = append(order, name)
+		}
+		return append([]string{}, order...)
+	}
+	collector.Use(
+		tracer.ProcessorFunc(func(rec *tracer.Record) bool {
+			invoked("first")
+			return rec.From != "com.healthcheck"
+		}),
+		tracer.RedactEmails(),
+		tracer.ProcessorFunc(func(rec *tracer.Record) bool {
+			invoked("last")
+			return true
+		}),
+	)
+
+	processed := make(chan *tracer.Record, 10)
+	collector.OnTraceAdded = func(rec *tracer.Record) {
+		processed <- rec
+	}
+
+	// Dropped records should not reach the remaining processors or the storage
+	collector.Add(&tracer.Record{From: "com.healthcheck", TraceId: "dropped"})
+	select {
+	case rec := <-processed:
+		t.Fatalf("expected record to be dropped; got %v", rec)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if order := invoked(""); len(order) != 1 {
+		t.Fatalf("expected only the first processor to be invoked; got %v", order)
+	}
+
+	tags := map[string]string{"user": "john@example.com"}
+	orig := &tracer.Record{From: "com.service", TraceId: "kept", Tags: tags}
+	collector.Add(orig)
+
+	var rec *tracer.Record
+	select {
+	case rec = <-processed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("trace was not handled after 5 sec")
+	}
+	if rec.Tags["user"] != "[email]" {
+		t.Fatalf("expected stored record to be redacted; got %v", rec.Tags)
+	}
+	if tags["user"] != "john@example.com" || orig.Tags["user"] != "john@example.com" {
+		t.Fatalf("expected processors not to modify the original record")
+	}
+	if order := invoked(""); len(order) != 3 || order[1] != "first" || order[2] != "last" {
+		t.Fatalf("expected processors to be invoked in order; got %v", order)
+	}
+
+	trace, err := collector.Storage.GetTrace("dropped")
+	if err != nil {
+		t.Fatalf("Error retrieving trace: %v", err)
+	}
+	if len(trace) != 0 {
+		t.Fatalf("expected dropped record not to be stored; got %v", trace)
+	}
+}
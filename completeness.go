@@ -0,0 +1,80 @@
+package tracer
+
+// The Completeness of a trace describes whether all records of a trace have been
+// stored. As trace records are stored asynchronously, a trace that is fetched right
+// after the request completes may still be missing some of its records.
+type Completeness struct {
+	// True if all requests have been matched with a response and the root request
+	// has finished.
+	Complete bool `json:"complete"`
+
+	// True if the response to the root (earliest) request has been recorded.
+	RootFinished bool `json:"root_finished"`
+
+	// Requests without a matching response. These calls are either still pending
+	// or their response records were lost.
+	OrphanedRequests []Record `json:"orphaned_requests"`
+
+	// Responses without a matching request. A trace with unmatched responses is
+	// broken (e.g. because a service did not propagate the trace id) unless the
+	// request records have not been stored yet.
+	UnmatchedResponses []Record `json:"unmatched_responses"`
+}
+
+// Check the completeness of a trace. Requests and responses are paired by their
+// correlation id and kind so that the records emitted by clients and servers for
+// the same call are paired separately.
+func (t Trace) Completeness() Completeness {
+	type callKey struct {
+		corrId string
+		kind   Kind
+	}
+
+	requests := make(map[callKey]int)
+	responses := make(map[callKey]int)
+	var root *Record
+	for index := range t {
+		rec := &t[index]
+		key := callKey{rec.CorrelationId, rec.Kind}
+		switch rec.Type {
+		case Request:
+			requests[key]++
+			if root == nil || rec.Timestamp.Before(root.Timestamp) {
+				root = rec
+			}
+		case Response:
+			responses[key]++
+		}
+	}
+
+	completeness := Completeness{
+		OrphanedRequests:   make([]Record, 0),
+		UnmatchedResponses: make([]Record, 0),
+	}
+	for _, rec := range t {
+		key := callKey{rec.CorrelationId, rec.Kind}
+		switch {
+		case rec.Type == Request && responses[key] == 0:
+			completeness.OrphanedRequests = append(completeness.OrphanedRequests, rec)
+		case rec.Type == Response && requests[key] == 0:
+			completeness.UnmatchedResponses = append(completeness.UnmatchedResponses, rec)
+		}
+	}
+
+	// The root has finished if any response (server or client) for the root call
+	// has been recorded.
+	if root != nil {
+		for _, rec := range t {
+			if rec.Type == Response && rec.CorrelationId == root.CorrelationId {
+				completeness.RootFinished = true
+				break
+			}
+		}
+	}
+
+	completeness.Complete = completeness.RootFinished &&
+		len(completeness.OrphanedRequests) == 0 &&
+		len(completeness.UnmatchedResponses) == 0
+
+	return completeness
+}
@@ -0,0 +1,55 @@
+package tracer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func TestTraceCompleteness(t *testing.T) {
+	now := time.Now()
+	rootReq := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now, CorrelationId: "c-1111"}
+	rootRes := tracer.Record{Type: tracer.Response, From: "com.service2", To: "com.service1", Timestamp: now.Add(4 * time.Second), CorrelationId: "c-1111"}
+	clientReq := tracer.Record{Type: tracer.Request, Kind: tracer.Client, From: "com.service2", To: "com.service3", Timestamp: now.Add(time.Second), CorrelationId: "c-2222"}
+	serverReq := tracer.Record{Type: tracer.Request, From: "com.service2", To: "com.service3", Timestamp: now.Add(time.Second), CorrelationId: "c-2222"}
+	serverRes := tracer.Record{Type: tracer.Response, From: "com.service3", To: "com.service2", Timestamp: now.Add(2 * time.Second), CorrelationId: "c-2222"}
+	clientRes := tracer.Record{Type: tracer.Response, Kind: tracer.Client, From: "com.service3", To: "com.service2", Timestamp: now.Add(2 * time.Second), CorrelationId: "c-2222"}
+
+	type spec struct {
+		trace              tracer.Trace
+		complete           bool
+		rootFinished       bool
+		orphanedRequests   int
+		unmatchedResponses int
+	}
+
+	specs := []spec{
+		{tracer.Trace{}, false, false, 0, 0},
+		{tracer.Trace{rootReq, clientReq, serverReq, serverRes, clientRes, rootRes}, true, true, 0, 0},
+		// Root response has not been stored yet
+		{tracer.Trace{rootReq, clientReq, serverReq, serverRes, clientRes}, false, false, 1, 0},
+		// Client response has not been stored yet
+		{tracer.Trace{rootReq, clientReq, serverReq, serverRes, rootRes}, false, true, 1, 0},
+		// Request records are missing
+		{tracer.Trace{rootReq, serverRes, rootRes}, false, true, 0, 1},
+		// Truncation markers are ignored
+		{tracer.Trace{rootReq, rootRes, tracer.NewTruncationMarker("trace", 2)}, true, true, 0, 0},
+	}
+
+	for index, s := range specs {
+		completeness := s.trace.Completeness()
+		if completeness.Complete != s.complete {
+			t.Fatalf("[spec %d] Expected complete to be %t", index, s.complete)
+		}
+		if completeness.RootFinished != s.rootFinished {
+			t.Fatalf("[spec %d] Expected root finished to be %t", index, s.rootFinished)
+		}
+		if len(completeness.OrphanedRequests) != s.orphanedRequests {
+			t.Fatalf("[spec %d] Expected %d orphaned requests; got %d", index, s.orphanedRequests, len(completeness.OrphanedRequests))
+		}
+		if len(completeness.UnmatchedResponses) != s.unmatchedResponses {
+			t.Fatalf("[spec %d] Expected %d unmatched responses; got %d", index, s.unmatchedResponses, len(completeness.UnmatchedResponses))
+		}
+	}
+}
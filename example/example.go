@@ -33,7 +33,7 @@ var (
 )
 
 type Adder struct {
-	client *usrv.Client
+	client *middleware.Client
 	Server *usrv.Server
 }
 
@@ -131,8 +131,14 @@ func NewAdder(transp usrv.Transport, collector *tracer.Collector) *Adder {
 		return payload, err
 	}
 
+	// Wrap the client so outgoing requests are also traced
+	client, err := middleware.NewClient(usrv.NewClient(transp), collector)
+	if err != nil {
+		panic(err)
+	}
+
 	adder := &Adder{
-		client: usrv.NewClient(transp),
+		client: client,
 		Server: server,
 	}
 
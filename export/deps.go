@@ -0,0 +1,314 @@
+// Package export converts service dependencies and traces into formats that can be
+// processed by third-party tools or embedded into documents.
+//
+// Dependency graphs can be exported as Graphviz DOT, Mermaid flowcharts and GraphML
+// documents. Traces can be exported as PlantUML or Mermaid sequence diagrams or
+// rendered as SVG images.
+package export
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// The Format of an exported document.
+type Format string
+
+// Supported export formats.
+const (
+	DOT     Format = "dot"
+	Mermaid Format = "mermaid"
+	GraphML Format = "graphml"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("export: unsupported format")
+)
+
+// Get the content type for documents exported in this format.
+func (f Format) ContentType() string {
+	switch f {
+	case DOT:
+		return "text/vnd.graphviz; charset=utf-8"
+	case GraphML:
+		return "application/graphml+xml; charset=utf-8"
+	case SVG:
+		return "image/svg+xml"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// An Edge of the dependency graph points from a service to one of its dependencies.
+type Edge struct {
+	From string
+	To   string
+}
+
+// The EdgeMetrics are used for annotating the edges of an exported dependency graph.
+type EdgeMetrics struct {
+	Calls     int64
+	Errors    int64
+	ErrorRate float64
+	P50       time.Duration
+	P99       time.Duration
+
+	// True if the metrics describe all calls served by the called service rather
+	// than only the calls made along the edge.
+	Callee bool
+}
+
+// Get a human-readable label for the metrics. Labels of callee metrics are prefixed
+// with "callee:" so they are not mistaken for per-edge metrics.
+func (m EdgeMetrics) Label() string {
+	label := fmt.Sprintf("%d calls, %.1f%% errors, p99 %s", m.Calls, m.ErrorRate*100, m.P99)
+	if m.Callee {
+		return "callee: " + label
+	}
+	return label
+}
+
+// Build edge metrics from a list of service summaries (as returned by
+// tracer.ServiceCatalog). Storage engines do not track per-edge statistics so each
+// edge is annotated with the metrics of the called service.
+func CalleeMetrics(services []tracer.ServiceSummary) map[Edge]EdgeMetrics {
+	metrics := make(map[Edge]EdgeMetrics)
+	for _, summary := range services {
+		for _, caller := range summary.Callers {
+			metrics[Edge{From: caller, To: summary.Service}] = EdgeMetrics{
+				Calls:     summary.Calls,
+				Errors:    summary.Errors,
+				ErrorRate: summary.ErrorRate,
+				P50:       summary.P50,
+				P99:       summary.P99,
+				Callee:    true,
+			}
+		}
+	}
+	return metrics
+}
+
+// Export a list of service dependencies (as returned by Storage.GetDependencies) in
+// the specified format. The graph nodes include the listed services and their direct
+// dependencies. If metrics is not nil, the edges with an entry in the metrics map are
+// annotated with its values.
+func Dependencies(w io.Writer, format Format, deps []tracer.Dependencies, metrics map[Edge]EdgeMetrics) error {
+	services, edges := graphOf(deps)
+	switch format {
+	case DOT:
+		return writeDOT(w, services, edges, metrics)
+	case Mermaid:
+		return writeMermaidFlowchart(w, services, edges, metrics)
+	case GraphML:
+		return writeGraphML(w, services, edges, metrics)
+	}
+	return ErrUnsupportedFormat
+}
+
+// Get the sorted list of services and edges of a dependency list.
+func graphOf(deps []tracer.Dependencies) ([]string, []Edge) {
+	seen := make(map[string]bool)
+	services := make([]string, 0)
+	addService := func(service string) {
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+
+	seenEdges := make(map[Edge]bool)
+	edges := make([]Edge, 0)
+	for _, dep := range deps {
+		addService(dep.Service)
+		for _, target := range dep.Dependencies {
+			addService(target)
+			edge := Edge{From: dep.Service, To: target}
+			if !seenEdges[edge] {
+				seenEdges[edge] = true
+				edges = append(edges, edge)
+			}
+		}
+	}
+
+	sort.Strings(services)
+	sort.Sort(edgeList(edges))
+	return services, edges
+}
+
+func writeDOT(w io.Writer, services []string, edges []Edge, metrics map[Edge]EdgeMetrics) error {
+	ew := &errWriter{w: w}
+	ew.printf("digraph dependencies {\n")
+	ew.printf("\trankdir=LR;\n")
+	ew.printf("\tnode [shape=box];\n")
+	for _, service := range services {
+		ew.printf("\t%s;\n", dotQuote(service))
+	}
+	for _, edge := range edges {
+		ew.printf("\t%s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		if m, exists := metrics[edge]; exists {
+			ew.printf(" [label=%s]", dotQuote(m.Label()))
+		}
+		ew.printf(";\n")
+	}
+	ew.printf("}\n")
+	return ew.err
+}
+
+func writeMermaidFlowchart(w io.Writer, services []string, edges []Edge, metrics map[Edge]EdgeMetrics) error {
+	// Service names may contain characters that are not valid in mermaid node ids
+	// so nodes are assigned sequential ids and labeled with the service name.
+	ids := make(map[string]string)
+	ew := &errWriter{w: w}
+	ew.printf("flowchart LR\n")
+	for index, service := range services {
+		ids[service] = fmt.Sprintf("n%d", index)
+		ew.printf("\t%s[\"%s\"]\n", ids[service], mermaidEscape(service))
+	}
+	for _, edge := range edges {
+		if m, exists := metrics[edge]; exists {
+			ew.printf("\t%s -->|\"%s\"| %s\n", ids[edge.From], mermaidEscape(m.Label()), ids[edge.To])
+			continue
+		}
+		ew.printf("\t%s --> %s\n", ids[edge.From], ids[edge.To])
+	}
+	return ew.err
+}
+
+// Quote a DOT identifier.
+func dotQuote(val string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val) + `"`
+}
+
+// Escape a mermaid label using mermaid's entity codes.
+func mermaidEscape(val string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(val)
+}
+
+// The GraphML document structure.
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	Id       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	Id          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	Id   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func writeGraphML(w io.Writer, services []string, edges []Edge, metrics map[Edge]EdgeMetrics) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{Id: "name", For: "node", AttrName: "name", AttrType: "string"},
+			{Id: "calls", For: "edge", AttrName: "calls", AttrType: "long"},
+			{Id: "errors", For: "edge", AttrName: "errors", AttrType: "long"},
+			{Id: "error_rate", For: "edge", AttrName: "error_rate", AttrType: "double"},
+			{Id: "p50", For: "edge", AttrName: "p50_ns", AttrType: "long"},
+			{Id: "p99", For: "edge", AttrName: "p99_ns", AttrType: "long"},
+			{Id: "callee", For: "edge", AttrName: "callee_metrics", AttrType: "boolean"},
+		},
+		Graph: graphMLGraph{
+			Id:          "dependencies",
+			EdgeDefault: "directed",
+			Nodes:       make([]graphMLNode, 0, len(services)),
+			Edges:       make([]graphMLEdge, 0, len(edges)),
+		},
+	}
+	for _, service := range services {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			Id:   service,
+			Data: []graphMLData{{Key: "name", Value: service}},
+		})
+	}
+	for _, edge := range edges {
+		e := graphMLEdge{Source: edge.From, Target: edge.To}
+		if m, exists := metrics[edge]; exists {
+			e.Data = []graphMLData{
+				{Key: "calls", Value: strconv.FormatInt(m.Calls, 10)},
+				{Key: "errors", Value: strconv.FormatInt(m.Errors, 10)},
+				{Key: "error_rate", Value: strconv.FormatFloat(m.ErrorRate, 'f', -1, 64)},
+				{Key: "p50", Value: strconv.FormatInt(int64(m.P50), 10)},
+				{Key: "p99", Value: strconv.FormatInt(int64(m.P99), 10)},
+				{Key: "callee", Value: strconv.FormatBool(m.Callee)},
+			}
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// An errWriter stops writing after the first error so that exporters only need to
+// check for errors once.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
+
+// Sort edges by source and target service. Implements sort.Interface
+type edgeList []Edge
+
+func (l edgeList) Len() int {
+	return len(l)
+}
+
+func (l edgeList) Less(i, j int) bool {
+	if l[i].From != l[j].From {
+		return l[i].From < l[j].From
+	}
+	return l[i].To < l[j].To
+}
+
+func (l edgeList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
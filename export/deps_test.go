@@ -0,0 +1,115 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/export"
+)
+
+func testDeps() []tracer.Dependencies {
+	return []tracer.Dependencies{
+		{Service: "com.b", Dependencies: []string{"com.c"}},
+		{Service: "com.a", Dependencies: []string{"com.c", "com.b", "com.c"}},
+	}
+}
+
+func testMetrics() map[export.Edge]export.EdgeMetrics {
+	return export.CalleeMetrics([]tracer.ServiceSummary{
+		{Service: "com.b", Callers: []string{"com.a"}, Calls: 10, Errors: 1, ErrorRate: 0.1, P50: time.Millisecond, P99: 5 * time.Millisecond},
+	})
+}
+
+func TestExportDOT(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.Dependencies(&buf, export.DOT, testDeps(), testMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := `digraph dependencies {
+	rankdir=LR;
+	node [shape=box];
+	"com.a";
+	"com.b";
+	"com.c";
+	"com.a" -> "com.b" [label="callee: 10 calls, 10.0% errors, p99 5ms"];
+	"com.a" -> "com.c";
+	"com.b" -> "com.c";
+}
+`
+	if buf.String() != expOutput {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expOutput, buf.String())
+	}
+}
+
+func TestExportMermaid(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.Dependencies(&buf, export.Mermaid, testDeps(), testMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := `flowchart LR
+	n0["com.a"]
+	n1["com.b"]
+	n2["com.c"]
+	n0 -->|"callee: 10 calls, 10.0% errors, p99 5ms"| n1
+	n0 --> n2
+	n1 --> n2
+`
+	if buf.String() != expOutput {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expOutput, buf.String())
+	}
+}
+
+func TestExportGraphML(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.Dependencies(&buf, export.GraphML, testDeps(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Graph struct {
+			Nodes []struct {
+				Id string `xml:"id,attr"`
+			} `xml:"node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+				Data   []struct {
+					Key string `xml:"key,attr"`
+				} `xml:"data"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}
+	err = xml.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Graph.Nodes) != 3 {
+		t.Fatalf("Expected 3 nodes; got %d", len(doc.Graph.Nodes))
+	}
+	if len(doc.Graph.Edges) != 3 {
+		t.Fatalf("Expected 3 edges; got %d", len(doc.Graph.Edges))
+	}
+	if doc.Graph.Edges[0].Source != "com.a" || doc.Graph.Edges[0].Target != "com.b" {
+		t.Fatalf("Unexpected first edge: %v", doc.Graph.Edges[0])
+	}
+	if len(doc.Graph.Edges[0].Data) != 0 {
+		t.Fatalf("Expected edges without metrics to have no data; got %v", doc.Graph.Edges[0].Data)
+	}
+}
+
+func TestExportUnsupportedFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.Dependencies(&buf, export.Format("png"), testDeps(), nil)
+	if err != export.ErrUnsupportedFormat {
+		t.Fatalf("Expected error %v; got %v", export.ErrUnsupportedFormat, err)
+	}
+}
@@ -0,0 +1,301 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// Supported sequence diagram formats. Sequence diagrams can also be exported in the
+// Mermaid format.
+const (
+	PlantUML Format = "plantuml"
+	SVG      Format = "svg"
+)
+
+// The style of a sequence diagram message.
+type messageStyle int
+
+const (
+	requestMessage messageStyle = iota
+	responseMessage
+	errorMessage
+	pendingMessage
+)
+
+// A message between two sequence diagram participants.
+type message struct {
+	from  int
+	to    int
+	style messageStyle
+	lines []string
+
+	// Additional details about the record that generated the message.
+	details string
+}
+
+// The sequence is a format-independent model of a sequence diagram.
+type sequence struct {
+	title        string
+	participants []string
+	messages     []message
+}
+
+// Export a trace as a sequence diagram in the specified format. The diagram is drawn
+// the same way as the sequence diagram of the web-app: requests are drawn as solid
+// lines, responses as dashed lines labeled with the call roundtrip time and pending
+// calls are labeled as such. Client records are not drawn; they are used for
+// reporting the time spent in the network and in request queues.
+func SequenceDiagram(w io.Writer, format Format, trace tracer.Trace) error {
+	seq := newSequence(trace)
+	switch format {
+	case PlantUML:
+		return writePlantUML(w, seq)
+	case Mermaid:
+		return writeMermaidSequence(w, seq)
+	case SVG:
+		return writeSVG(w, seq)
+	}
+	return ErrUnsupportedFormat
+}
+
+// Build the sequence diagram model for a trace.
+func newSequence(trace tracer.Trace) *sequence {
+	// Storage engines replace the records that exceed their per-trace record cap with
+	// a truncation marker
+	records := make(tracer.Trace, 0, len(trace))
+	for _, rec := range trace {
+		if rec.Type != tracer.Truncated {
+			records = append(records, rec)
+		}
+	}
+	sort.Sort(records)
+
+	seq := &sequence{
+		participants: make([]string, 0),
+		messages:     make([]message, 0),
+	}
+	if len(records) == 0 {
+		seq.title = "no data available"
+		return seq
+	}
+
+	rtt := records[len(records)-1].Timestamp.Sub(records[0].Timestamp)
+	if rtt < time.Millisecond {
+		seq.title = "Roundtrip time: < 1ms"
+	} else {
+		seq.title = fmt.Sprintf("Roundtrip time: %s", rtt.Round(time.Millisecond))
+	}
+
+	// Index server requests that have not received a response yet and the
+	// durations reported by clients
+	pending := make(map[string]bool)
+	for _, rec := range records.Completeness().OrphanedRequests {
+		if rec.Kind != tracer.Client {
+			pending[rec.CorrelationId] = true
+		}
+	}
+	clientDurations := make(map[string]int64)
+	for _, rec := range records {
+		if rec.Kind == tracer.Client && rec.Type == tracer.Response {
+			clientDurations[rec.CorrelationId] = rec.Duration
+		}
+	}
+
+	participants := make(map[string]int)
+	participant := func(service string) int {
+		index, exists := participants[service]
+		if !exists {
+			index = len(seq.participants)
+			participants[service] = index
+			seq.participants = append(seq.participants, service)
+		}
+		return index
+	}
+
+	requestTimestamps := make(map[string]time.Time)
+	for index := range records {
+		rec := &records[index]
+		if rec.Kind == tracer.Client {
+			continue
+		}
+
+		msg := message{
+			from:    participant(rec.From),
+			to:      participant(rec.To),
+			lines:   make([]string, 0),
+			details: recordDetails(rec),
+		}
+		switch {
+		case rec.Type == tracer.Request && pending[rec.CorrelationId]:
+			msg.style = pendingMessage
+			msg.lines = append(msg.lines, "(pending)")
+			requestTimestamps[rec.CorrelationId] = rec.Timestamp
+		case rec.Type == tracer.Request:
+			msg.style = requestMessage
+			requestTimestamps[rec.CorrelationId] = rec.Timestamp
+		default:
+			msg.style = responseMessage
+			if reqTs, exists := requestTimestamps[rec.CorrelationId]; exists {
+				msg.lines = append(msg.lines, callDuration(rec, rec.Timestamp.Sub(reqTs)))
+			}
+
+			// If the call was also traced by the client, report network/queue time
+			if clientDuration, exists := clientDurations[rec.CorrelationId]; exists && rec.Duration != 0 {
+				overhead := clientDuration - rec.Duration
+				if overhead < 0 {
+					overhead = 0
+				}
+				msg.lines = append(msg.lines, fmt.Sprintf("network/queue: %.3fms", float64(overhead)/float64(time.Millisecond)))
+			}
+
+			if rec.ErrorCategory() != "" {
+				msg.style = errorMessage
+				msg.lines = append(msg.lines, errorLabel(rec))
+			}
+		}
+		seq.messages = append(seq.messages, msg)
+	}
+
+	return seq
+}
+
+// Format the roundtrip time of a call. Calls that complete in less than a millisecond
+// are reported using the duration measured by the server.
+func callDuration(rec *tracer.Record, rtt time.Duration) string {
+	if rtt < 0 {
+		rtt = -rtt
+	}
+	if rtt < time.Millisecond {
+		return time.Duration(rec.Duration).Round(time.Microsecond).String()
+	}
+	return rtt.Round(time.Millisecond).String()
+}
+
+// Generate the label for a failed call. Only the first line of the error message is
+// included (panic errors include a stack trace).
+func errorLabel(rec *tracer.Record) string {
+	if rec.ErrorInfo == nil {
+		return firstLine(rec.Error)
+	}
+	code := ""
+	if rec.ErrorInfo.Code != "" {
+		code = " " + rec.ErrorInfo.Code
+	}
+	return fmt.Sprintf("[%s%s] %s", rec.ErrorInfo.Category, code, firstLine(rec.ErrorInfo.Message))
+}
+
+// Describe the host, payload, tags and error of a record.
+func recordDetails(rec *tracer.Record) string {
+	lines := []string{
+		fmt.Sprintf("%s %s -> %s (%s)", rec.Type, rec.From, rec.To, rec.Host),
+		"payload: " + formatSize(rec.PayloadSize),
+	}
+	if rec.PayloadHash != "" {
+		lines = append(lines, "fingerprint: "+rec.PayloadHash)
+	}
+	if rec.PayloadPreview != "" {
+		lines = append(lines, "preview: "+rec.PayloadPreview)
+	}
+	keys := make([]string, 0, len(rec.Tags))
+	for key := range rec.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+": "+rec.Tags[key])
+	}
+	if rec.Error != "" {
+		lines = append(lines, "error: "+rec.Error)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Format a payload size.
+func formatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+}
+
+func firstLine(val string) string {
+	if index := strings.IndexByte(val, '\n'); index != -1 {
+		return val[:index]
+	}
+	return val
+}
+
+func writePlantUML(w io.Writer, seq *sequence) error {
+	ew := &errWriter{w: w}
+	ew.printf("@startuml\n")
+	ew.printf("title %s\n", seq.title)
+	for index, service := range seq.participants {
+		ew.printf("participant \"%s\" as p%d\n", strings.Replace(service, `"`, `'`, -1), index)
+	}
+	for _, msg := range seq.messages {
+		var arrow string
+		switch msg.style {
+		case requestMessage:
+			arrow = "->"
+		case responseMessage:
+			arrow = "-->"
+		case errorMessage:
+			arrow = "-[#red]->"
+		case pendingMessage:
+			arrow = "-[#gray]->"
+		}
+		ew.printf("p%d %s p%d", msg.from, arrow, msg.to)
+		if len(msg.lines) > 0 {
+			ew.printf(" : %s", strings.Join(msg.lines, `\n`))
+		}
+		ew.printf("\n")
+	}
+	ew.printf("@enduml\n")
+	return ew.err
+}
+
+func writeMermaidSequence(w io.Writer, seq *sequence) error {
+	ew := &errWriter{w: w}
+	ew.printf("sequenceDiagram\n")
+	ew.printf("\ttitle %s\n", mermaidSequenceEscape(seq.title))
+	for index, service := range seq.participants {
+		ew.printf("\tparticipant p%d as %s\n", index, mermaidSequenceEscape(service))
+	}
+	for _, msg := range seq.messages {
+		var arrow string
+		switch msg.style {
+		case requestMessage:
+			arrow = "->>"
+		case responseMessage:
+			arrow = "-->>"
+		case errorMessage:
+			arrow = "--x"
+		case pendingMessage:
+			arrow = "-)"
+		}
+		lines := make([]string, len(msg.lines))
+		for index, line := range msg.lines {
+			lines[index] = mermaidSequenceEscape(line)
+		}
+		ew.printf("\tp%d%sp%d:", msg.from, arrow, msg.to)
+		if len(lines) > 0 {
+			ew.printf(" %s", strings.Join(lines, "<br/>"))
+		}
+		ew.printf("\n")
+	}
+	return ew.err
+}
+
+// Escape the characters that mermaid treats as statement separators or comments
+// using mermaid's entity codes.
+func mermaidSequenceEscape(val string) string {
+	return strings.NewReplacer("#", "#35;", ";", "#59;", "%", "#37;", "\n", " ").Replace(val)
+}
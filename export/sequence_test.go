@@ -0,0 +1,136 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/export"
+)
+
+// com.a calls com.b which calls com.c (failed) and com.d (pending).
+func testTrace() tracer.Trace {
+	start := time.Date(2015, 7, 1, 12, 0, 0, 0, time.UTC)
+	return tracer.Trace{
+		{Timestamp: start, CorrelationId: "1", Type: tracer.Request, From: "com.a", To: "com.b"},
+		{Timestamp: start.Add(1 * time.Millisecond), CorrelationId: "2", Type: tracer.Request, From: "com.b", To: "com.c"},
+		{Timestamp: start.Add(3 * time.Millisecond), CorrelationId: "2", Type: tracer.Response, From: "com.c", To: "com.b", Duration: int64(2 * time.Millisecond),
+			Error: "timeout\nstack", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryTimeout, Code: "504", Message: "timeout\nstack"}},
+		{Timestamp: start.Add(4 * time.Millisecond), CorrelationId: "3", Type: tracer.Request, From: "com.b", To: "com.d"},
+		{Timestamp: start.Add(5 * time.Millisecond), CorrelationId: "1", Type: tracer.Response, From: "com.b", To: "com.a", Duration: int64(5 * time.Millisecond)},
+		{Timestamp: start.Add(6 * time.Millisecond), CorrelationId: "1", Type: tracer.Response, Kind: tracer.Client, From: "com.b", To: "com.a", Duration: int64(6 * time.Millisecond)},
+	}
+}
+
+func TestExportPlantUML(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.SequenceDiagram(&buf, export.PlantUML, testTrace())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := `@startuml
+title Roundtrip time: 6ms
+participant "com.a" as p0
+participant "com.b" as p1
+participant "com.c" as p2
+participant "com.d" as p3
+p0 -> p1
+p1 -> p2
+p2 -[#red]-> p1 : 2ms\n[timeout 504] timeout
+p1 -[#gray]-> p3 : (pending)
+p1 --> p0 : 5ms\nnetwork/queue: 1.000ms
+@enduml
+`
+	if buf.String() != expOutput {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expOutput, buf.String())
+	}
+}
+
+func TestExportMermaidSequence(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.SequenceDiagram(&buf, export.Mermaid, testTrace())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := `sequenceDiagram
+	title Roundtrip time: 6ms
+	participant p0 as com.a
+	participant p1 as com.b
+	participant p2 as com.c
+	participant p3 as com.d
+	p0->>p1:
+	p1->>p2:
+	p2--xp1: 2ms<br/>[timeout 504] timeout
+	p1-)p3: (pending)
+	p1-->>p0: 5ms<br/>network/queue: 1.000ms
+`
+	if buf.String() != expOutput {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expOutput, buf.String())
+	}
+}
+
+func TestExportSVG(t *testing.T) {
+	trace := testTrace()
+	trace[0].Tags = map[string]string{"user": "<admin>"}
+
+	var buf bytes.Buffer
+	err := export.SequenceDiagram(&buf, export.SVG, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		XMLName xml.Name
+		Texts   []string `xml:"text"`
+		Groups  []struct {
+			Title string   `xml:"title"`
+			Texts []string `xml:"text"`
+		} `xml:"g"`
+	}
+	err = xml.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("Expected a valid SVG document; got error %v\n%s", err, buf.String())
+	}
+
+	if doc.XMLName.Local != "svg" {
+		t.Fatalf("Expected root element to be svg; got %s", doc.XMLName.Local)
+	}
+
+	// Title plus top and bottom actor boxes
+	if len(doc.Texts) != 9 || doc.Texts[0] != "Roundtrip time: 6ms" {
+		t.Fatalf("Unexpected texts: %v", doc.Texts)
+	}
+	if len(doc.Groups) != 5 {
+		t.Fatalf("Expected 5 messages; got %d", len(doc.Groups))
+	}
+	if !strings.Contains(doc.Groups[0].Title, "user: <admin>") {
+		t.Fatalf("Expected message details to include tags; got %q", doc.Groups[0].Title)
+	}
+	expTexts := []string{"2ms", "[timeout 504] timeout"}
+	if strings.Join(doc.Groups[2].Texts, "|") != strings.Join(expTexts, "|") {
+		t.Fatalf("Expected error message labels %v; got %v", expTexts, doc.Groups[2].Texts)
+	}
+}
+
+func TestExportEmptyTrace(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.SequenceDiagram(&buf, export.PlantUML, tracer.Trace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := "@startuml\ntitle no data available\n@enduml\n"
+	if buf.String() != expOutput {
+		t.Fatalf("Expected output:\n%s\ngot:\n%s", expOutput, buf.String())
+	}
+
+	err = export.SequenceDiagram(&buf, export.DOT, tracer.Trace{})
+	if err != export.ErrUnsupportedFormat {
+		t.Fatalf("Expected error %v; got %v", export.ErrUnsupportedFormat, err)
+	}
+}
@@ -0,0 +1,171 @@
+package export
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"unicode/utf8"
+)
+
+// Layout settings for SVG sequence diagrams. Text widths are estimated from the
+// number of characters as the renderer has no access to font metrics.
+const (
+	svgMargin        = 20
+	svgFontSize      = 12
+	svgCharWidth     = 7
+	svgLineHeight    = 14
+	svgActorHeight   = 30
+	svgActorPadding  = 10
+	svgMessageGap    = 16
+	svgSelfCallWidth = 30
+)
+
+// The stroke color of each message style.
+var svgColors = map[messageStyle]string{
+	requestMessage:  "#000000",
+	responseMessage: "#000000",
+	errorMessage:    "#c0392b",
+	pendingMessage:  "#888888",
+}
+
+// Render a sequence diagram as a standalone SVG document.
+func writeSVG(w io.Writer, seq *sequence) error {
+	// Position the participant lifelines so that actor boxes and message labels
+	// do not overlap
+	widths := make([]int, len(seq.participants))
+	for index, service := range seq.participants {
+		widths[index] = textWidth(service) + 2*svgActorPadding
+	}
+	gaps := make([]int, len(seq.participants))
+	for index := 1; index < len(seq.participants); index++ {
+		gaps[index] = widths[index-1]/2 + widths[index]/2 + svgActorPadding
+	}
+	selfCallWidth := 0
+	for _, msg := range seq.messages {
+		labelWidth := 0
+		for _, line := range msg.lines {
+			if width := textWidth(line); width > labelWidth {
+				labelWidth = width
+			}
+		}
+
+		lo, hi := msg.from, msg.to
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		required := labelWidth + 2*svgActorPadding
+		if lo == hi {
+			// Self calls are drawn to the right of the lifeline
+			required += svgSelfCallWidth
+			if hi == len(seq.participants)-1 {
+				if required > selfCallWidth {
+					selfCallWidth = required
+				}
+				continue
+			}
+			hi++
+		}
+		span := 0
+		for index := lo + 1; index <= hi; index++ {
+			span += gaps[index]
+		}
+		if span < required {
+			gaps[hi] += required - span
+		}
+	}
+
+	xs := make([]int, len(seq.participants))
+	width := 2*svgMargin + textWidth(seq.title)
+	for index := range seq.participants {
+		xs[index] = svgMargin + widths[0]/2
+		if index > 0 {
+			xs[index] = xs[index-1] + gaps[index]
+		}
+		if right := xs[index] + widths[index]/2 + svgMargin; right > width {
+			width = right
+		}
+	}
+	if len(xs) > 0 && xs[len(xs)-1]+selfCallWidth+svgMargin > width {
+		width = xs[len(xs)-1] + selfCallWidth + svgMargin
+	}
+
+	// Calculate the vertical position of each message
+	actorTop := svgMargin + svgLineHeight + svgMessageGap
+	y := actorTop + svgActorHeight + svgMessageGap
+	ys := make([]int, len(seq.messages))
+	for index, msg := range seq.messages {
+		y += len(msg.lines)*svgLineHeight + 4
+		ys[index] = y
+		if msg.from == msg.to {
+			y += svgMessageGap
+		}
+		y += svgMessageGap
+	}
+	actorBottom := y
+	height := actorBottom + svgMargin
+	if len(seq.participants) > 0 {
+		height += svgActorHeight
+	}
+
+	ew := &errWriter{w: w}
+	ew.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="%d">`+"\n", width, height, width, height, svgFontSize)
+	ew.printf("<defs>\n")
+	for _, style := range []messageStyle{requestMessage, errorMessage, pendingMessage} {
+		ew.printf(`<marker id="arrow%d" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto"><path d="M0,0 L10,5 L0,10 z" fill="%s"/></marker>`+"\n", style, svgColors[style])
+	}
+	ew.printf("</defs>\n")
+	ew.printf(`<rect width="100%%" height="100%%" fill="#ffffff"/>` + "\n")
+	ew.printf(`<text x="%d" y="%d" text-anchor="middle" font-weight="bold">%s</text>`+"\n", width/2, svgMargin+svgLineHeight-2, svgEscape(seq.title))
+
+	// Draw lifelines and actor boxes
+	for index, service := range seq.participants {
+		ew.printf(`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888888"/>`+"\n", xs[index], actorTop+svgActorHeight, xs[index], actorBottom)
+		for _, top := range []int{actorTop, actorBottom} {
+			ew.printf(`<rect x="%d" y="%d" width="%d" height="%d" fill="#ffffff" stroke="#000000"/>`+"\n", xs[index]-widths[index]/2, top, widths[index], svgActorHeight)
+			ew.printf(`<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n", xs[index], top+svgActorHeight/2+svgFontSize/2-2, svgEscape(service))
+		}
+	}
+
+	// Draw messages
+	for index, msg := range seq.messages {
+		marker := msg.style
+		if marker == responseMessage {
+			marker = requestMessage
+		}
+		stroke := svgColors[msg.style]
+		dash := ""
+		if msg.style != requestMessage {
+			dash = ` stroke-dasharray="6,4"`
+		}
+
+		ew.printf("<g>\n<title>%s</title>\n", svgEscape(msg.details))
+		from, to, arrowY := xs[msg.from], xs[msg.to], ys[index]
+		labelX, anchor := (from+to)/2, "middle"
+		if msg.from == msg.to {
+			ew.printf(`<path d="M%d,%d H%d V%d H%d" fill="none" stroke="%s"%s marker-end="url(#arrow%d)"/>`+"\n", from, arrowY, from+svgSelfCallWidth, arrowY+svgMessageGap, from, stroke, dash, marker)
+			labelX, anchor = from+svgSelfCallWidth+4, "start"
+		} else {
+			ew.printf(`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"%s marker-end="url(#arrow%d)"/>`+"\n", from, arrowY, to, arrowY, stroke, dash, marker)
+		}
+		for lineIndex, line := range msg.lines {
+			lineY := arrowY - 4 - (len(msg.lines)-1-lineIndex)*svgLineHeight
+			ew.printf(`<text x="%d" y="%d" text-anchor="%s" fill="%s">%s</text>`+"\n", labelX, lineY, anchor, stroke, svgEscape(line))
+		}
+		ew.printf("</g>\n")
+	}
+
+	ew.printf("</svg>\n")
+	return ew.err
+}
+
+// Estimate the rendered width of a text.
+func textWidth(val string) int {
+	return utf8.RuneCountInString(val) * svgCharWidth
+}
+
+// Escape a value for use as SVG text content.
+func svgEscape(val string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(val))
+	return buf.String()
+}
@@ -0,0 +1,134 @@
+package tracer
+
+import (
+	stdcontext "context"
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+type ErrorCategory string
+
+// The categories used for classifying failed requests.
+const (
+	// The request did not complete before its deadline.
+	CategoryTimeout ErrorCategory = "timeout"
+
+	// The request was canceled by the caller.
+	CategoryCanceled ErrorCategory = "canceled"
+
+	// The request was rejected due to a caller error (e.g. invalid arguments).
+	CategoryClient ErrorCategory = "client"
+
+	// The request failed due to an error in the service that processed it.
+	CategoryServer ErrorCategory = "server"
+)
+
+// The ErrorInfo structure contains the classification of a request failure.
+type ErrorInfo struct {
+	Code     string        `json:"code,omitempty"`
+	Category ErrorCategory `json:"category"`
+	Message  string        `json:"message"`
+}
+
+// The ClassifiedError interface is implemented by errors that provide their own
+// error code and category.
+type ClassifiedError interface {
+	error
+	ErrorCode() string
+	ErrorCategory() ErrorCategory
+}
+
+// A basic ClassifiedError implementation.
+type classifiedError struct {
+	code     string
+	category ErrorCategory
+	message  string
+}
+
+func (e *classifiedError) Error() string {
+	return e.message
+}
+
+func (e *classifiedError) ErrorCode() string {
+	return e.code
+}
+
+func (e *classifiedError) ErrorCategory() ErrorCategory {
+	return e.category
+}
+
+// Create a new error with the specified category and code. Handlers can return
+// such errors so that failures are classified correctly in emitted records.
+func NewError(category ErrorCategory, code, message string) error {
+	return &classifiedError{code: code, category: category, message: message}
+}
+
+// Classify an error. Errors that implement ClassifiedError report their own code and
+// category. Context deadline errors (of either the standard library or the x/net
+// context package) and errors that implement a Timeout() method returning true
+// (e.g. net.Error) are classified as timeouts. Context cancelation errors are
+// classified as canceled. Any other error is classified as a server error.
+//
+// Returns nil if err is nil.
+func ClassifyError(err error) *ErrorInfo {
+	if err == nil {
+		return nil
+	}
+
+	info := &ErrorInfo{
+		Category: CategoryServer,
+		Message:  err.Error(),
+	}
+
+	var classified ClassifiedError
+	var timeout interface {
+		Timeout() bool
+	}
+	switch {
+	case errors.As(err, &classified):
+		info.Code = classified.ErrorCode()
+		info.Category = classified.ErrorCategory()
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, stdcontext.DeadlineExceeded):
+		info.Code = "DEADLINE_EXCEEDED"
+		info.Category = CategoryTimeout
+	case errors.Is(err, context.Canceled) || errors.Is(err, stdcontext.Canceled):
+		info.Code = "CANCELED"
+		info.Category = CategoryCanceled
+	case errors.As(err, &timeout) && timeout.Timeout():
+		info.Code = "TIMEOUT"
+		info.Category = CategoryTimeout
+	}
+
+	return info
+}
+
+// Get the category of the error reported by a record. Records without an ErrorInfo
+// that report an error (e.g. records emitted by older versions of the middleware)
+// are classified as server errors. Returns an empty string if the record does not
+// report an error.
+func (r *Record) ErrorCategory() ErrorCategory {
+	if r.ErrorInfo != nil {
+		return r.ErrorInfo.Category
+	}
+	if r.Error != "" {
+		return CategoryServer
+	}
+	return ""
+}
+
+// Count the failed requests in the trace grouped by error category. Only server
+// response records are taken into account so that each failed call is counted once.
+func (t Trace) Failures() map[ErrorCategory]int {
+	failures := make(map[ErrorCategory]int)
+	for index := range t {
+		rec := &t[index]
+		if rec.Type != Response || rec.Kind != Server {
+			continue
+		}
+		if category := rec.ErrorCategory(); category != "" {
+			failures[category]++
+		}
+	}
+	return failures
+}
@@ -0,0 +1,83 @@
+package tracer_test
+
+import (
+	stdcontext "context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/achilleasa/usrv-tracer"
+	"golang.org/x/net/context"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	type spec struct {
+		err      error
+		code     string
+		category tracer.ErrorCategory
+	}
+
+	specs := []spec{
+		{errors.New("oops"), "", tracer.CategoryServer},
+		{tracer.NewError(tracer.CategoryClient, "INVALID_ARGS", "invalid args"), "INVALID_ARGS", tracer.CategoryClient},
+		{fmt.Errorf("wrapped: %w", tracer.NewError(tracer.CategoryClient, "INVALID_ARGS", "invalid args")), "INVALID_ARGS", tracer.CategoryClient},
+		{context.DeadlineExceeded, "DEADLINE_EXCEEDED", tracer.CategoryTimeout},
+		{context.Canceled, "CANCELED", tracer.CategoryCanceled},
+		{stdcontext.DeadlineExceeded, "DEADLINE_EXCEEDED", tracer.CategoryTimeout},
+		{fmt.Errorf("wrapped: %w", stdcontext.Canceled), "CANCELED", tracer.CategoryCanceled},
+		{timeoutError{}, "TIMEOUT", tracer.CategoryTimeout},
+	}
+
+	for index, s := range specs {
+		info := tracer.ClassifyError(s.err)
+		if info == nil {
+			t.Fatalf("[spec %d] expected ClassifyError to return a non-nil ErrorInfo", index)
+		}
+		if info.Code != s.code {
+			t.Fatalf("[spec %d] expected code to be %q; got %q", index, s.code, info.Code)
+		}
+		if info.Category != s.category {
+			t.Fatalf("[spec %d] expected category to be %q; got %q", index, s.category, info.Category)
+		}
+		if info.Message != s.err.Error() {
+			t.Fatalf("[spec %d] expected message to be %q; got %q", index, s.err.Error(), info.Message)
+		}
+	}
+
+	if tracer.ClassifyError(nil) != nil {
+		t.Fatalf("expected ClassifyError(nil) to return nil")
+	}
+}
+
+func TestTraceFailures(t *testing.T) {
+	trace := tracer.Trace{
+		{Type: tracer.Request, Error: "ignored"},
+		{Type: tracer.Response},
+		{Type: tracer.Response, Error: "legacy error"},
+		{Type: tracer.Response, Error: "timeout", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryTimeout}},
+		{Type: tracer.Response, Kind: tracer.Client, Error: "timeout", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryTimeout}},
+		{Type: tracer.Response, Error: "bad args", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryClient}},
+		{Type: tracer.Response, Error: "bad args", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryClient}},
+	}
+
+	expected := map[tracer.ErrorCategory]int{
+		tracer.CategoryServer:  1,
+		tracer.CategoryTimeout: 1,
+		tracer.CategoryClient:  2,
+	}
+	failures := trace.Failures()
+	if len(failures) != len(expected) {
+		t.Fatalf("expected failures to be %v; got %v", expected, failures)
+	}
+	for category, count := range expected {
+		if failures[category] != count {
+			t.Fatalf("expected %d %s failures; got %d", count, category, failures[category])
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package tracer
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrDependencyCycle = errors.New("tracer: dependency graph contains cycles")
+)
+
+// A DependencyGraph is a directed graph whose nodes are services and whose edges
+// point from each service to its dependencies.
+type DependencyGraph struct {
+	services []string
+	edges    map[string][]string
+}
+
+// A DependencyTree is a spanning tree of the dependencies of a service. Services
+// that are reachable via multiple paths appear only once in the tree.
+type DependencyTree struct {
+	Service  string            `json:"name"`
+	Children []*DependencyTree `json:"children"`
+}
+
+// The DependencyStats describes the position of a service in the dependency graph.
+type DependencyStats struct {
+	Service string `json:"service"`
+
+	// The number of direct dependencies and direct dependents of the service.
+	FanOut int `json:"fan_out"`
+	FanIn  int `json:"fan_in"`
+
+	// The length of the longest dependency chain starting at this service. Services
+	// that belong to the same cycle share the same depth.
+	Depth int `json:"depth"`
+
+	// The number of direct and indirect dependencies of the service.
+	Transitive int `json:"transitive"`
+}
+
+// The GraphAnalysis summarizes the structure of a dependency graph.
+type GraphAnalysis struct {
+	Services  int `json:"services"`
+	Edges     int `json:"edges"`
+	MaxDepth  int `json:"max_depth"`
+	MaxFanOut int `json:"max_fan_out"`
+	MaxFanIn  int `json:"max_fan_in"`
+
+	// The dependency cycles in the graph.
+	Cycles [][]string `json:"cycles"`
+
+	// The services ordered so that each service appears after its dependencies. It
+	// is empty if the graph contains cycles.
+	Order []string `json:"order"`
+
+	// Per-service statistics sorted by service name.
+	Stats []DependencyStats `json:"stats"`
+}
+
+// Create a dependency graph from a list of service dependencies (as returned by
+// Storage.GetDependencies). Graphs built from the output of Storage.GetDependents
+// have their edges reversed; their closures list the transitive dependents of each
+// service.
+func NewDependencyGraph(deps []Dependencies) *DependencyGraph {
+	g := &DependencyGraph{
+		services: make([]string, 0),
+		edges:    make(map[string][]string),
+	}
+
+	addService := func(service string) {
+		if _, exists := g.edges[service]; !exists {
+			g.edges[service] = make([]string, 0)
+			g.services = append(g.services, service)
+		}
+	}
+
+	for _, dep := range deps {
+		addService(dep.Service)
+		for _, target := range dep.Dependencies {
+			addService(target)
+			if !containsString(g.edges[dep.Service], target) {
+				g.edges[dep.Service] = append(g.edges[dep.Service], target)
+			}
+		}
+	}
+
+	sort.Strings(g.services)
+	for _, targets := range g.edges {
+		sort.Strings(targets)
+	}
+	return g
+}
+
+// Get the services in the graph sorted by name.
+func (g *DependencyGraph) Services() []string {
+	return g.services
+}
+
+// Get the direct dependencies of a service sorted by name.
+func (g *DependencyGraph) Dependencies(service string) []string {
+	return g.edges[service]
+}
+
+// Get the transitive closure of a service, i.e. all services that it depends on
+// directly or indirectly, sorted by name. The service itself is only included if
+// it belongs to a dependency cycle.
+func (g *DependencyGraph) Closure(service string) []string {
+	visited := make(map[string]bool)
+	stack := append([]string(nil), g.edges[service]...)
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		stack = append(stack, g.edges[next]...)
+	}
+
+	closure := make([]string, 0, len(visited))
+	for dep := range visited {
+		closure = append(closure, dep)
+	}
+	sort.Strings(closure)
+	return closure
+}
+
+// Build a spanning tree of the dependencies of a service using a depth-first
+// traversal. Returns nil if the service is not part of the graph.
+func (g *DependencyGraph) Tree(service string) *DependencyTree {
+	if _, exists := g.edges[service]; !exists {
+		return nil
+	}
+
+	visited := make(map[string]bool)
+	var visit func(service string) *DependencyTree
+	visit = func(service string) *DependencyTree {
+		visited[service] = true
+		node := &DependencyTree{
+			Service:  service,
+			Children: make([]*DependencyTree, 0),
+		}
+		for _, dep := range g.edges[service] {
+			// Skip services that are already part of the tree to avoid loops
+			if visited[dep] {
+				continue
+			}
+			node.Children = append(node.Children, visit(dep))
+		}
+		return node
+	}
+	return visit(service)
+}
+
+// Detect dependency cycles. Each cycle is reported as the list of services that
+// belong to a strongly connected component of the graph, sorted by name. Services
+// that depend on themselves are reported as single-service cycles.
+func (g *DependencyGraph) Cycles() [][]string {
+	cycles := make([][]string, 0)
+	for _, component := range g.components() {
+		if len(component) > 1 || containsString(g.edges[component[0]], component[0]) {
+			cycles = append(cycles, component)
+		}
+	}
+	sort.Sort(serviceGroups(cycles))
+	return cycles
+}
+
+// Get a topological ordering of the graph where each service appears after all of
+// its dependencies (e.g. a valid service start-up order). Services without
+// dependencies between them are ordered by name. Returns ErrDependencyCycle if the
+// graph contains cycles.
+func (g *DependencyGraph) TopologicalOrder() ([]string, error) {
+	// Count the unprocessed dependencies of each service and index its dependents
+	pending := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, service := range g.services {
+		pending[service] = len(g.edges[service])
+		for _, dep := range g.edges[service] {
+			dependents[dep] = append(dependents[dep], service)
+		}
+	}
+
+	ready := make([]string, 0)
+	for _, service := range g.services {
+		if pending[service] == 0 {
+			ready = append(ready, service)
+		}
+	}
+
+	order := make([]string, 0, len(g.services))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		service := ready[0]
+		ready = ready[1:]
+		order = append(order, service)
+		for _, dependent := range dependents[service] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) != len(g.services) {
+		return nil, ErrDependencyCycle
+	}
+	return order, nil
+}
+
+// Analyze the structure of the graph.
+func (g *DependencyGraph) Analyze() GraphAnalysis {
+	analysis := GraphAnalysis{
+		Services: len(g.services),
+		Cycles:   g.Cycles(),
+		Order:    make([]string, 0),
+		Stats:    make([]DependencyStats, 0, len(g.services)),
+	}
+	if order, err := g.TopologicalOrder(); err == nil {
+		analysis.Order = order
+	}
+
+	fanIn := make(map[string]int)
+	for _, service := range g.services {
+		analysis.Edges += len(g.edges[service])
+		for _, dep := range g.edges[service] {
+			fanIn[dep]++
+		}
+	}
+
+	depths := g.depths()
+	for _, service := range g.services {
+		stats := DependencyStats{
+			Service:    service,
+			FanOut:     len(g.edges[service]),
+			FanIn:      fanIn[service],
+			Depth:      depths[service],
+			Transitive: len(g.Closure(service)),
+		}
+		analysis.Stats = append(analysis.Stats, stats)
+
+		if stats.Depth > analysis.MaxDepth {
+			analysis.MaxDepth = stats.Depth
+		}
+		if stats.FanOut > analysis.MaxFanOut {
+			analysis.MaxFanOut = stats.FanOut
+		}
+		if stats.FanIn > analysis.MaxFanIn {
+			analysis.MaxFanIn = stats.FanIn
+		}
+	}
+
+	return analysis
+}
+
+// Calculate the depth of each service. Cycles are collapsed into a single node so
+// the depth is the length of the longest chain of dependencies between strongly
+// connected components.
+func (g *DependencyGraph) depths() map[string]int {
+	componentOf := make(map[string]int)
+	components := g.components()
+	for index, component := range components {
+		for _, service := range component {
+			componentOf[service] = index
+		}
+	}
+
+	// Tarjan's algorithm emits components in reverse topological order so the
+	// dependencies of each component have already been processed.
+	componentDepth := make([]int, len(components))
+	for index, component := range components {
+		for _, service := range component {
+			for _, dep := range g.edges[service] {
+				depIndex := componentOf[dep]
+				if depIndex != index && componentDepth[depIndex]+1 > componentDepth[index] {
+					componentDepth[index] = componentDepth[depIndex] + 1
+				}
+			}
+		}
+	}
+
+	depths := make(map[string]int)
+	for service, index := range componentOf {
+		depths[service] = componentDepth[index]
+	}
+	return depths
+}
+
+// Find the strongly connected components of the graph using Tarjan's algorithm.
+// Components are returned in reverse topological order and the services of each
+// component are sorted by name.
+func (g *DependencyGraph) components() [][]string {
+	index := 0
+	indices := make(map[string]int)
+	lowLinks := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := make([]string, 0)
+	components := make([][]string, 0)
+
+	var connect func(service string)
+	connect = func(service string) {
+		indices[service] = index
+		lowLinks[service] = index
+		index++
+		stack = append(stack, service)
+		onStack[service] = true
+
+		for _, dep := range g.edges[service] {
+			if _, visited := indices[dep]; !visited {
+				connect(dep)
+				if lowLinks[dep] < lowLinks[service] {
+					lowLinks[service] = lowLinks[dep]
+				}
+			} else if onStack[dep] && indices[dep] < lowLinks[service] {
+				lowLinks[service] = indices[dep]
+			}
+		}
+
+		// Pop the component if service is its root
+		if lowLinks[service] != indices[service] {
+			return
+		}
+		component := make([]string, 0)
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			component = append(component, member)
+			if member == service {
+				break
+			}
+		}
+		sort.Strings(component)
+		components = append(components, component)
+	}
+
+	for _, service := range g.services {
+		if _, visited := indices[service]; !visited {
+			connect(service)
+		}
+	}
+	return components
+}
+
+func containsString(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort groups of services by their first service. Implements sort.Interface
+type serviceGroups [][]string
+
+func (s serviceGroups) Len() int {
+	return len(s)
+}
+
+func (s serviceGroups) Less(i, j int) bool {
+	return s[i][0] < s[j][0]
+}
+
+func (s serviceGroups) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
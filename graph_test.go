@@ -0,0 +1,139 @@
+package tracer_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// a -> b -> c -> d, a -> c, e -> f -> e, g
+func testGraph() *tracer.DependencyGraph {
+	return tracer.NewDependencyGraph([]tracer.Dependencies{
+		{Service: "a", Dependencies: []string{"c", "b"}},
+		{Service: "b", Dependencies: []string{"c"}},
+		{Service: "c", Dependencies: []string{"d"}},
+		{Service: "e", Dependencies: []string{"f"}},
+		{Service: "f", Dependencies: []string{"e"}},
+		{Service: "g", Dependencies: []string{}},
+	})
+}
+
+func TestDependencyGraphClosure(t *testing.T) {
+	g := testGraph()
+
+	if !reflect.DeepEqual(g.Services(), []string{"a", "b", "c", "d", "e", "f", "g"}) {
+		t.Fatalf("Unexpected services: %v", g.Services())
+	}
+
+	specs := map[string][]string{
+		"a": {"b", "c", "d"},
+		"c": {"d"},
+		"d": {},
+		"e": {"e", "f"},
+		"x": {},
+	}
+	for service, expClosure := range specs {
+		closure := g.Closure(service)
+		if !reflect.DeepEqual(closure, expClosure) {
+			t.Fatalf("Expected closure of %s to be %v; got %v", service, expClosure, closure)
+		}
+	}
+}
+
+func TestDependencyGraphTree(t *testing.T) {
+	g := testGraph()
+
+	tree := g.Tree("a")
+	leaf := func(service string) *tracer.DependencyTree {
+		return &tracer.DependencyTree{Service: service, Children: []*tracer.DependencyTree{}}
+	}
+	expTree := &tracer.DependencyTree{
+		Service: "a",
+		Children: []*tracer.DependencyTree{
+			{Service: "b", Children: []*tracer.DependencyTree{
+				{Service: "c", Children: []*tracer.DependencyTree{leaf("d")}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(tree, expTree) {
+		t.Fatalf("Unexpected dependency tree for a")
+	}
+
+	tree = g.Tree("e")
+	if len(tree.Children) != 1 || len(tree.Children[0].Children) != 0 {
+		t.Fatalf("Expected cycles to be broken when building the dependency tree")
+	}
+
+	if g.Tree("x") != nil {
+		t.Fatalf("Expected tree of unknown service to be nil")
+	}
+}
+
+func TestDependencyGraphCycles(t *testing.T) {
+	g := tracer.NewDependencyGraph([]tracer.Dependencies{
+		{Service: "a", Dependencies: []string{"b"}},
+		{Service: "b", Dependencies: []string{"c"}},
+		{Service: "c", Dependencies: []string{"a", "d"}},
+		{Service: "d", Dependencies: []string{"d"}},
+		{Service: "e", Dependencies: []string{"a"}},
+	})
+
+	expCycles := [][]string{{"a", "b", "c"}, {"d"}}
+	if cycles := g.Cycles(); !reflect.DeepEqual(cycles, expCycles) {
+		t.Fatalf("Expected cycles to be %v; got %v", expCycles, cycles)
+	}
+
+	if _, err := g.TopologicalOrder(); err != tracer.ErrDependencyCycle {
+		t.Fatalf("Expected to get ErrDependencyCycle; got %v", err)
+	}
+
+	if cycles := testGraph().Cycles(); !reflect.DeepEqual(cycles, [][]string{{"e", "f"}}) {
+		t.Fatalf("Unexpected cycles: %v", cycles)
+	}
+}
+
+func TestDependencyGraphTopologicalOrder(t *testing.T) {
+	g := tracer.NewDependencyGraph([]tracer.Dependencies{
+		{Service: "a", Dependencies: []string{"c", "b"}},
+		{Service: "b", Dependencies: []string{"c"}},
+		{Service: "c", Dependencies: []string{"d"}},
+		{Service: "e", Dependencies: []string{}},
+	})
+
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expOrder := []string{"d", "c", "b", "a", "e"}
+	if !reflect.DeepEqual(order, expOrder) {
+		t.Fatalf("Expected order to be %v; got %v", expOrder, order)
+	}
+}
+
+func TestDependencyGraphAnalyze(t *testing.T) {
+	analysis := testGraph().Analyze()
+
+	if analysis.Services != 7 || analysis.Edges != 6 {
+		t.Fatalf("Expected 7 services and 6 edges; got %d services and %d edges", analysis.Services, analysis.Edges)
+	}
+	if analysis.MaxDepth != 3 || analysis.MaxFanOut != 2 || analysis.MaxFanIn != 2 {
+		t.Fatalf("Unexpected max depth/fan-out/fan-in: %d, %d, %d", analysis.MaxDepth, analysis.MaxFanOut, analysis.MaxFanIn)
+	}
+	if len(analysis.Order) != 0 {
+		t.Fatalf("Expected order to be empty for cyclic graphs")
+	}
+
+	expStats := map[string]tracer.DependencyStats{
+		"a": {Service: "a", FanOut: 2, FanIn: 0, Depth: 3, Transitive: 3},
+		"c": {Service: "c", FanOut: 1, FanIn: 2, Depth: 1, Transitive: 1},
+		"d": {Service: "d", FanOut: 0, FanIn: 1, Depth: 0, Transitive: 0},
+		"e": {Service: "e", FanOut: 1, FanIn: 1, Depth: 0, Transitive: 2},
+	}
+	for _, stats := range analysis.Stats {
+		exp, exists := expStats[stats.Service]
+		if exists && stats != exp {
+			t.Fatalf("Expected stats for %s to be %+v; got %+v", stats.Service, exp, stats)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+#!/usr/bin/env bash
+
+#
+# Download the third-party libraries listed in vendor.txt and their licenses into
+# static/vendor. The vendored files are embedded into the ui-server binary so the
+# web-app does not depend on public CDNs. Library versions are part of the file
+# names so that browsers can cache them indefinitely.
+#
+# Usage: go generate ./http
+#
+
+set -e
+cd "$(dirname "$0")"
+mkdir -p static/vendor
+
+fetch() {
+    echo "Fetching $2"
+    curl -sSfL -o "static/vendor/$1" "$2"
+}
+
+grep -v '^#' vendor.txt | while read -r file url license licenseUrl; do
+    fetch "$file" "$url"
+    if [ "$license" != "-" ]; then
+        fetch "$license" "$licenseUrl"
+    fi
+done
@@ -10,43 +10,200 @@ import (
 
 	"net/http"
 
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 
 	"strconv"
 
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/achilleasa/usrv-service-adapters"
 	"github.com/achilleasa/usrv-service-adapters/dial"
 	"github.com/achilleasa/usrv-service-adapters/service/etcd"
 	"github.com/achilleasa/usrv-service-adapters/service/redis"
 	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/export"
 	"github.com/achilleasa/usrv-tracer/storage"
 )
 
+var (
+	errInvalidDirection    = errors.New("direction must be either upstream or downstream")
+	errInvalidTimelineMode = errors.New("mode must be either timeline or flame")
+)
+
+//go:generate bash fetch-assets.sh
+
+// The web-app assets. Third-party libraries are vendored under static/vendor so the
+// web-app does not depend on public CDNs.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// The third-party libraries used by the web-app and their download URLs. Libraries
+// that have not been vendored are served by redirecting to their download URL.
+//
+//go:embed vendor.txt
+var vendorManifest string
+
+// A third-party library listed in the vendor manifest.
+type vendorLib struct {
+	file    string
+	url     string
+	license string
+}
+
+// Parse the vendor manifest. Empty lines and lines starting with # are ignored.
+func parseVendorManifest(manifest string) ([]vendorLib, error) {
+	libs := make([]vendorLib, 0)
+	for _, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid vendor manifest entry %q", line)
+		}
+		lib := vendorLib{file: fields[0], url: fields[1]}
+		if fields[2] != "-" {
+			lib.license = fields[2]
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// Cache policies for static assets. Vendored libraries include their version in
+// their file name so they can be cached indefinitely; other assets are revalidated
+// on each request using their ETag.
+const (
+	vendorCacheControl = "public, max-age=31536000, immutable"
+	assetCacheControl  = "no-cache"
+)
+
+// An asset is a static file that is embedded in the server binary. Vendored
+// libraries that are not embedded are served by redirecting to their download URL.
+type asset struct {
+	name         string
+	content      []byte
+	etag         string
+	cacheControl string
+	redirect     string
+}
+
 type server struct {
-	storageEngine tracer.Storage
+	storageEngine tracer.ContextStorage
+	pagedStorage  tracer.PagedStorage
+	catalog       tracer.ServiceCatalog
+
+	// The embedded assets indexed by their URL path.
+	assets map[string]*asset
+
+	// The maximum time for serving a storage query. A value of 0 indicates no timeout.
+	queryTimeout time.Duration
 }
 
 // Create a new http server for reporting trace and dependency details.
-func newServer(storage tracer.Storage) (*server, error) {
+func newServer(storage tracer.Storage, queryTimeout time.Duration) (*server, error) {
+	libs, err := parseVendorManifest(vendorManifest)
+	if err != nil {
+		return nil, err
+	}
+	assets, err := loadAssets(staticFiles, libs)
+	if err != nil {
+		return nil, err
+	}
+
 	return &server{
-		storageEngine: storage,
+		storageEngine: tracer.NewContextStorage(storage),
+		pagedStorage:  tracer.NewPagedStorage(storage),
+		catalog:       tracer.NewServiceCatalog(storage),
+		assets:        assets,
+		queryTimeout:  queryTimeout,
 	}, storage.Dial()
 }
 
+// Load the static assets and index them by their URL path. The index page is also
+// served at the root path. Vendored libraries that are missing from fsys are served
+// from their download URL.
+func loadAssets(fsys fs.FS, libs []vendorLib) (map[string]*asset, error) {
+	assets := make(map[string]*asset)
+	err := fs.WalkDir(fsys, "static", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(content)
+		a := &asset{
+			name:         entry.Name(),
+			content:      content,
+			etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+			cacheControl: assetCacheControl,
+		}
+		if strings.HasPrefix(path, "static/vendor/") {
+			a.cacheControl = vendorCacheControl
+		}
+		assets["/"+path] = a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lib := range libs {
+		path := "/static/vendor/" + lib.file
+		if _, exists := assets[path]; !exists {
+			assets[path] = &asset{name: lib.file, redirect: lib.url}
+		}
+	}
+
+	if index, exists := assets["/static/index.html"]; exists {
+		assets["/"] = index
+	}
+	return assets, nil
+}
+
+// Create a context for a storage query. The context is canceled when the client
+// disconnects or the query timeout expires.
+func (s *server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.queryTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.queryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 // The top-level router for the http server.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handlerFunc := http.NotFound
 
 	if r.Method == "GET" {
-		if strings.HasPrefix(r.URL.Path, "/trace/") {
+		if strings.HasPrefix(r.URL.Path, "/trace/") && strings.HasSuffix(r.URL.Path, "/completeness") {
+			handlerFunc = s.getTraceCompleteness
+		} else if strings.HasPrefix(r.URL.Path, "/trace/") && strings.HasSuffix(r.URL.Path, "/timeline") {
+			handlerFunc = s.getTraceTimeline
+		} else if strings.HasPrefix(r.URL.Path, "/trace/") {
 			handlerFunc = s.getTrace
+		} else if strings.HasPrefix(r.URL.Path, "/deps/") {
+			handlerFunc = s.getDepsAnalysis
 		} else if strings.HasPrefix(r.URL.Path, "/deps") {
 			handlerFunc = s.getDeps
-		} else if r.URL.Path == "/" {
-			handlerFunc = s.getIndex
+		} else if r.URL.Path == "/services" {
+			handlerFunc = s.getServices
+		} else if r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/static/") {
+			handlerFunc = s.getAsset
 		}
 	}
 
@@ -54,25 +211,165 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handlerFunc(w, r)
 }
 
-// Serve the index page.
-func (s *server) getIndex(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "http/static/index.html")
+// Serve an embedded static asset. Conditional requests are answered with
+// 304 Not Modified if the asset ETag has not changed.
+func (s *server) getAsset(w http.ResponseWriter, r *http.Request) {
+	a, exists := s.assets[r.URL.Path]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	if a.redirect != "" {
+		http.Redirect(w, r, a.redirect, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", a.cacheControl)
+	w.Header().Set("ETag", a.etag)
+	http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.content))
 }
 
-// Get trace by id.
+// Get trace by id. The trace can be exported as a sequence diagram by specifying
+// the diagram format (plantuml, mermaid or svg) via the format GET param or by
+// requesting /trace/{id}.svg.
 func (s *server) getTrace(w http.ResponseWriter, r *http.Request) {
 	// Extract trace id from path and load trace
 	traceId := r.URL.Path[7:]
-	trace, err := s.storageEngine.GetTrace(traceId)
+	format := export.Format(r.URL.Query().Get("format"))
+	if strings.HasSuffix(traceId, ".svg") {
+		traceId = strings.TrimSuffix(traceId, ".svg")
+		format = export.SVG
+	}
+
+	// Large traces can be fetched in pages
+	if r.URL.Query().Get("page_size") != "" {
+		s.getTracePage(w, r, traceId)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	trace, err := s.storageEngine.GetTraceContext(ctx, traceId)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	// Optionally compensate for clock skew between hosts and report the applied
+	// adjustments via a response header
+	if r.URL.Query().Get("adjust_skew") == "true" {
+		adjustments, err := json.Marshal(trace.AdjustSkew())
+		if err != nil {
+			s.sendError(w, err)
+			return
+		}
+		w.Header().Set("X-Trace-Skew-Adjustments", string(adjustments))
+	}
+
+	if format != "" && format != "json" {
+		s.sendDocument(w, format, func(w io.Writer) error {
+			return export.SequenceDiagram(w, format, trace)
+		})
+		return
+	}
+
+	// Report the failed calls grouped by error category
+	failures, err := json.Marshal(trace.Failures())
 	if err != nil {
 		s.sendError(w, err)
 		return
 	}
+	w.Header().Set("X-Trace-Failures", string(failures))
+
+	// Report whether all trace records have been stored
+	w.Header().Set("X-Trace-Complete", strconv.FormatBool(trace.Completeness().Complete))
+
+	// Clients may ask for the compact binary encoding via the Accept header
+	if r.Header.Get("Accept") == tracer.BinaryCodec.ContentType() {
+		s.sendTrace(w, tracer.BinaryCodec, trace)
+		return
+	}
 
 	s.send(w, trace)
 }
 
-// Get service dependencies optionally filtered by a list of service names.
+// Get the completeness of a trace.
+func (s *server) getTraceCompleteness(w http.ResponseWriter, r *http.Request) {
+	// Extract trace id from path and load trace
+	traceId := strings.TrimSuffix(r.URL.Path[7:], "/completeness")
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	trace, err := s.storageEngine.GetTraceContext(ctx, traceId)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	s.send(w, trace.Completeness())
+}
+
+// Get the timeline of a trace. If the mode GET param is set to flame, the timeline
+// spans are aggregated into a flame graph. Clock skew between hosts is compensated
+// if the adjust_skew GET param is set to true.
+func (s *server) getTraceTimeline(w http.ResponseWriter, r *http.Request) {
+	// Extract trace id from path and load trace
+	traceId := strings.TrimSuffix(r.URL.Path[7:], "/timeline")
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	trace, err := s.storageEngine.GetTraceContext(ctx, traceId)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("adjust_skew") == "true" {
+		trace.AdjustSkew()
+	}
+
+	timeline := trace.Timeline()
+	switch r.URL.Query().Get("mode") {
+	case "", "timeline":
+		s.send(w, timeline)
+	case "flame":
+		s.send(w, timeline.FlameGraph())
+	default:
+		s.sendError(w, errInvalidTimelineMode)
+	}
+}
+
+// Get a page of trace records. The page size and cursor are specified via the
+// page_size and cursor GET params.
+func (s *server) getTracePage(w http.ResponseWriter, r *http.Request, traceId string) {
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil {
+		s.sendError(w, tracer.ErrInvalidPageSize)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	page, err := s.pagedStorage.GetTracePage(ctx, traceId, r.URL.Query().Get("cursor"), pageSize)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	// Report the failed calls in this page grouped by error category
+	failures, err := json.Marshal(page.Records.Failures())
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+	w.Header().Set("X-Trace-Failures", string(failures))
+
+	s.send(w, page)
+}
+
+// Get service dependencies optionally filtered by a list of service names. The
+// direction GET param selects whether the dependencies (downstream) or the
+// dependents (upstream) of each service are reported. The format GET param selects
+// the export format (dot, mermaid or graphml); dependencies are reported as json if
+// no format is specified.
 func (s *server) getDeps(w http.ResponseWriter, r *http.Request) {
 	// Extract filters from GET params
 	filterVal := r.URL.Query().Get("srv_filter")
@@ -83,13 +380,119 @@ func (s *server) getDeps(w http.ResponseWriter, r *http.Request) {
 		srvFilter = nil
 	}
 
-	trace, err := s.storageEngine.GetDependencies(srvFilter...)
+	deps, err := s.loadDeps(r, srvFilter)
 	if err != nil {
 		s.sendError(w, err)
 		return
 	}
 
-	s.send(w, trace)
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		s.exportDeps(w, r, export.Format(format), deps)
+		return
+	}
+
+	s.send(w, deps)
+}
+
+// Export service dependencies in a graph format. If the metrics GET param is set to
+// true, the graph edges are annotated with the metrics of the called services.
+func (s *server) exportDeps(w http.ResponseWriter, r *http.Request, format export.Format, deps []tracer.Dependencies) {
+	var metrics map[export.Edge]export.EdgeMetrics
+	if r.URL.Query().Get("metrics") == "true" {
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+		services, err := s.catalog.GetServices(ctx)
+		if err != nil {
+			s.sendError(w, err)
+			return
+		}
+		metrics = export.CalleeMetrics(services)
+
+		// The edges of the upstream graph point from each service to its callers
+		if r.URL.Query().Get("direction") == "upstream" {
+			reversed := make(map[export.Edge]export.EdgeMetrics)
+			for edge, m := range metrics {
+				reversed[export.Edge{From: edge.To, To: edge.From}] = m
+			}
+			metrics = reversed
+		}
+	}
+
+	s.sendDocument(w, format, func(w io.Writer) error {
+		return export.Dependencies(w, format, deps, metrics)
+	})
+}
+
+// Analyze the dependency graph of all known services. The direction GET param
+// selects whether the graph edges point to the dependencies (downstream) or the
+// dependents (upstream) of each service. The following endpoints are supported:
+//   - /deps/closure?service=X: the direct and indirect dependencies of X and their spanning tree.
+//   - /deps/cycles: the dependency cycles.
+//   - /deps/order: the services ordered so that each service appears after its dependencies.
+//   - /deps/analysis: depth, fan-in and fan-out statistics, cycles and ordering.
+func (s *server) getDepsAnalysis(w http.ResponseWriter, r *http.Request) {
+	deps, err := s.loadDeps(r, nil)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+	graph := tracer.NewDependencyGraph(deps)
+
+	switch r.URL.Path[6:] {
+	case "closure":
+		service := r.URL.Query().Get("service")
+		tree := graph.Tree(service)
+		if tree == nil {
+			s.sendError(w, fmt.Errorf("unknown service %q", service))
+			return
+		}
+		s.send(w, map[string]interface{}{
+			"service": service,
+			"closure": graph.Closure(service),
+			"tree":    tree,
+		})
+	case "cycles":
+		s.send(w, graph.Cycles())
+	case "order":
+		order, err := graph.TopologicalOrder()
+		if err != nil {
+			s.sendError(w, err)
+			return
+		}
+		s.send(w, order)
+	case "analysis":
+		s.send(w, graph.Analyze())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Load the dependencies (downstream) or the dependents (upstream) of a list of
+// services depending on the direction GET param.
+func (s *server) loadDeps(r *http.Request, srvFilter []string) ([]tracer.Dependencies, error) {
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	switch r.URL.Query().Get("direction") {
+	case "", "downstream":
+		return s.storageEngine.GetDependenciesContext(ctx, srvFilter...)
+	case "upstream":
+		return s.storageEngine.GetDependentsContext(ctx, srvFilter...)
+	}
+	return nil, errInvalidDirection
+}
+
+// Get the summaries of all known services.
+func (s *server) getServices(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	services, err := s.catalog.GetServices(ctx)
+	if err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	s.send(w, services)
 }
 
 // Report error encoded as json.
@@ -105,6 +508,30 @@ func (s *server) sendError(w http.ResponseWriter, err error) {
 	w.Write(data)
 }
 
+// Send a trace encoded with the supplied codec.
+func (s *server) sendTrace(w http.ResponseWriter, codec tracer.Codec, trace tracer.Trace) {
+	data, err := tracer.MarshalTrace(codec, trace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Write(data)
+}
+
+// Send a document generated by an exporter. Export errors are reported as json.
+func (s *server) sendDocument(w http.ResponseWriter, format export.Format, exportFn func(w io.Writer) error) {
+	var buf bytes.Buffer
+	if err := exportFn(&buf); err != nil {
+		s.sendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Write(buf.Bytes())
+}
+
 // Report error encoded as json.
 func (s *server) send(w http.ResponseWriter, payload interface{}) {
 	data, err := json.Marshal(payload)
@@ -123,6 +550,7 @@ var (
 	redisDb       = flag.Int("redis-db", 0, "Redis db number")
 	redisPassword = flag.String("redis-password", "", "Redis password")
 	port          = flag.Int("port", 8080, "The http server port")
+	queryTimeout  = flag.Duration("query-timeout", 10*time.Second, "The maximum time for serving a trace or dependency query; set to 0 to disable")
 	storageEngine tracer.Storage
 )
 
@@ -186,10 +614,18 @@ func main() {
 	}
 
 	logger.Printf("[UI-SRV] Listening for incoming connections on port %d; press ctrl+c to exit\n", *port)
-	srv, err := newServer(storage.Redis)
+	if *etcdEndpoints == "" {
+		storage.Redis.SetDirectEndpoint(*redisEndpoint, *redisPassword, *redisDb)
+	}
+	srv, err := newServer(storage.Redis, *queryTimeout)
 	if err != nil {
 		log.Panic(err)
 	}
+	for path, a := range srv.assets {
+		if a.redirect != "" {
+			logger.Printf("[UI-SRV] %s is not vendored; serving it from %s (run \"go generate ./http\")\n", path, a.redirect)
+		}
+	}
 
 	http.ListenAndServe(fmt.Sprintf(":%d", *port), srv)
 }
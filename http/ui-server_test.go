@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVendoredAssets(t *testing.T) {
+	index, err := fs.ReadFile(staticFiles, "static/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := regexp.MustCompile(`/static/vendor/[^"'\s]+`).FindAllString(string(index), -1)
+	if len(refs) == 0 {
+		t.Fatal("Expected index.html to reference vendored libraries")
+	}
+
+	libs, err := parseVendorManifest(vendorManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := make(map[string]vendorLib)
+	for _, lib := range libs {
+		manifest["/static/vendor/"+lib.file] = lib
+	}
+
+	// Vendored libraries are fetched via "go generate ./http". Libraries that have
+	// not been fetched yet are served from their download URL
+	for _, ref := range refs {
+		lib, listed := manifest[ref]
+		if !listed {
+			t.Errorf("index.html references %s which is not listed in vendor.txt", ref)
+			continue
+		}
+		if _, err := fs.Stat(staticFiles, ref[1:]); err != nil {
+			t.Logf("%s is not vendored; run \"go generate ./http\"", ref)
+			continue
+		}
+		if lib.license == "" {
+			continue
+		}
+		if _, err := fs.Stat(staticFiles, "static/vendor/"+lib.license); err != nil {
+			t.Errorf("%s is vendored without its license", ref)
+		}
+	}
+}
+
+func TestVendoredAssetFallback(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/index.html":             &fstest.MapFile{Data: []byte("<html></html>")},
+		"static/vendor/d3-3.5.5.min.js": &fstest.MapFile{Data: []byte("// d3")},
+	}
+	libs := []vendorLib{
+		{file: "d3-3.5.5.min.js", url: "https://cdnjs.cloudflare.com/ajax/libs/d3/3.5.5/d3.min.js"},
+		{file: "lodash-3.10.0.min.js", url: "https://cdnjs.cloudflare.com/ajax/libs/lodash.js/3.10.0/lodash.min.js"},
+	}
+	assets, err := loadAssets(fsys, libs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{assets: assets}
+
+	// Vendored libraries are served from the binary
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/static/vendor/d3-3.5.5.min.js", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "// d3" {
+		t.Fatalf("Expected vendored library to be served; got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != vendorCacheControl {
+		t.Fatalf("Expected Cache-Control %q; got %q", vendorCacheControl, w.Header().Get("Cache-Control"))
+	}
+
+	// Missing libraries are served from their download URL
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/static/vendor/lodash-3.10.0.min.js", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != libs[1].url {
+		t.Fatalf("Expected a redirect to %s; got %d %q", libs[1].url, w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestParseVendorManifest(t *testing.T) {
+	libs, err := parseVendorManifest("# comment\n\nd3.js https://example.com/d3.js d3.LICENSE https://example.com/LICENSE\nroute.js https://example.com/route.js - -\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 2 || libs[0].file != "d3.js" || libs[0].license != "d3.LICENSE" || libs[1].license != "" {
+		t.Fatalf("Unexpected libraries: %v", libs)
+	}
+
+	_, err = parseVendorManifest("d3.js https://example.com/d3.js\n")
+	if err == nil {
+		t.Fatalf("Expected an error for an incomplete entry")
+	}
+}
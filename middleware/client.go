@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+	"golang.org/x/net/context"
+)
+
+// The Client wraps a usrv.Client and emits Client trace records for each outgoing
+// request. The emitted records measure the roundtrip time observed by the caller
+// which, when compared to the records emitted by the Tracer middleware on the
+// server side, allows separating network and queue time from processing time.
+//
+// Two Trace entries will be emitted when the request completes, one for the outgoing
+// request and one for the response (or timeout/transport error).
+type Client struct {
+	*usrv.Client
+
+	collector *tracePkg.Collector
+	options   *tracerOptions
+}
+
+// Wrap a usrv client so that it emits trace records to the supplied Collector. The
+// emitted records can be customized using the same options as the Tracer middleware.
+func NewClient(client *usrv.Client, collector *tracePkg.Collector, opts ...TracerOption) (*Client, error) {
+	options, err := newTracerOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Client:    client,
+		collector: collector,
+		options:   options,
+	}, nil
+}
+
+// Send a request and trace it. Implements the same interface as usrv.Client.Request.
+func (c *Client) Request(ctx context.Context, msg *usrv.Message, endpoint string) <-chan usrv.ServerResponse {
+	start := time.Now()
+	return c.trace(ctx, msg, endpoint, start, c.Client.Request(ctx, msg, endpoint))
+}
+
+// Send a request with a timeout and trace it. Implements the same interface as
+// usrv.Client.RequestWithTimeout.
+func (c *Client) RequestWithTimeout(ctx context.Context, msg *usrv.Message, timeout time.Duration, endpoint string) <-chan usrv.ServerResponse {
+	start := time.Now()
+	return c.trace(ctx, msg, endpoint, start, c.Client.RequestWithTimeout(ctx, msg, timeout, endpoint))
+}
+
+// Wait for the response to a request, emit the trace records and forward the response.
+func (c *Client) trace(ctx context.Context, msg *usrv.Message, endpoint string, start time.Time, resChan <-chan usrv.ServerResponse) <-chan usrv.ServerResponse {
+	outChan := make(chan usrv.ServerResponse, 1)
+
+	go func() {
+		res := <-resChan
+		end := time.Now()
+
+		from, _ := ctx.Value(usrv.CtxCurEndpoint).(string)
+		from = c.options.normalizeEndpoint(from)
+		to := c.options.normalizeEndpoint(endpoint)
+		tags := c.options.tags(msg.Headers)
+
+		// Use the trace id from the context. If the context does not specify
+		// one, the server will allocate a trace id and include it in its response
+		traceId, _ := ctx.Value(CtxTraceId).(string)
+		if traceId == "" && res.Message != nil {
+			traceId, _ = res.Message.Headers.Get(CtxTraceId).(string)
+		}
+		if traceId == "" {
+			traceId = uuid.New()
+		}
+
+		correlationId := msg.CorrelationId
+		if res.Message != nil && res.Message.CorrelationId != "" {
+			correlationId = res.Message.CorrelationId
+		}
+		if correlationId == "" {
+			correlationId = uuid.New()
+		}
+
+		// Errors reported by the remote endpoint are also included in the response
+		// headers together with their classification
+		var errMsg string
+		var errInfo *tracePkg.ErrorInfo
+		if res.Message != nil {
+			errInfo = errorFromHeaders(res.Message.Headers)
+		}
+		if errInfo == nil && res.Error != nil {
+			errInfo = classifyError(res.Error)
+		}
+		if errInfo != nil {
+			errMsg = errInfo.Message
+		}
+
+		// Trace outgoing request. This call is non-blocking
+		reqRecord := &tracePkg.Record{
+			Timestamp:     start,
+			TraceId:       traceId,
+			CorrelationId: correlationId,
+			Type:          tracePkg.Request,
+			Kind:          tracePkg.Client,
+			From:          from,
+			To:            to,
+			Host:          c.options.host,
+			Tags:          tags,
+		}
+		c.options.recordPayload(reqRecord, to, msg.Payload)
+		c.collector.Add(reqRecord)
+
+		// Trace response. This call is non-blocking
+		resRecord := &tracePkg.Record{
+			Timestamp:     end,
+			TraceId:       traceId,
+			CorrelationId: correlationId,
+			Type:          tracePkg.Response,
+			Kind:          tracePkg.Client,
+			From:          to, // when responding we switch From/To
+			To:            from,
+			Host:          c.options.host,
+			Tags:          tags,
+			Duration:      end.Sub(start).Nanoseconds(),
+			Error:         errMsg,
+			ErrorInfo:     errInfo,
+		}
+		if res.Message != nil {
+			c.options.recordPayload(resRecord, from, res.Message.Payload)
+		}
+		c.collector.Add(resRecord)
+
+		outChan <- res
+	}()
+
+	return outChan
+}
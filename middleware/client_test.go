@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+	"github.com/achilleasa/usrv/usrvtest"
+	"golang.org/x/net/context"
+)
+
+func TestClientTracing(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	transp := usrvtest.NewTransport()
+	defer transp.Close()
+
+	server, err := usrv.NewServer(transp)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	server.Handle(
+		"com.test.client",
+		usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+			rw.WriteError(tracePkg.NewError(tracePkg.CategoryClient, "FORBIDDEN", "I cannot allow you to do that Dave"))
+		}),
+		Tracer(collector),
+	)
+	go server.ListenAndServe()
+	defer server.Close()
+	<-time.After(100 * time.Millisecond)
+
+	client, err := NewClient(usrv.NewClient(transp), collector)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), usrv.CtxCurEndpoint, "com.test.api")
+	res := <-client.Request(ctx, &usrv.Message{}, "com.test.client")
+	if res.Message == nil {
+		t.Fatalf("Expected to receive a response message; got error %v", res.Error)
+	}
+	traceId := res.Message.Headers.Get(CtxTraceId)
+	if traceId == nil {
+		t.Fatalf("Expected response to include header %s", CtxTraceId)
+	}
+
+	// Block till the server and client entries are processed
+	for i := 0; i < 4; i++ {
+		<-processedChan
+	}
+
+	traceLog, err := storage.GetTrace(traceId.(string))
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 4 {
+		t.Fatalf("Expected trace len to be 4; got %d", len(traceLog))
+	}
+
+	var clientReq, clientRes *tracePkg.Record
+	for index, rec := range traceLog {
+		if rec.Kind != tracePkg.Client {
+			continue
+		}
+		if rec.Type == tracePkg.Request {
+			clientReq = &traceLog[index]
+		} else {
+			clientRes = &traceLog[index]
+		}
+	}
+	if clientReq == nil || clientRes == nil {
+		t.Fatalf("Expected trace to include client request and response records; got %v", traceLog)
+	}
+	if clientReq.From != "com.test.api" || clientReq.To != "com.test.client" {
+		t.Fatalf("Expected client request From/To to be com.test.api/com.test.client; got %s/%s", clientReq.From, clientReq.To)
+	}
+	if clientRes.From != "com.test.client" || clientRes.To != "com.test.api" {
+		t.Fatalf("Expected client response From/To to be com.test.client/com.test.api; got %s/%s", clientRes.From, clientRes.To)
+	}
+	if clientReq.CorrelationId != res.Message.CorrelationId || clientRes.CorrelationId != res.Message.CorrelationId {
+		t.Fatalf("Expected client records to use correlation id %s", res.Message.CorrelationId)
+	}
+	if clientRes.Error != "I cannot allow you to do that Dave" {
+		t.Fatalf("Expected client response Error to be 'I cannot allow you to do that Dave'; got %v", clientRes.Error)
+	}
+
+	// The server classification should be propagated to the client records
+	for _, rec := range traceLog {
+		if rec.Type != tracePkg.Response {
+			continue
+		}
+		if rec.ErrorInfo == nil || rec.ErrorInfo.Category != tracePkg.CategoryClient || rec.ErrorInfo.Code != "FORBIDDEN" {
+			t.Fatalf("Expected %s response ErrorInfo to be classified as client/FORBIDDEN; got %v", rec.Kind, rec.ErrorInfo)
+		}
+	}
+}
+
+func TestClientTracingWithTimeout(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	transp := usrvtest.NewTransport()
+	defer transp.Close()
+
+	server, err := usrv.NewServer(transp)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	server.Handle(
+		"com.test.slow",
+		usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+			<-time.After(500 * time.Millisecond)
+		}),
+	)
+	go server.ListenAndServe()
+	defer server.Close()
+	<-time.After(100 * time.Millisecond)
+
+	client, err := NewClient(usrv.NewClient(transp), collector)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+
+	traceId := "0-0-0-0"
+	ctx := context.WithValue(context.Background(), CtxTraceId, traceId)
+	res := <-client.RequestWithTimeout(ctx, &usrv.Message{}, 10*time.Millisecond, "com.test.slow")
+	if res.Error == nil {
+		t.Fatalf("Expected request to time out")
+	}
+
+	// Block till both client entries are processed
+	<-processedChan
+	<-processedChan
+
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 2 {
+		t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+	}
+
+	clientRes := traceLog[1]
+	if clientRes.Kind != tracePkg.Client || clientRes.Type != tracePkg.Response {
+		t.Fatalf("Expected a client response record; got %v", clientRes)
+	}
+	if clientRes.Error != res.Error.Error() {
+		t.Fatalf("Expected client response Error to be %q; got %q", res.Error.Error(), clientRes.Error)
+	}
+	if clientRes.ErrorInfo == nil || clientRes.ErrorInfo.Category != tracePkg.CategoryTimeout {
+		t.Fatalf("Expected client response ErrorInfo to be classified as a timeout; got %v", clientRes.ErrorInfo)
+	}
+	if clientRes.Duration < (10 * time.Millisecond).Nanoseconds() {
+		t.Fatalf("Expected client response Duration to be at least 10ms; got %v", time.Duration(clientRes.Duration))
+	}
+}
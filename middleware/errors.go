@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+)
+
+// The response headers used for propagating the classification of errors
+// reported by traced endpoints to their callers.
+const (
+	ErrorCodeHeader     = "error_code"
+	ErrorCategoryHeader = "error_category"
+)
+
+// The classification of errors returned by usrv.
+var usrvErrors = map[error]tracePkg.ErrorInfo{
+	usrv.ErrTimeout:            {Code: "TIMEOUT", Category: tracePkg.CategoryTimeout},
+	usrv.ErrServiceUnavailable: {Code: "SERVICE_UNAVAILABLE", Category: tracePkg.CategoryServer},
+}
+
+// Classify an error. Errors returned by usrv are classified using the usrvErrors
+// map; all other errors are classified using tracer.ClassifyError.
+func classifyError(err error) *tracePkg.ErrorInfo {
+	for usrvErr, info := range usrvErrors {
+		if errors.Is(err, usrvErr) {
+			info.Message = err.Error()
+			return &info
+		}
+	}
+	return tracePkg.ClassifyError(err)
+}
+
+// Get the error reported by the headers of a response. If the response does not
+// include classification headers, the error is classified as a server error.
+// Returns nil if the headers do not report an error.
+func errorFromHeaders(headers usrv.Header) *tracePkg.ErrorInfo {
+	errMsg, _ := headers.Get("error").(string)
+	if errMsg == "" {
+		return nil
+	}
+
+	info := &tracePkg.ErrorInfo{
+		Category: tracePkg.CategoryServer,
+		Message:  errMsg,
+	}
+	info.Code, _ = headers.Get(ErrorCodeHeader).(string)
+	if category, _ := headers.Get(ErrorCategoryHeader).(string); category != "" {
+		info.Category = tracePkg.ErrorCategory(category)
+	}
+	return info
+}
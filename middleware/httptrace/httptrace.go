@@ -0,0 +1,342 @@
+// Package httptrace provides tracing support for net/http servers and clients.
+//
+// The Handler wrapper emits Request/Response trace records for each request processed
+// by an http.Handler while the Transport wrapper propagates the trace id to remote
+// services and emits Client trace records for each outgoing request. Both wrappers
+// share the same trace ids with the usrv middleware so HTTP hops appear in the same
+// traces and dependency graph as usrv calls.
+package httptrace
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+)
+
+// The headers used for propagating trace details.
+const (
+	TraceIdHeader       = "X-Trace-Id"
+	ServiceHeader       = "X-Trace-Service"
+	CorrelationIdHeader = "X-Trace-Correlation-Id"
+)
+
+// The hostname for emitted records.
+var hostname string
+
+func init() {
+	hostname, _ = os.Hostname()
+}
+
+// Map tracer carrier keys to http headers.
+var headerNames = map[string]string{
+	tracePkg.TraceIdKey: TraceIdHeader,
+	tracePkg.ServiceKey: ServiceHeader,
+}
+
+// A tracer.Carrier that maps carrier keys to http headers.
+type headerCarrier http.Header
+
+func (c headerCarrier) Get(key string) string {
+	return http.Header(c).Get(headerNames[key])
+}
+
+func (c headerCarrier) Set(key, value string) {
+	http.Header(c).Set(headerNames[key], value)
+}
+
+// Get the error for a response status code. 4xx status codes are classified as
+// client errors and 5xx status codes as server errors. Returns nil for status codes
+// that do not indicate an error.
+func statusError(status int) *tracePkg.ErrorInfo {
+	if status < http.StatusBadRequest {
+		return nil
+	}
+
+	info := &tracePkg.ErrorInfo{
+		Code:     strconv.Itoa(status),
+		Category: tracePkg.CategoryServer,
+		Message:  fmt.Sprintf("%d %s", status, http.StatusText(status)),
+	}
+	if status < http.StatusInternalServerError {
+		info.Category = tracePkg.CategoryClient
+	}
+	return info
+}
+
+// Get the error message for a classified error.
+func errorMessage(info *tracePkg.ErrorInfo) string {
+	if info == nil {
+		return ""
+	}
+	return info.Message
+}
+
+// A response writer that captures the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// An http.Flusher for a statusRecorder whose underlying writer is a Flusher.
+// Flushing sends the response headers so the status defaults to 200 if the
+// handler has not set one.
+type statusFlusher struct {
+	recorder *statusRecorder
+	flusher  http.Flusher
+}
+
+func (f statusFlusher) Flush() {
+	if f.recorder.status == 0 {
+		f.recorder.status = http.StatusOK
+	}
+	f.flusher.Flush()
+}
+
+// Wrap a response writer with a statusRecorder. The returned writer implements
+// the optional http.Flusher, http.Hijacker and http.CloseNotifier interfaces
+// if and only if the wrapped writer implements them so handlers can still detect
+// and use them.
+func newStatusRecorder(w http.ResponseWriter) (*statusRecorder, http.ResponseWriter) {
+	recorder := &statusRecorder{ResponseWriter: w}
+
+	flusher, isFlusher := w.(http.Flusher)
+	hijacker, isHijacker := w.(http.Hijacker)
+	closeNotifier, isCloseNotifier := w.(http.CloseNotifier)
+	if isFlusher {
+		flusher = statusFlusher{recorder: recorder, flusher: flusher}
+	}
+
+	switch {
+	case isFlusher && isHijacker && isCloseNotifier:
+		return recorder, struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{recorder, flusher, hijacker, closeNotifier}
+	case isFlusher && isHijacker:
+		return recorder, struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+		}{recorder, flusher, hijacker}
+	case isFlusher && isCloseNotifier:
+		return recorder, struct {
+			*statusRecorder
+			http.Flusher
+			http.CloseNotifier
+		}{recorder, flusher, closeNotifier}
+	case isHijacker && isCloseNotifier:
+		return recorder, struct {
+			*statusRecorder
+			http.Hijacker
+			http.CloseNotifier
+		}{recorder, hijacker, closeNotifier}
+	case isFlusher:
+		return recorder, struct {
+			*statusRecorder
+			http.Flusher
+		}{recorder, flusher}
+	case isHijacker:
+		return recorder, struct {
+			*statusRecorder
+			http.Hijacker
+		}{recorder, hijacker}
+	case isCloseNotifier:
+		return recorder, struct {
+			*statusRecorder
+			http.CloseNotifier
+		}{recorder, closeNotifier}
+	}
+	return recorder, struct{ *statusRecorder }{recorder}
+}
+
+// Wrap an http.Handler so that it emits trace records to the supplied Collector
+// whenever it processes an incoming request. The service argument defines the name
+// that is used for this handler in the emitted records.
+//
+// Two Trace entries will be emitted for each request, one for the incoming request
+// and one for the outgoing response. Responses with a 4xx or 5xx status code are
+// traced as client and server errors respectively.
+//
+// If the incoming request does not include a trace id header, a new trace id is
+// allocated. If it does not include a service header, the caller is unknown; the
+// emitted records are still stored with the trace but storage engines do not add
+// an empty caller to their service and dependency indexes.
+//
+// The trace id and the service name are included in the response headers. The
+// trace details are also injected into the request context so that any spans or
+// outgoing requests performed by the handler are linked to the trace.
+func Handler(collector *tracePkg.Collector, service string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := tracePkg.Extract(headerCarrier(r.Header))
+		if !ok {
+			sc.TraceId = uuid.New()
+		}
+		correlationId := r.Header.Get(CorrelationIdHeader)
+		if correlationId == "" {
+			correlationId = uuid.New()
+		}
+
+		// Inject trace into the response and the handler context
+		w.Header().Set(TraceIdHeader, sc.TraceId)
+		w.Header().Set(ServiceHeader, service)
+		ctx := tracePkg.ContextWithCollector(r.Context(), collector)
+		ctx = tracePkg.ContextWithSpanContext(ctx, tracePkg.SpanContext{TraceId: sc.TraceId, Service: service})
+
+		// Trace incoming request. This call is non-blocking
+		collector.Add(&tracePkg.Record{
+			Timestamp:     time.Now(),
+			TraceId:       sc.TraceId,
+			CorrelationId: correlationId,
+			Type:          tracePkg.Request,
+			From:          sc.Service,
+			To:            service,
+			Host:          hostname,
+		})
+
+		recorder, writer := newStatusRecorder(w)
+
+		// Trace response when the handler returns
+		defer func(start time.Time) {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			errInfo := statusError(status)
+
+			// Trace response. This call is non-blocking
+			collector.Add(&tracePkg.Record{
+				Timestamp:     time.Now(),
+				TraceId:       sc.TraceId,
+				CorrelationId: correlationId,
+				Type:          tracePkg.Response,
+				From:          service, // when responding we switch From/To
+				To:            sc.Service,
+				Host:          hostname,
+				Duration:      time.Since(start).Nanoseconds(),
+				Error:         errorMessage(errInfo),
+				ErrorInfo:     errInfo,
+			})
+		}(time.Now())
+
+		// Invoke the original handler
+		handler.ServeHTTP(writer, r.WithContext(ctx))
+	})
+}
+
+// The Transport is an http.RoundTripper that propagates the trace details stored
+// in the request context to the remote service. If a Collector is specified, the
+// transport also emits Client trace records for each request.
+type Transport struct {
+	// The RoundTripper used for performing requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// The collector for emitted client records. If nil, no records are emitted.
+	Collector *tracePkg.Collector
+
+	// The name of the calling service. It is used when the request context does
+	// not contain a span.
+	Service string
+}
+
+// Perform a request. Implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// RoundTrippers must not modify the original request
+	req := r.Clone(r.Context())
+	carrier := headerCarrier(req.Header)
+	tracePkg.Inject(req.Context(), carrier)
+	from := carrier.Get(tracePkg.ServiceKey)
+	if from == "" && t.Service != "" {
+		from = t.Service
+		carrier.Set(tracePkg.ServiceKey, from)
+	}
+
+	// Share the correlation id with the remote service so client and server
+	// records for this request can be matched
+	correlationId := uuid.New()
+	req.Header.Set(CorrelationIdHeader, correlationId)
+
+	start := time.Now()
+	res, err := base.RoundTrip(req)
+	if t.Collector == nil {
+		return res, err
+	}
+	end := time.Now()
+
+	// Use the trace id we propagated. If none was available, the remote
+	// service will allocate one and include it in its response.
+	traceId := carrier.Get(tracePkg.TraceIdKey)
+	if traceId == "" && res != nil {
+		traceId = res.Header.Get(TraceIdHeader)
+	}
+	if traceId == "" {
+		traceId = uuid.New()
+	}
+
+	// Prefer the service name reported by the remote service over its host name
+	to := req.URL.Host
+	if res != nil && res.Header.Get(ServiceHeader) != "" {
+		to = res.Header.Get(ServiceHeader)
+	}
+
+	var errInfo *tracePkg.ErrorInfo
+	if err != nil {
+		errInfo = tracePkg.ClassifyError(err)
+	} else {
+		errInfo = statusError(res.StatusCode)
+	}
+
+	// Trace outgoing request. This call is non-blocking
+	t.Collector.Add(&tracePkg.Record{
+		Timestamp:     start,
+		TraceId:       traceId,
+		CorrelationId: correlationId,
+		Type:          tracePkg.Request,
+		Kind:          tracePkg.Client,
+		From:          from,
+		To:            to,
+		Host:          hostname,
+	})
+
+	// Trace response. This call is non-blocking
+	t.Collector.Add(&tracePkg.Record{
+		Timestamp:     end,
+		TraceId:       traceId,
+		CorrelationId: correlationId,
+		Type:          tracePkg.Response,
+		Kind:          tracePkg.Client,
+		From:          to, // when responding we switch From/To
+		To:            from,
+		Host:          hostname,
+		Duration:      end.Sub(start).Nanoseconds(),
+		Error:         errorMessage(errInfo),
+		ErrorInfo:     errInfo,
+	})
+
+	return res, err
+}
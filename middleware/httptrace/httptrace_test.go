@@ -0,0 +1,250 @@
+package httptrace
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tracePkg "github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+	"golang.org/x/net/context"
+)
+
+func TestHandlerAndTransport(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	var handlerTraceId interface{}
+	srv := httptest.NewServer(Handler(collector, "com.test.http", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerTraceId = r.Context().Value(tracePkg.TraceIdKey)
+		http.Error(w, "not found", http.StatusNotFound)
+	})))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Collector: collector, Service: "com.test.api"},
+	}
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Error performing request: %v", err)
+	}
+	res.Body.Close()
+
+	traceId := res.Header.Get(TraceIdHeader)
+	if traceId == "" {
+		t.Fatalf("Expected response to include header %s", TraceIdHeader)
+	}
+	if handlerTraceId != traceId {
+		t.Fatalf("Expected handler context to include trace id %s; got %v", traceId, handlerTraceId)
+	}
+
+	// Block till the server and client entries are processed
+	for i := 0; i < 4; i++ {
+		<-processedChan
+	}
+
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 4 {
+		t.Fatalf("Expected trace len to be 4; got %d", len(traceLog))
+	}
+
+	correlationId := traceLog[0].CorrelationId
+	for index, rec := range traceLog {
+		if rec.CorrelationId != correlationId {
+			t.Fatalf("Expected record %d to have correlation id %s; got %s", index, correlationId, rec.CorrelationId)
+		}
+
+		from, to := "com.test.api", "com.test.http"
+		if rec.Type == tracePkg.Response {
+			from, to = to, from
+			if rec.Error != "404 Not Found" {
+				t.Fatalf("Expected record %d Error to be '404 Not Found'; got %q", index, rec.Error)
+			}
+			if rec.ErrorInfo == nil || rec.ErrorInfo.Category != tracePkg.CategoryClient || rec.ErrorInfo.Code != "404" {
+				t.Fatalf("Expected record %d ErrorInfo to be classified as client/404; got %v", index, rec.ErrorInfo)
+			}
+		}
+		if rec.From != from || rec.To != to {
+			t.Fatalf("Expected record %d From/To to be %s/%s; got %s/%s", index, from, to, rec.From, rec.To)
+		}
+	}
+}
+
+func TestTransportPropagation(t *testing.T) {
+	var reqTraceId, reqService string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqTraceId = r.Header.Get(TraceIdHeader)
+		reqService = r.Header.Get(ServiceHeader)
+	}))
+	defer srv.Close()
+
+	span, ctx := tracePkg.StartSpan(context.Background(), "com.test.job")
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	res, err := (&Transport{}).RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("Error performing request: %v", err)
+	}
+	res.Body.Close()
+
+	if reqTraceId != span.TraceId {
+		t.Fatalf("Expected request header %s to be %s; got %s", TraceIdHeader, span.TraceId, reqTraceId)
+	}
+	if reqService != span.Name {
+		t.Fatalf("Expected request header %s to be %s; got %s", ServiceHeader, span.Name, reqService)
+	}
+	if req.Header.Get(TraceIdHeader) != "" {
+		t.Fatalf("Expected original request headers to remain unmodified")
+	}
+}
+
+func TestHandlerWithoutCaller(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	handler := Handler(collector, "com.test.http", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+
+	// The caller is unknown; it should not be added to the index
+	deps, err := storage.GetDependencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].Service != "com.test.http" || len(deps[0].Dependencies) != 0 {
+		t.Fatalf("Unexpected dependencies: %v", deps)
+	}
+	dependents, err := storage.GetDependents("com.test.http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dependents) != 1 || len(dependents[0].Dependencies) != 0 {
+		t.Fatalf("Expected com.test.http to have no dependents; got %v", dependents)
+	}
+	services, err := tracePkg.NewServiceCatalog(storage).GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, summary := range services {
+		if summary.Service == "" {
+			t.Fatalf("Expected the unknown caller not to be listed as a service; got %v", services)
+		}
+	}
+}
+
+type hijackWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *hijackWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func TestHandlerResponseWriterInterfaces(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	// httptest.ResponseRecorder is a Flusher but neither a Hijacker nor a CloseNotifier
+	recorder := httptest.NewRecorder()
+	handler := Handler(collector, "com.test.http", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); ok {
+			t.Errorf("Expected writer not to implement http.Hijacker")
+		}
+		if _, ok := w.(http.CloseNotifier); ok {
+			t.Errorf("Expected writer not to implement http.CloseNotifier")
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatalf("Expected writer to implement http.Flusher")
+		}
+		flusher.Flush()
+	}))
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if !recorder.Flushed {
+		t.Fatalf("Expected the underlying writer to be flushed")
+	}
+
+	writer := &hijackWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler = Handler(collector, "com.test.http", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.CloseNotifier); !ok {
+			t.Errorf("Expected writer to implement http.CloseNotifier")
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatalf("Expected writer to implement http.Hijacker")
+		}
+		hijacker.Hijack()
+	}))
+	handler.ServeHTTP(writer, httptest.NewRequest("GET", "/", nil))
+	if !writer.hijacked {
+		t.Fatalf("Expected the underlying writer to be hijacked")
+	}
+
+	// Block till all entries are processed
+	for i := 0; i < 4; i++ {
+		<-processedChan
+	}
+}
+
+func TestStatusRecorderFlush(t *testing.T) {
+	recorder, writer := newStatusRecorder(httptest.NewRecorder())
+	writer.(http.Flusher).Flush()
+	if recorder.status != http.StatusOK {
+		t.Fatalf("Expected flushing to imply status %d; got %d", http.StatusOK, recorder.status)
+	}
+
+	recorder, writer = newStatusRecorder(httptest.NewRecorder())
+	writer.WriteHeader(http.StatusAccepted)
+	writer.(http.Flusher).Flush()
+	if recorder.status != http.StatusAccepted {
+		t.Fatalf("Expected status %d; got %d", http.StatusAccepted, recorder.status)
+	}
+}
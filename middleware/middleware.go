@@ -1,24 +1,35 @@
 package middleware
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
-	tracePkg "github.com/achilleasa/usrv-tracer"
 	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
 	"golang.org/x/net/context"
 )
 
 var (
-	CtxTraceId = "trace_id"
+	// The trace id header/context key. It is shared with the tracer package so that
+	// spans started via tracer.StartSpan join the traces of usrv endpoints.
+	CtxTraceId = tracePkg.TraceIdKey
+
+	// The W3C Trace Context header/context keys.
+	CtxTraceParent = tracePkg.TraceParentKey
+	CtxTraceState  = tracePkg.TraceStateKey
 )
 
 func init() {
 	// Make sure clients inject the trace-id header in outgoing messages so we can track service dependencies
-	usrv.InjectCtxFieldToClients(CtxTraceId)
+	usrv.InjectCtxFieldToClients(CtxTraceId, CtxTraceParent, CtxTraceState)
 }
 
+// The maximum length of the stack trace included in the records of handlers that panic.
+const maxPanicStackSize = 2048
+
 // The tracer middleware emits TraceEntry objects to the supplied Collector whenever the
 // server processes an incoming request.
 //
@@ -30,11 +41,32 @@ func init() {
 // that occur inside the wrapped handler are associated with the current request, the
 // handler should pass its context to any performed RPC client requests.
 //
+// The middleware understands both the W3C Trace Context (traceparent/tracestate)
+// headers and the legacy CtxTraceId header. If a valid traceparent header is present,
+// its 128-bit trace id is converted to the UUID format used by trace records.
+// Otherwise, the CtxTraceId header is used. Both headers are injected into outgoing
+// messages so that services that have not yet been migrated remain part of the trace.
+//
+// The emitted records can be customized by passing a list of TracerOption (see Host,
+// EndpointNormalizer and HeaderTags).
+//
+// Errors reported by the handler are classified (see tracer.ErrorInfo) and the
+// classification is shared with the caller via the ErrorCodeHeader and
+// ErrorCategoryHeader response headers.
+//
+// The payload size of each request and response is included in the emitted records.
+// Payload fingerprints and previews can be enabled using the PayloadHash and
+// PayloadPreview options.
+//
+// If the handler panics, the response record is emitted with an error that contains
+// the panic value and a truncated stack trace. The panic is then re-raised unless
+// the RecoverPanics option is specified, in which case an error response is sent.
+//
 // This function is designed to emit events in non-blocking mode. If the Collector does
 // not have enough capacity to store a generated TraceEntry then it will be silently dropped.
-func Tracer(collector *tracePkg.Collector) usrv.EndpointOption {
+func Tracer(collector *tracePkg.Collector, opts ...TracerOption) usrv.EndpointOption {
 	return func(ep *usrv.Endpoint) error {
-		hostname, err := os.Hostname()
+		options, err := newTracerOptions(opts)
 		if err != nil {
 			return err
 		}
@@ -44,59 +76,145 @@ func Tracer(collector *tracePkg.Collector) usrv.EndpointOption {
 		ep.Handler = usrv.HandlerFunc(func(ctx context.Context, responseWriter usrv.ResponseWriter, request *usrv.Message) {
 			var traceId string
 
-			// Check if the request contains a trace id. If no trace is
-			// available allocate a new traceId and inject it in the
-			// request context that gets passed to the handler
-			trace := request.Headers.Get(CtxTraceId)
-			if trace == nil {
-				traceId = uuid.New()
+			// Check if the request contains a W3C traceparent header. If not, fall
+			// back to the legacy trace id header. If no trace is available allocate
+			// a new traceId and inject it in the request context that gets passed
+			// to the handler. Callers that send both headers derive the traceparent
+			// from the legacy trace id; in that case the legacy trace id is kept
+			// so that non-UUID trace ids are not replaced by their hashed form
+			traceParent, _ := request.Headers.Get(CtxTraceParent).(string)
+			legacyTraceId, _ := request.Headers.Get(CtxTraceId).(string)
+			parent, err := tracePkg.ParseTraceParent(traceParent)
+			if err == nil {
+				traceId = parent.RecordTraceId()
+				if legacyTraceId != "" && tracePkg.W3CTraceId(legacyTraceId) == parent.TraceId {
+					traceId = legacyTraceId
+				}
 				ctx = context.WithValue(ctx, CtxTraceId, traceId)
+			} else if legacyTraceId != "" {
+				traceId = legacyTraceId
 			} else {
-				traceId = trace.(string)
+				traceId = uuid.New()
+				ctx = context.WithValue(ctx, CtxTraceId, traceId)
+			}
+
+			// Generate the traceparent for outgoing requests made by the handler. The
+			// tracestate is propagated unmodified.
+			outParent := tracePkg.NewTraceParent(traceId)
+			if parent != nil {
+				outParent.TraceId = parent.TraceId
+				outParent.Flags = parent.Flags
+			}
+			ctx = context.WithValue(ctx, CtxTraceParent, outParent.String())
+			traceState, _ := request.Headers.Get(CtxTraceState).(string)
+			if traceState != "" {
+				ctx = context.WithValue(ctx, CtxTraceState, traceState)
 			}
 
 			// Inject trace into outgoing message
 			responseWriter.Header().Set(CtxTraceId, traceId)
+			responseWriter.Header().Set(CtxTraceParent, outParent.String())
+			if traceState != "" {
+				responseWriter.Header().Set(CtxTraceState, traceState)
+			}
+
+			from := options.normalizeEndpoint(request.From)
+			to := options.normalizeEndpoint(request.To)
+			tags := options.tags(request.Headers)
 
 			// Trace incoming request. This call is non-blocking
-			collector.Add(&tracePkg.Record{
+			reqRecord := &tracePkg.Record{
 				Timestamp:     time.Now(),
 				TraceId:       traceId,
 				CorrelationId: request.CorrelationId,
 				Type:          tracePkg.Request,
-				From:          request.From,
-				To:            request.To,
-				Host:          hostname,
-			})
+				From:          from,
+				To:            to,
+				Host:          options.host,
+				Tags:          tags,
+			}
+			options.recordPayload(reqRecord, to, request.Payload)
+			collector.Add(reqRecord)
+
+			// Capture the error (if any) returned by the handler so it can be classified
+			// and the response payload so its size can be recorded
+			recorder := newResponseRecorder(responseWriter, options)
 
 			// Trace response when the handler returns
 			defer func(start time.Time) {
 
 				var errMsg string
+				var errInfo *tracePkg.ErrorInfo
+
+				// Record handler panics as errors
+				panicVal := recover()
+				if panicVal != nil {
+					errMsg = panicError(panicVal, debug.Stack())
+					errInfo = &tracePkg.ErrorInfo{
+						Code:     "PANIC",
+						Category: tracePkg.CategoryServer,
+						Message:  fmt.Sprintf("panic: %v", panicVal),
+					}
+					if options.recoverPanics {
+						responseWriter.WriteError(errors.New(errInfo.Message))
+					}
+				} else if recorder.err != nil {
+					errMsg = recorder.err.Error()
+					errInfo = classifyError(recorder.err)
+				} else if errInfo = errorFromHeaders(responseWriter.Header()); errInfo != nil {
+					errMsg = errInfo.Message
+				}
 
-				errVal := responseWriter.Header().Get("error")
-				if errVal != nil {
-					errMsg = errVal.(string)
+				if errInfo != nil {
+					// If the handler failed with an unclassified error after the
+					// request deadline expired, blame the deadline
+					if errInfo.Code == "" && errInfo.Category == tracePkg.CategoryServer && ctx.Err() != nil {
+						ctxErrInfo := tracePkg.ClassifyError(ctx.Err())
+						errInfo.Code, errInfo.Category = ctxErrInfo.Code, ctxErrInfo.Category
+					}
+
+					// Share the error classification with the caller
+					if errInfo.Code != "" {
+						responseWriter.Header().Set(ErrorCodeHeader, errInfo.Code)
+					}
+					responseWriter.Header().Set(ErrorCategoryHeader, string(errInfo.Category))
 				}
 
 				// Trace response. This call is non-blocking
-				collector.Add(&tracePkg.Record{
+				resRecord := &tracePkg.Record{
 					Timestamp:     time.Now(),
 					TraceId:       traceId,
 					CorrelationId: request.CorrelationId,
 					Type:          tracePkg.Response,
-					From:          request.To, // when responding we switch From/To
-					To:            request.From,
-					Host:          hostname,
+					From:          to, // when responding we switch From/To
+					To:            from,
+					Host:          options.host,
+					Tags:          tags,
 					Duration:      time.Since(start).Nanoseconds(),
 					Error:         errMsg,
-				})
+					ErrorInfo:     errInfo,
+				}
+				recorder.recordPayload(resRecord, from)
+				collector.Add(resRecord)
+
+				if panicVal != nil && !options.recoverPanics {
+					panic(panicVal)
+				}
 			}(time.Now())
 
 			// Invoke the original handler
-			originalHandler.Serve(ctx, responseWriter, request)
+			originalHandler.Serve(ctx, recorder, request)
 		})
 
 		return nil
 	}
 }
+
+// Format the error message for a handler panic. The stack trace is truncated to
+// maxPanicStackSize bytes.
+func panicError(panicVal interface{}, stack []byte) string {
+	if len(stack) > maxPanicStackSize {
+		stack = append(stack[:maxPanicStackSize:maxPanicStackSize], "\n..."...)
+	}
+	return fmt.Sprintf("panic: %v\n\n%s", panicVal, stack)
+}
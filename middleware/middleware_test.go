@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"errors"
+	"strings"
 	"testing"
 
 	"time"
@@ -301,3 +302,343 @@ func TestTracerWithError(t *testing.T) {
 	}
 
 }
+
+func TestTracerWithTraceParent(t *testing.T) {
+	var err error
+
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	var handlerCtx context.Context
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+			handlerCtx = ctx
+		}),
+	}
+
+	err = Tracer(collector)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	msg := &usrv.Message{
+		From:          "sender",
+		To:            "recipient",
+		CorrelationId: "123",
+		Headers:       make(usrv.Header),
+	}
+
+	// The traceparent header should take precedence over the legacy header
+	msg.Headers.Set(CtxTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	msg.Headers.Set(CtxTraceState, "congo=t61rcWkgMzE")
+	msg.Headers.Set(CtxTraceId, "0-0-0-0")
+	expTraceId := "4bf92f35-77b3-4da6-a3ce-929d0e0e4736"
+
+	w := usrvtest.NewRecorder()
+	ep.Handler.Serve(context.Background(), w, msg)
+
+	if w.Header().Get(CtxTraceId) != expTraceId {
+		t.Fatalf("Expected middleware to set response writer header %s to %s; got %v", CtxTraceId, expTraceId, w.Header().Get(CtxTraceId))
+	}
+	if handlerCtx.Value(CtxTraceId) != expTraceId {
+		t.Fatalf("Expected handler context %s to be %s; got %v", CtxTraceId, expTraceId, handlerCtx.Value(CtxTraceId))
+	}
+	if handlerCtx.Value(CtxTraceState) != "congo=t61rcWkgMzE" {
+		t.Fatalf("Expected handler context %s to be propagated; got %v", CtxTraceState, handlerCtx.Value(CtxTraceState))
+	}
+
+	outParent, err := tracePkg.ParseTraceParent(handlerCtx.Value(CtxTraceParent).(string))
+	if err != nil {
+		t.Fatalf("Expected handler context to contain a valid traceparent: %v", err)
+	}
+	if outParent.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || outParent.ParentId == "00f067aa0ba902b7" {
+		t.Fatalf("Expected outgoing traceparent to keep the trace id and use a new parent id; got %v", outParent)
+	}
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+
+	traceLog, err := storage.GetTrace(expTraceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", expTraceId, err)
+	}
+	if len(traceLog) != 2 {
+		t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+	}
+}
+
+func TestTracerWithTraceParentAndLegacyTraceId(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+		}),
+	}
+
+	err = Tracer(collector)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	// Legacy trace ids that map to the traceparent trace id should be kept
+	for _, legacyTraceId := range []string{"4BF92F35-77B3-4DA6-A3CE-929D0E0E4736", "order-42"} {
+		msg := &usrv.Message{
+			From:          "sender",
+			To:            "recipient",
+			CorrelationId: "123",
+			Headers:       make(usrv.Header),
+		}
+		msg.Headers.Set(CtxTraceParent, "00-"+tracePkg.W3CTraceId(legacyTraceId)+"-00f067aa0ba902b7-01")
+		msg.Headers.Set(CtxTraceId, legacyTraceId)
+
+		w := usrvtest.NewRecorder()
+		ep.Handler.Serve(context.Background(), w, msg)
+
+		if w.Header().Get(CtxTraceId) != legacyTraceId {
+			t.Fatalf("Expected middleware to keep legacy traceId %s; got %v", legacyTraceId, w.Header().Get(CtxTraceId))
+		}
+
+		// Block till both entries are processed
+		<-processedChan
+		<-processedChan
+
+		traceLog, err := storage.GetTrace(legacyTraceId)
+		if err != nil {
+			t.Fatalf("Error retrieving trace with id %s: %v", legacyTraceId, err)
+		}
+		if len(traceLog) != 2 {
+			t.Fatalf("Expected trace %s len to be 2; got %d", legacyTraceId, len(traceLog))
+		}
+	}
+}
+
+func TestTracerWithInvalidTraceParent(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+		}),
+	}
+
+	err = Tracer(collector)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	msg := &usrv.Message{
+		From:          "sender",
+		To:            "recipient",
+		CorrelationId: "123",
+		Headers:       make(usrv.Header),
+	}
+
+	// Invalid traceparent headers should be ignored in favor of the legacy header
+	msg.Headers.Set(CtxTraceParent, "00-invalid")
+	msg.Headers.Set(CtxTraceId, "0-0-0-0")
+
+	w := usrvtest.NewRecorder()
+	ep.Handler.Serve(context.Background(), w, msg)
+
+	if w.Header().Get(CtxTraceId) != "0-0-0-0" {
+		t.Fatalf("Middleware did not reuse legacy traceId 0-0-0-0; got %v", w.Header().Get(CtxTraceId))
+	}
+	outParent, err := tracePkg.ParseTraceParent(w.Header().Get(CtxTraceParent).(string))
+	if err != nil {
+		t.Fatalf("Expected response to contain a valid traceparent: %v", err)
+	}
+	if outParent.TraceId != tracePkg.W3CTraceId("0-0-0-0") {
+		t.Fatalf("Expected traceparent trace id to be derived from the legacy trace id; got %s", outParent.TraceId)
+	}
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+}
+
+func TestTracerWithPanic(t *testing.T) {
+	var err error
+
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	for _, recoverPanics := range []bool{false, true} {
+		ep := usrv.Endpoint{
+			Name: "traceTest",
+			Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+				panic("boom")
+			}),
+		}
+
+		opts := []TracerOption{}
+		if recoverPanics {
+			opts = append(opts, RecoverPanics())
+		}
+		err = Tracer(collector, opts...)(&ep)
+		if err != nil {
+			t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+		}
+
+		msg := &usrv.Message{
+			From:          "sender",
+			To:            "recipient",
+			CorrelationId: "123",
+		}
+
+		w := usrvtest.NewRecorder()
+		panicVal := func() (panicVal interface{}) {
+			defer func() {
+				panicVal = recover()
+			}()
+			ep.Handler.Serve(context.Background(), w, msg)
+			return nil
+		}()
+
+		if recoverPanics {
+			if panicVal != nil {
+				t.Fatalf("Expected middleware to recover panic; got %v", panicVal)
+			}
+			if errVal := w.Header().Get("error"); errVal != "panic: boom" {
+				t.Fatalf("Expected error response 'panic: boom'; got %v", errVal)
+			}
+		} else if panicVal != "boom" {
+			t.Fatalf("Expected middleware to re-panic with 'boom'; got %v", panicVal)
+		}
+
+		// Block till both entries are processed
+		<-processedChan
+		<-processedChan
+
+		traceId := w.Header().Get(CtxTraceId).(string)
+		traceLog, err := storage.GetTrace(traceId)
+		if err != nil {
+			t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+		}
+		if len(traceLog) != 2 {
+			t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+		}
+		errMsg := traceLog[1].Error
+		if !strings.HasPrefix(errMsg, "panic: boom\n") {
+			t.Fatalf("Expected trace Error to start with 'panic: boom'; got %q", errMsg)
+		}
+		if !strings.Contains(errMsg, "goroutine") {
+			t.Fatalf("Expected trace Error to include the stack trace; got %q", errMsg)
+		}
+		if info := traceLog[1].ErrorInfo; info == nil || info.Code != "PANIC" || info.Message != "panic: boom" {
+			t.Fatalf("Expected trace ErrorInfo to be PANIC with message 'panic: boom'; got %v", info)
+		}
+		if len(errMsg) > maxPanicStackSize+64 {
+			t.Fatalf("Expected trace Error stack to be truncated; got %d bytes", len(errMsg))
+		}
+	}
+}
+
+func TestTracerErrorClassification(t *testing.T) {
+	var err error
+
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+			rw.WriteError(errors.New("gave up"))
+		}),
+	}
+
+	err = Tracer(collector)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	msg := &usrv.Message{
+		From:          "sender",
+		To:            "recipient",
+		CorrelationId: "123",
+	}
+
+	// Generic errors reported after the request deadline are classified as timeouts
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	w := usrvtest.NewRecorder()
+	ep.Handler.Serve(ctx, w, msg)
+
+	if category := w.Header().Get(ErrorCategoryHeader); category != string(tracePkg.CategoryTimeout) {
+		t.Fatalf("Expected response header %s to be %s; got %v", ErrorCategoryHeader, tracePkg.CategoryTimeout, category)
+	}
+	if code := w.Header().Get(ErrorCodeHeader); code != "DEADLINE_EXCEEDED" {
+		t.Fatalf("Expected response header %s to be DEADLINE_EXCEEDED; got %v", ErrorCodeHeader, code)
+	}
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+
+	traceId := w.Header().Get(CtxTraceId).(string)
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 2 {
+		t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+	}
+	errInfo := traceLog[1].ErrorInfo
+	if errInfo == nil || errInfo.Category != tracePkg.CategoryTimeout || errInfo.Message != "gave up" {
+		t.Fatalf("Expected trace ErrorInfo to be a timeout with message 'gave up'; got %v", errInfo)
+	}
+}
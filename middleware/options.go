@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/achilleasa/usrv"
+)
+
+var (
+	ErrInvalidPreviewSize = errors.New("tracer: payload preview size must not be negative")
+)
+
+// A TracerOption customizes the trace records emitted by the Tracer middleware and
+// the traced Client.
+type TracerOption func(opts *tracerOptions) error
+
+type tracerOptions struct {
+	// The host reported in emitted records.
+	host string
+
+	// A function for normalizing the endpoint names reported in emitted records.
+	normalizeEndpoint func(string) string
+
+	// The request headers that are recorded as tags.
+	headerTags []string
+
+	// If true, handler panics are converted to error responses instead of
+	// being re-raised after they are traced.
+	recoverPanics bool
+
+	// Payload capture settings. Payloads are passed through redactPayload (if
+	// defined) before being hashed or previewed.
+	payloadHash    bool
+	payloadPreview int
+	redactPayload  func(endpoint string, payload []byte) []byte
+}
+
+// Apply a set of options on top of the defaults.
+func newTracerOptions(opts []TracerOption) (*tracerOptions, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &tracerOptions{
+		host: hostname,
+		normalizeEndpoint: func(endpoint string) string {
+			return endpoint
+		},
+	}
+	for _, opt := range opts {
+		err = opt(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
+// Extract the configured header tags from a message. Returns nil if no tags are found.
+func (opts *tracerOptions) tags(headers usrv.Header) map[string]string {
+	var tags map[string]string
+	for _, header := range opts.headerTags {
+		val := headers.Get(header)
+		if val == nil {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[header] = fmt.Sprint(val)
+	}
+	return tags
+}
+
+// Override the host reported in emitted records. By default, the value returned by
+// os.Hostname is used. This option is useful for containers with random hostnames.
+func Host(host string) TracerOption {
+	return func(opts *tracerOptions) error {
+		opts.host = host
+		return nil
+	}
+}
+
+// Normalize the endpoint names (From/To) reported in emitted records using the
+// supplied function. Passing a nil function restores the default behavior which
+// reports endpoint names unmodified.
+func EndpointNormalizer(normalizer func(endpoint string) string) TracerOption {
+	return func(opts *tracerOptions) error {
+		if normalizer == nil {
+			normalizer = func(endpoint string) string {
+				return endpoint
+			}
+		}
+		opts.normalizeEndpoint = normalizer
+		return nil
+	}
+}
+
+// Record the values of the specified request headers as record tags.
+func HeaderTags(headers ...string) TracerOption {
+	return func(opts *tracerOptions) error {
+		opts.headerTags = append(opts.headerTags, headers...)
+		return nil
+	}
+}
+
+// Convert handler panics into error responses. By default, the Tracer middleware
+// records the panic and then re-panics so that the usrv server can handle it.
+func RecoverPanics() TracerOption {
+	return func(opts *tracerOptions) error {
+		opts.recoverPanics = true
+		return nil
+	}
+}
+
+// Record a fingerprint (the first 8 bytes of the SHA-256 hash) of the request and
+// response payloads. Fingerprints allow identical payloads to be identified without
+// storing their contents.
+func PayloadHash() TracerOption {
+	return func(opts *tracerOptions) error {
+		opts.payloadHash = true
+		return nil
+	}
+}
+
+// Record a preview of the request and response payloads truncated to maxBytes. Invalid
+// UTF-8 sequences are replaced so previews of binary payloads can be safely displayed.
+func PayloadPreview(maxBytes int) TracerOption {
+	return func(opts *tracerOptions) error {
+		if maxBytes < 0 {
+			return ErrInvalidPreviewSize
+		}
+		opts.payloadPreview = maxBytes
+		return nil
+	}
+}
+
+// Redact payloads before they are hashed or previewed. The redactor receives the name
+// of the endpoint that the payload is sent to and returns the payload to capture. The
+// supplied payload must not be modified in place. Payload sizes are always reported
+// for the original payload. As redactors operate on the entire payload, response
+// payloads are buffered in full when a redactor is specified.
+func PayloadRedactor(redactor func(endpoint string, payload []byte) []byte) TracerOption {
+	return func(opts *tracerOptions) error {
+		opts.redactPayload = redactor
+		return nil
+	}
+}
+
+// An endpoint normalizer that strips numeric version suffixes from endpoint names
+// (e.g. com.test.add/2 becomes com.test.add).
+func StripVersionSuffix(endpoint string) string {
+	index := strings.LastIndex(endpoint, "/")
+	if index == -1 || index == len(endpoint)-1 {
+		return endpoint
+	}
+	for _, c := range endpoint[index+1:] {
+		if c < '0' || c > '9' {
+			return endpoint
+		}
+	}
+	return endpoint[:index]
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+	"github.com/achilleasa/usrv/usrvtest"
+	"golang.org/x/net/context"
+)
+
+func TestStripVersionSuffix(t *testing.T) {
+	specs := map[string]string{
+		"com.test.add/2":    "com.test.add",
+		"com.test.add/12":   "com.test.add",
+		"com.test.add":      "com.test.add",
+		"com.test.add/":     "com.test.add/",
+		"com.test.add/beta": "com.test.add/beta",
+		"com.test/v2/add/3": "com.test/v2/add",
+		"":                  "",
+	}
+
+	for endpoint, expected := range specs {
+		normalized := StripVersionSuffix(endpoint)
+		if normalized != expected {
+			t.Fatalf("Expected StripVersionSuffix(%q) to return %q; got %q", endpoint, expected, normalized)
+		}
+	}
+}
+
+func TestTracerOptions(t *testing.T) {
+	var err error
+
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+		}),
+	}
+
+	err = Tracer(
+		collector,
+		Host("container-1"),
+		EndpointNormalizer(StripVersionSuffix),
+		HeaderTags("region", "tenant"),
+	)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	msg := &usrv.Message{
+		From:          "com.test.api/1",
+		To:            "com.test.add/2",
+		CorrelationId: "123",
+		Headers:       usrv.Header{},
+	}
+	msg.Headers.Set("region", "eu-west-1")
+	msg.Headers.Set("secret", "s3cr3t")
+
+	w := usrvtest.NewRecorder()
+	ep.Handler.Serve(context.Background(), w, msg)
+	traceId := w.Header().Get(CtxTraceId)
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+
+	traceLog, err := storage.GetTrace(traceId.(string))
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 2 {
+		t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+	}
+
+	for index, rec := range traceLog {
+		if rec.Host != "container-1" {
+			t.Fatalf("[rec %d] Expected Host to be container-1; got %s", index, rec.Host)
+		}
+		if len(rec.Tags) != 1 || rec.Tags["region"] != "eu-west-1" {
+			t.Fatalf("[rec %d] Expected Tags to only contain region=eu-west-1; got %v", index, rec.Tags)
+		}
+	}
+	if traceLog[0].From != "com.test.api" || traceLog[0].To != "com.test.add" {
+		t.Fatalf("Expected REQ record to be com.test.api -> com.test.add; got %s -> %s", traceLog[0].From, traceLog[0].To)
+	}
+	if traceLog[1].From != "com.test.add" || traceLog[1].To != "com.test.api" {
+		t.Fatalf("Expected RES record to be com.test.add -> com.test.api; got %s -> %s", traceLog[1].From, traceLog[1].To)
+	}
+}
+
+func TestTracerPayloadCapture(t *testing.T) {
+	var err error
+
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracePkg.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ep := usrv.Endpoint{
+		Name: "traceTest",
+		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
+			rw.Write([]byte("response "))
+			rw.Write([]byte("payload"))
+		}),
+	}
+
+	var redactedEndpoints []string
+	err = Tracer(
+		collector,
+		PayloadHash(),
+		PayloadPreview(8),
+		PayloadRedactor(func(endpoint string, payload []byte) []byte {
+			redactedEndpoints = append(redactedEndpoints, endpoint)
+			return bytes.Replace(payload, []byte("s3cr3t"), []byte("******"), -1)
+		}),
+	)(&ep)
+	if err != nil {
+		t.Fatalf("Error applying Tracer() to endpoint: %v", err)
+	}
+
+	msg := &usrv.Message{
+		From:          "sender",
+		To:            "recipient",
+		CorrelationId: "123",
+		Payload:       []byte("s3cr3t request"),
+	}
+
+	w := usrvtest.NewRecorder()
+	ep.Handler.Serve(context.Background(), w, msg)
+	traceId := w.Header().Get(CtxTraceId)
+
+	// Block till both entries are processed
+	<-processedChan
+	<-processedChan
+
+	traceLog, err := storage.GetTrace(traceId.(string))
+	if err != nil {
+		t.Fatalf("Error retrieving trace with id %s: %v", traceId, err)
+	}
+	if len(traceLog) != 2 {
+		t.Fatalf("Expected trace len to be 2; got %d", len(traceLog))
+	}
+
+	type spec struct {
+		size     int64
+		redacted string
+	}
+	specs := []spec{
+		{14, "****** request"},
+		{16, "response payload"},
+	}
+	for index, s := range specs {
+		rec := traceLog[index]
+		if rec.PayloadSize != s.size {
+			t.Fatalf("[rec %d] Expected PayloadSize to be %d; got %d", index, s.size, rec.PayloadSize)
+		}
+		if rec.PayloadPreview != s.redacted[:8] {
+			t.Fatalf("[rec %d] Expected PayloadPreview to be %q; got %q", index, s.redacted[:8], rec.PayloadPreview)
+		}
+		sum := sha256.Sum256([]byte(s.redacted))
+		if expHash := hex.EncodeToString(sum[:8]); rec.PayloadHash != expHash {
+			t.Fatalf("[rec %d] Expected PayloadHash to be %q; got %q", index, expHash, rec.PayloadHash)
+		}
+	}
+
+	if !reflect.DeepEqual(redactedEndpoints, []string{"recipient", "sender"}) {
+		t.Fatalf("Expected redactor to be invoked for [recipient sender]; got %v", redactedEndpoints)
+	}
+}
+
+func TestResponseRecorderPayloadCapture(t *testing.T) {
+	options, err := newTracerOptions([]TracerOption{PayloadHash(), PayloadPreview(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := newResponseRecorder(usrvtest.NewRecorder(), options)
+	for _, chunk := range []string{"res", "ponse ", "payload"} {
+		recorder.Write([]byte(chunk))
+	}
+
+	// Only the bytes needed for the preview should be kept
+	if string(recorder.payload) != "resp" {
+		t.Fatalf("Expected recorder to keep %q; got %q", "resp", recorder.payload)
+	}
+
+	var rec tracePkg.Record
+	recorder.recordPayload(&rec, "sender")
+	sum := sha256.Sum256([]byte("response payload"))
+	if expHash := hex.EncodeToString(sum[:8]); rec.PayloadHash != expHash {
+		t.Fatalf("Expected PayloadHash to be %q; got %q", expHash, rec.PayloadHash)
+	}
+	if rec.PayloadPreview != "resp" || rec.PayloadSize != 16 {
+		t.Fatalf("Unexpected payload preview/size: %q, %d", rec.PayloadPreview, rec.PayloadSize)
+	}
+
+	// Nothing should be kept if only the payload hash is recorded
+	options, err = newTracerOptions([]TracerOption{PayloadHash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = newResponseRecorder(usrvtest.NewRecorder(), options)
+	recorder.Write([]byte("response payload"))
+	if len(recorder.payload) != 0 {
+		t.Fatalf("Expected recorder not to keep the payload; got %q", recorder.payload)
+	}
+}
+
+func TestPayloadPreviewValidation(t *testing.T) {
+	_, err := newTracerOptions([]TracerOption{PayloadPreview(-1)})
+	if err != ErrInvalidPreviewSize {
+		t.Fatalf("Expected error %v; got %v", ErrInvalidPreviewSize, err)
+	}
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/achilleasa/usrv"
+	tracePkg "github.com/achilleasa/usrv-tracer"
+)
+
+// Check whether the payload contents need to be captured.
+func (opts *tracerOptions) capturePayloads() bool {
+	return opts.payloadHash || opts.payloadPreview > 0
+}
+
+// Populate the payload fields of a record. The endpoint is the name of the endpoint
+// that the payload is sent to.
+func (opts *tracerOptions) recordPayload(rec *tracePkg.Record, endpoint string, payload []byte) {
+	rec.PayloadSize = int64(len(payload))
+	if !opts.capturePayloads() || len(payload) == 0 {
+		return
+	}
+
+	if opts.redactPayload != nil {
+		payload = opts.redactPayload(endpoint, payload)
+	}
+	var sum []byte
+	if opts.payloadHash {
+		hashSum := sha256.Sum256(payload)
+		sum = hashSum[:]
+	}
+	opts.setPayloadFields(rec, sum, payload)
+}
+
+// Populate the hash and preview fields of a record given the payload hash sum (nil
+// if payload hashing is disabled) and the payload or its first payloadPreview bytes.
+func (opts *tracerOptions) setPayloadFields(rec *tracePkg.Record, sum []byte, payload []byte) {
+	if sum != nil {
+		rec.PayloadHash = hex.EncodeToString(sum[:8])
+	}
+	if opts.payloadPreview > 0 {
+		if len(payload) > opts.payloadPreview {
+			payload = payload[:opts.payloadPreview]
+		}
+		rec.PayloadPreview = strings.ToValidUTF8(string(payload), "�")
+	}
+}
+
+// A response writer that captures the error and the payload written by a handler.
+type responseRecorder struct {
+	usrv.ResponseWriter
+	err     error
+	options *tracerOptions
+
+	// The number of bytes written by the handler. If payload capturing is enabled
+	// the payload is hashed as it is written and only the bytes needed for the
+	// preview are kept. Redactors operate on the entire payload so the entire
+	// payload is kept when a redactor is specified.
+	size    int
+	hash    hash.Hash
+	payload []byte
+}
+
+func newResponseRecorder(responseWriter usrv.ResponseWriter, options *tracerOptions) *responseRecorder {
+	w := &responseRecorder{ResponseWriter: responseWriter, options: options}
+	if options.payloadHash && options.redactPayload == nil {
+		w.hash = sha256.New()
+	}
+	return w
+}
+
+func (w *responseRecorder) WriteError(err error) error {
+	w.err = err
+	return w.ResponseWriter.WriteError(err)
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	if !w.options.capturePayloads() {
+		return n, err
+	}
+
+	data = data[:n]
+	if w.hash != nil {
+		w.hash.Write(data)
+	}
+	if w.options.redactPayload == nil {
+		room := w.options.payloadPreview - len(w.payload)
+		if room < 0 {
+			room = 0
+		}
+		if len(data) > room {
+			data = data[:room]
+		}
+	}
+	w.payload = append(w.payload, data...)
+	return n, err
+}
+
+// Populate the payload fields of the response record. The endpoint is the name of
+// the endpoint that the response is sent to.
+func (w *responseRecorder) recordPayload(rec *tracePkg.Record, endpoint string) {
+	if w.hash == nil {
+		// Either the entire payload or the preview bytes have been kept
+		w.options.recordPayload(rec, endpoint, w.payload)
+	} else if w.size > 0 {
+		w.options.setPayloadFields(rec, w.hash.Sum(nil), w.payload)
+	}
+	rec.PayloadSize = int64(w.size)
+}
@@ -0,0 +1,110 @@
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+// The version byte that prefixes packed traces.
+const packedTraceVersion byte = 0x01
+
+// Pack a trace into a single gzip-compressed blob. Strings that are shared between
+// records (service names, hosts e.t.c) are stored once in a per-trace dictionary
+// and referenced by index from each record.
+func PackTrace(trace Trace) ([]byte, error) {
+	// Encode records first so we can populate the string table
+	enc := recordEncoder{buf: make([]byte, 0, 32*len(trace)), strings: newStringTable()}
+	offsets := make([]int, len(trace)+1)
+	for index := range trace {
+		enc.encode(&trace[index])
+		offsets[index+1] = len(enc.buf)
+	}
+
+	payload := make([]byte, 1, 16+len(enc.buf))
+	payload[0] = packedTraceVersion
+	payload = binary.AppendUvarint(payload, uint64(len(enc.strings.values)))
+	for _, val := range enc.strings.values {
+		payload = binary.AppendUvarint(payload, uint64(len(val)))
+		payload = append(payload, val...)
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(trace)))
+	for index := range trace {
+		rec := enc.buf[offsets[index]:offsets[index+1]]
+		payload = binary.AppendUvarint(payload, uint64(len(rec)))
+		payload = append(payload, rec...)
+	}
+
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	_, err := zw.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Unpack a trace that was packed using PackTrace.
+func UnpackTrace(data []byte) (Trace, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	payload, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) == 0 {
+		return nil, ErrMalformedRecord
+	}
+	if payload[0] != packedTraceVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	dec := recordDecoder{buf: payload[1:]}
+
+	// Load string table
+	count, err := dec.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	dec.strings = make([]string, 0, count)
+	for ; count > 0; count-- {
+		val, err := dec.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		dec.strings = append(dec.strings, string(val))
+	}
+
+	// Load records
+	count, err = dec.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	trace := make(Trace, 0, count)
+	for ; count > 0; count-- {
+		rec, err := dec.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := Record{}
+		recDec := recordDecoder{buf: rec, strings: dec.strings}
+		err = recDec.decode(&entry)
+		if err != nil {
+			return nil, err
+		}
+		trace = append(trace, entry)
+	}
+
+	return trace, nil
+}
@@ -0,0 +1,65 @@
+package tracer_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func TestPackTrace(t *testing.T) {
+	records := testRecords()
+
+	packed, err := tracer.PackTrace(records)
+	if err != nil {
+		t.Fatalf("Error packing trace: %v", err)
+	}
+
+	trace, err := tracer.UnpackTrace(packed)
+	if err != nil {
+		t.Fatalf("Error unpacking trace: %v", err)
+	}
+
+	l, _ := json.Marshal(records)
+	r, _ := json.Marshal(trace)
+	if string(l) != string(r) {
+		t.Fatalf("Expected unpacked trace to be %v; got %v", records, trace)
+	}
+
+	if len(packed) >= len(l) {
+		t.Fatalf("Expected packed trace (%d bytes) to be smaller than json trace (%d bytes)", len(packed), len(l))
+	}
+}
+
+func TestUnpackTraceErrors(t *testing.T) {
+	_, err := tracer.UnpackTrace([]byte("not gzip data"))
+	if err == nil {
+		t.Fatalf("Expected an error when unpacking invalid data")
+	}
+
+	packed, _ := tracer.PackTrace(tracer.Trace{})
+	trace, err := tracer.UnpackTrace(packed)
+	if err != nil {
+		t.Fatalf("Error unpacking empty trace: %v", err)
+	}
+	if len(trace) != 0 {
+		t.Fatalf("Expected empty trace; got %v", trace)
+	}
+}
+
+func BenchmarkPackTrace(b *testing.B) {
+	records := testRecords()[:4]
+	for i := 0; i < 5; i++ {
+		records = append(records, records...)
+	}
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		packed, err := tracer.PackTrace(records)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(packed)
+	}
+	b.ReportMetric(float64(size)/float64(len(records)), "bytes/record")
+}
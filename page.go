@@ -0,0 +1,133 @@
+package tracer
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrInvalidCursor   = errors.New("tracer: invalid trace cursor")
+	ErrInvalidPageSize = errors.New("tracer: trace page size must be positive")
+)
+
+// The tag of a truncation marker that holds the per-trace record cap.
+const MaxRecordsTag = "max_records"
+
+// A TracePage contains a subset of the records of a trace.
+type TracePage struct {
+	// The page records sorted by timestamp. See PagedStorage for the ordering of
+	// records across pages.
+	Records Trace `json:"records"`
+
+	// An opaque cursor for fetching the next page. It is empty if there are no more
+	// records to fetch.
+	NextCursor string `json:"next_cursor,omitempty"`
+
+	// The total number of trace records at the time the page was fetched.
+	Total int `json:"total"`
+}
+
+// The PagedStorage interface is implemented by providers that can fetch large traces
+// in pages instead of loading all trace records at once. Use NewPagedStorage to
+// obtain a PagedStorage for any Storage implementation.
+//
+// The records of each page are sorted by timestamp but ordering is only guaranteed
+// within a page; implementations may page records in the order they were stored so
+// a page can include records that precede the records of earlier pages. Callers
+// that need a time-ordered trace should sort the records of all pages.
+type PagedStorage interface {
+	// Fetch up to limit records of the trace with the given trace-id starting at
+	// cursor. An empty cursor selects the first page.
+	GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (TracePage, error)
+}
+
+// Get a PagedStorage for a storage. If the storage natively implements the
+// PagedStorage interface it is returned as is. Otherwise, it is wrapped by an
+// adapter that loads the entire trace and returns the requested page.
+func NewPagedStorage(storage Storage) PagedStorage {
+	if pagedStorage, ok := storage.(PagedStorage); ok {
+		return pagedStorage
+	}
+	return &pagedAdapter{NewContextStorage(storage)}
+}
+
+// An adapter for using Storage implementations as a PagedStorage.
+type pagedAdapter struct {
+	storage ContextStorage
+}
+
+func (a *pagedAdapter) GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (TracePage, error) {
+	offset, err := ParseCursor(cursor, limit)
+	if err != nil {
+		return TracePage{}, err
+	}
+
+	trace, err := a.storage.GetTraceContext(ctx, traceId)
+	if err != nil {
+		return TracePage{}, err
+	}
+
+	return NewTracePage(trace, offset, limit), nil
+}
+
+// Parse a cursor returned by GetTracePage into a record offset and validate the
+// page size. This function is meant to be used by PagedStorage implementations.
+func ParseCursor(cursor string, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, ErrInvalidPageSize
+	}
+	if cursor == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(cursor)
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
+
+// Create a page with up to limit records of a time-ordered trace starting at offset.
+func NewTracePage(trace Trace, offset int, limit int) TracePage {
+	start := offset
+	if start > len(trace) {
+		start = len(trace)
+	}
+	end := start + limit
+	if end > len(trace) {
+		end = len(trace)
+	}
+
+	page := TracePage{
+		Records: trace[start:end],
+		Total:   len(trace),
+	}
+	if end < len(trace) {
+		page.NextCursor = strconv.Itoa(end)
+	}
+	return page
+}
+
+// Create a marker record that is stored in place of the records of a trace that
+// exceed the per-trace record cap.
+func NewTruncationMarker(traceId string, maxRecords int) Record {
+	return Record{
+		Timestamp: time.Now(),
+		TraceId:   traceId,
+		Type:      Truncated,
+		Tags:      map[string]string{MaxRecordsTag: strconv.Itoa(maxRecords)},
+	}
+}
+
+// Check whether some of the trace records were discarded because the trace
+// exceeded the per-trace record cap of the storage.
+func (t Trace) IsTruncated() bool {
+	for _, rec := range t {
+		if rec.Type == Truncated {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package tracer_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+)
+
+// Hides the native PagedStorage implementation of the wrapped storage.
+type unpagedStorage struct {
+	tracer.Storage
+}
+
+func TestParseCursor(t *testing.T) {
+	specs := []struct {
+		cursor string
+		limit  int
+		offset int
+		err    error
+	}{
+		{"", 10, 0, nil},
+		{"25", 10, 25, nil},
+		{"25", 0, 0, tracer.ErrInvalidPageSize},
+		{"-1", 10, 0, tracer.ErrInvalidCursor},
+		{"abc", 10, 0, tracer.ErrInvalidCursor},
+	}
+
+	for index, spec := range specs {
+		offset, err := tracer.ParseCursor(spec.cursor, spec.limit)
+		if err != spec.err || offset != spec.offset {
+			t.Fatalf("[spec %d] Expected offset %d and error %v; got %d, %v", index, spec.offset, spec.err, offset, err)
+		}
+	}
+}
+
+func TestNewTracePage(t *testing.T) {
+	trace := make(tracer.Trace, 5)
+
+	specs := []struct {
+		offset     int
+		limit      int
+		records    int
+		nextCursor string
+	}{
+		{0, 2, 2, "2"},
+		{2, 2, 2, "4"},
+		{4, 2, 1, ""},
+		{10, 2, 0, ""},
+		{0, 10, 5, ""},
+	}
+
+	for index, spec := range specs {
+		page := tracer.NewTracePage(trace, spec.offset, spec.limit)
+		if len(page.Records) != spec.records || page.NextCursor != spec.nextCursor || page.Total != 5 {
+			t.Fatalf("[spec %d] Expected %d records and next cursor %q; got %d records and next cursor %q", index, spec.records, spec.nextCursor, len(page.Records), page.NextCursor)
+		}
+	}
+}
+
+func TestPagedStorageAdapter(t *testing.T) {
+	backend := &unpagedStorage{storage.Memory}
+	defer backend.Close()
+
+	if tracer.NewPagedStorage(storage.Memory) != tracer.PagedStorage(storage.Memory) {
+		t.Fatalf("Expected storages implementing PagedStorage to be returned as is")
+	}
+
+	now := time.Now()
+	traceId := "abcd-1234-1234-1234"
+	for index := 2; index >= 0; index-- {
+		rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now.Add(time.Duration(index) * time.Second), TraceId: traceId}
+		backend.Store(&rec, 0)
+	}
+
+	pagedStorage := tracer.NewPagedStorage(backend)
+	page, err := pagedStorage.GetTracePage(context.Background(), traceId, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 || page.Total != 3 || page.NextCursor != "2" {
+		t.Fatalf("Unexpected first page: %v", page)
+	}
+	if !page.Records[0].Timestamp.Equal(now) {
+		t.Fatalf("Expected page records to be sorted by timestamp")
+	}
+
+	page, err = pagedStorage.GetTracePage(context.Background(), traceId, page.NextCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || page.NextCursor != "" {
+		t.Fatalf("Unexpected last page: %v", page)
+	}
+
+	_, err = pagedStorage.GetTracePage(context.Background(), traceId, "", 0)
+	if err != tracer.ErrInvalidPageSize {
+		t.Fatalf("Expected to get ErrInvalidPageSize; got %v", err)
+	}
+}
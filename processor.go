@@ -0,0 +1,116 @@
+package tracer
+
+import "path"
+
+// A Processor inspects a record before it is stored. Processors may modify the record
+// in place; the collector passes each processor chain a private copy of the record
+// that was supplied to Add. Process returns false if the record should be dropped.
+type Processor interface {
+	Process(rec *Record) bool
+}
+
+// The ProcessorFunc type is an adapter to allow the use of ordinary functions as
+// processors.
+type ProcessorFunc func(rec *Record) bool
+
+// Process a record by invoking f(rec).
+func (f ProcessorFunc) Process(rec *Record) bool {
+	return f(rec)
+}
+
+// Create a processor that adds a set of static tags (e.g. environment, region or build
+// version) to each record. Tags already defined by a record are not overwritten.
+func StaticTags(tags map[string]string) Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		if rec.Tags == nil {
+			rec.Tags = make(map[string]string, len(tags))
+		}
+		for key, val := range tags {
+			if _, exists := rec.Tags[key]; !exists {
+				rec.Tags[key] = val
+			}
+		}
+		return true
+	})
+}
+
+// Create a processor that rewrites the service names (From/To) of each record
+// using the supplied function.
+func RewriteServices(rewrite func(service string) string) Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		rec.From = rewrite(rec.From)
+		rec.To = rewrite(rec.To)
+		return true
+	})
+}
+
+// Create a processor that renames services. Services not included in the renames
+// map are left intact.
+func RenameServices(renames map[string]string) Processor {
+	return RewriteServices(func(service string) string {
+		if renamed, exists := renames[service]; exists {
+			return renamed
+		}
+		return service
+	})
+}
+
+// Create a processor that drops records sent from or to any service matching the
+// supplied patterns (e.g. health-check traffic). Patterns use the path.Match syntax.
+func DropServices(patterns ...string) Processor {
+	return DropRecords(ServiceMatches(patterns...))
+}
+
+// Create a processor that only keeps records sent from or to a service matching the
+// supplied patterns. Patterns use the path.Match syntax.
+func KeepServices(patterns ...string) Processor {
+	matches := ServiceMatches(patterns...)
+	return ProcessorFunc(func(rec *Record) bool {
+		return matches(rec)
+	})
+}
+
+// A DropRule that matches records sent from or to a service matching any of the
+// supplied patterns. Patterns use the path.Match syntax; malformed patterns never match.
+func ServiceMatches(patterns ...string) DropRule {
+	return func(rec *Record) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, rec.From); matched {
+				return true
+			}
+			if matched, _ := path.Match(pattern, rec.To); matched {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Create a deep copy of the record.
+func (r *Record) clone() *Record {
+	c := *r
+	if r.Tags != nil {
+		c.Tags = make(map[string]string, len(r.Tags))
+		for key, val := range r.Tags {
+			c.Tags[key] = val
+		}
+	}
+	if r.ErrorInfo != nil {
+		info := *r.ErrorInfo
+		c.ErrorInfo = &info
+	}
+	return &c
+}
+
+// Apply fn to all free-form text fields of the record (error messages, payload
+// previews and tag values).
+func (r *Record) mapText(fn func(string) string) {
+	r.Error = fn(r.Error)
+	if r.ErrorInfo != nil {
+		r.ErrorInfo.Message = fn(r.ErrorInfo.Message)
+	}
+	r.PayloadPreview = fn(r.PayloadPreview)
+	for key, val := range r.Tags {
+		r.Tags[key] = fn(val)
+	}
+}
@@ -0,0 +1,61 @@
+package tracer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func TestStaticTags(t *testing.T) {
+	p := tracer.StaticTags(map[string]string{"env": "prod", "region": "eu-west-1"})
+
+	rec, keep := process(p, tracer.Record{})
+	if !keep || rec.Tags["env"] != "prod" || rec.Tags["region"] != "eu-west-1" {
+		t.Fatalf("expected static tags to be added; got %v", rec.Tags)
+	}
+
+	rec, _ = process(p, tracer.Record{Tags: map[string]string{"region": "us-east-1"}})
+	if rec.Tags["region"] != "us-east-1" || rec.Tags["env"] != "prod" {
+		t.Fatalf("expected existing tags not to be overwritten; got %v", rec.Tags)
+	}
+}
+
+func TestRenameServices(t *testing.T) {
+	p := tracer.RenameServices(map[string]string{"com.test.add/2": "com.test.add"})
+
+	rec, keep := process(p, tracer.Record{From: "com.test.api", To: "com.test.add/2"})
+	if !keep || rec.From != "com.test.api" || rec.To != "com.test.add" {
+		t.Fatalf("expected To to be renamed; got %s -> %s", rec.From, rec.To)
+	}
+
+	rec, _ = process(tracer.RewriteServices(strings.ToUpper), tracer.Record{From: "a", To: "b"})
+	if rec.From != "A" || rec.To != "B" {
+		t.Fatalf("expected services to be rewritten; got %s -> %s", rec.From, rec.To)
+	}
+}
+
+func TestFilterServices(t *testing.T) {
+	drop := tracer.DropServices("*.healthcheck", "com.test.ping")
+	keep := tracer.KeepServices("com.test.*")
+
+	specs := []struct {
+		rec              tracer.Record
+		dropKeeps, keeps bool
+	}{
+		{tracer.Record{From: "lb.healthcheck", To: "com.test.api"}, false, true},
+		{tracer.Record{From: "com.test.api", To: "lb.healthcheck"}, false, true},
+		{tracer.Record{From: "com.test.api", To: "com.test.ping"}, false, true},
+		{tracer.Record{From: "com.test.api", To: "com.test.add"}, true, true},
+		{tracer.Record{From: "com.other.api", To: "com.other.add"}, true, false},
+	}
+
+	for index, spec := range specs {
+		if _, kept := process(drop, spec.rec); kept != spec.dropKeeps {
+			t.Fatalf("[spec %d] expected DropServices to return %t; got %t", index, spec.dropKeeps, kept)
+		}
+		if _, kept := process(keep, spec.rec); kept != spec.keeps {
+			t.Fatalf("[spec %d] expected KeepServices to return %t; got %t", index, spec.keeps, kept)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package tracer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// Patterns for detecting common types of personally identifiable information and secrets.
+var (
+	EmailPattern = regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`)
+
+	// Bearer/basic authorization credentials and JSON web tokens.
+	TokenPattern = regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+[a-z0-9\-._~+/]+=*|\beyJ[a-zA-Z0-9_\-]+\.[a-zA-Z0-9_\-]+\.[a-zA-Z0-9_\-]*`)
+
+	// Sequences of 13-19 digits that may be separated by spaces or dashes. Matches
+	// are only redacted by RedactCardNumbers if they pass the Luhn check.
+	CardNumberPattern = regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`)
+)
+
+// A DropRule decides whether a record should be dropped.
+type DropRule func(rec *Record) bool
+
+// Create a processor that replaces all matches of pattern in the free-form text
+// fields of a record (error messages, payload previews and tag values).
+func RedactPattern(pattern *regexp.Regexp, replacement string) Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		rec.mapText(func(val string) string {
+			return pattern.ReplaceAllLiteralString(val, replacement)
+		})
+		return true
+	})
+}
+
+// Create a processor that redacts email addresses.
+func RedactEmails() Processor {
+	return RedactPattern(EmailPattern, "[email]")
+}
+
+// Create a processor that redacts authorization credentials and JSON web tokens.
+func RedactTokens() Processor {
+	return RedactPattern(TokenPattern, "[token]")
+}
+
+// Create a processor that redacts credit card numbers. To avoid redacting other
+// numeric values (timestamps, ids e.t.c), only numbers that pass the Luhn check
+// are redacted.
+func RedactCardNumbers() Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		rec.mapText(func(val string) string {
+			return CardNumberPattern.ReplaceAllStringFunc(val, func(match string) string {
+				if !luhnValid(match) {
+					return match
+				}
+				return "[card]"
+			})
+		})
+		return true
+	})
+}
+
+// Create a processor that replaces the values associated with the supplied keys.
+// Keys are matched case-insensitively against record tags as well as against
+// key/value pairs (e.g. "password": "secret" or password=secret) that appear in
+// the free-form text fields of the record. If no keys are specified, records are
+// left unchanged.
+func RedactKeys(replacement string, keys ...string) Processor {
+	if len(keys) == 0 {
+		return ProcessorFunc(func(rec *Record) bool {
+			return true
+		})
+	}
+
+	quoted := make([]string, len(keys))
+	keySet := make(map[string]struct{}, len(keys))
+	for index, key := range keys {
+		quoted[index] = regexp.QuoteMeta(key)
+		keySet[strings.ToLower(key)] = struct{}{}
+	}
+	pattern := regexp.MustCompile(`(?i)("?\b(?:` + strings.Join(quoted, "|") + `)"?\s*[:=]\s*)("[^"]*"|[^\s,&;}]+)`)
+	quotedReplacement := `"` + replacement + `"`
+
+	return ProcessorFunc(func(rec *Record) bool {
+		for key := range rec.Tags {
+			if _, exists := keySet[strings.ToLower(key)]; exists {
+				rec.Tags[key] = replacement
+			}
+		}
+		rec.mapText(func(val string) string {
+			return pattern.ReplaceAllStringFunc(val, func(match string) string {
+				groups := pattern.FindStringSubmatch(match)
+				if strings.HasPrefix(groups[2], `"`) {
+					return groups[1] + quotedReplacement
+				}
+				return groups[1] + replacement
+			})
+		})
+		return true
+	})
+}
+
+// Create a processor that replaces the values of the supplied tags with their keyed
+// (HMAC-SHA256) hash. Hashed values can still be used for correlating records
+// (e.g. all records for a particular user) without exposing the original values.
+// The secret prevents the original values from being recovered by hashing a list of
+// candidate values.
+func HashTags(secret []byte, tags ...string) Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		for _, tag := range tags {
+			val, exists := rec.Tags[tag]
+			if !exists {
+				continue
+			}
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(val))
+			rec.Tags[tag] = hex.EncodeToString(mac.Sum(nil)[:16])
+		}
+		return true
+	})
+}
+
+// Create a processor that drops records matching any of the supplied rules.
+func DropRecords(rules ...DropRule) Processor {
+	return ProcessorFunc(func(rec *Record) bool {
+		for _, rule := range rules {
+			if rule(rec) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// A DropRule that matches records with the supplied tag. If no values are specified,
+// all records that define the tag are matched.
+func HasTag(key string, values ...string) DropRule {
+	return func(rec *Record) bool {
+		val, exists := rec.Tags[key]
+		if !exists {
+			return false
+		}
+		if len(values) == 0 {
+			return true
+		}
+		for _, candidate := range values {
+			if val == candidate {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// A DropRule that matches records whose free-form text fields match pattern. It can
+// be used for dropping records that contain sensitive data which cannot be redacted.
+func ContainsPattern(pattern *regexp.Regexp) DropRule {
+	return func(rec *Record) bool {
+		if pattern.MatchString(rec.Error) || pattern.MatchString(rec.PayloadPreview) {
+			return true
+		}
+		if rec.ErrorInfo != nil && pattern.MatchString(rec.ErrorInfo.Message) {
+			return true
+		}
+		for _, val := range rec.Tags {
+			if pattern.MatchString(val) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Check whether a number passes the Luhn checksum. Spaces and dashes are ignored.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for index := len(number) - 1; index >= 0; index-- {
+		c := number[index]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
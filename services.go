@@ -0,0 +1,190 @@
+package tracer
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The number of recent call durations that storage engines retain for each service
+// for estimating its latency percentiles.
+const LatencySampleSize = 1000
+
+// The ServiceSummary describes a service and its recent activity.
+type ServiceSummary struct {
+	Service string `json:"service"`
+
+	// The timestamps of the first and last trace records stored for this service.
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// The hosts that served requests for this service.
+	Hosts []string `json:"hosts"`
+
+	// The number of served calls and the fraction of calls that failed.
+	Calls     int64   `json:"calls"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+
+	// Latency percentiles (in nanoseconds) calculated over the most recent calls.
+	P50 time.Duration `json:"p50"`
+	P99 time.Duration `json:"p99"`
+
+	// The services calling this service (upstream) and the services called by this
+	// service (downstream).
+	Callers      []string `json:"callers"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// Set the call counters and calculate the error rate.
+func (s *ServiceSummary) SetCalls(calls, errors int64) {
+	s.Calls = calls
+	s.Errors = errors
+	s.ErrorRate = 0
+	if calls > 0 {
+		s.ErrorRate = float64(errors) / float64(calls)
+	}
+}
+
+// Calculate the latency percentiles from a sample of call durations.
+func (s *ServiceSummary) SetLatencies(latencies []time.Duration) {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Sort(durationList(sorted))
+	s.P50 = percentile(sorted, 0.50)
+	s.P99 = percentile(sorted, 0.99)
+}
+
+// Get the nearest-rank percentile of a sorted list of durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Get the service whose activity is described by a record. Server requests are
+// attributed to the called service and server responses to the responding
+// service. Returns an empty string for client records and truncation markers.
+func (r *Record) ServedBy() string {
+	if r.Kind != Server {
+		return ""
+	}
+	switch r.Type {
+	case Request:
+		return r.To
+	case Response:
+		return r.From
+	}
+	return ""
+}
+
+// The ServiceCatalog interface is implemented by providers that can summarize the
+// activity of each known service. Use NewServiceCatalog to obtain a ServiceCatalog
+// for any Storage implementation.
+type ServiceCatalog interface {
+	// Get the summaries of all known services sorted by service name.
+	GetServices(ctx context.Context) ([]ServiceSummary, error)
+}
+
+// Get a ServiceCatalog for a storage. If the storage natively implements the
+// ServiceCatalog interface it is returned as is. Otherwise, it is wrapped by an
+// adapter that builds the summaries from the service dependencies; these summaries
+// only include the callers and dependencies of each service.
+func NewServiceCatalog(storage Storage) ServiceCatalog {
+	if catalog, ok := storage.(ServiceCatalog); ok {
+		return catalog
+	}
+	return &catalogAdapter{NewContextStorage(storage)}
+}
+
+// An adapter for using Storage implementations as a ServiceCatalog.
+type catalogAdapter struct {
+	storage ContextStorage
+}
+
+func (a *catalogAdapter) GetServices(ctx context.Context) ([]ServiceSummary, error) {
+	deps, err := a.storage.GetDependenciesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return SummarizeServices(make(map[string]*ServiceSummary), deps), nil
+}
+
+// Fill in the callers and dependencies of a set of service summaries and return them
+// sorted by service name. Services that only appear as dependencies are added to the
+// summary set. This function is meant to be used by ServiceCatalog implementations.
+func SummarizeServices(summaries map[string]*ServiceSummary, deps []Dependencies) []ServiceSummary {
+	summary := func(service string) *ServiceSummary {
+		s, exists := summaries[service]
+		if !exists {
+			s = &ServiceSummary{Service: service}
+			summaries[service] = s
+		}
+		return s
+	}
+
+	for _, dep := range deps {
+		summary(dep.Service).Dependencies = append([]string(nil), dep.Dependencies...)
+		for _, target := range dep.Dependencies {
+			callee := summary(target)
+			callee.Callers = append(callee.Callers, dep.Service)
+		}
+	}
+
+	list := make([]ServiceSummary, 0, len(summaries))
+	for _, s := range summaries {
+		if s.Hosts == nil {
+			s.Hosts = make([]string, 0)
+		}
+		if s.Callers == nil {
+			s.Callers = make([]string, 0)
+		}
+		if s.Dependencies == nil {
+			s.Dependencies = make([]string, 0)
+		}
+		sort.Strings(s.Hosts)
+		sort.Strings(s.Callers)
+		sort.Strings(s.Dependencies)
+		list = append(list, *s)
+	}
+	sort.Sort(summariesByService(list))
+	return list
+}
+
+// Sort service summaries by service name. Implements sort.Interface
+type summariesByService []ServiceSummary
+
+func (s summariesByService) Len() int {
+	return len(s)
+}
+
+func (s summariesByService) Less(i, j int) bool {
+	return s[i].Service < s[j].Service
+}
+
+func (s summariesByService) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Sort durations in ascending order. Implements sort.Interface
+type durationList []time.Duration
+
+func (l durationList) Len() int {
+	return len(l)
+}
+
+func (l durationList) Less(i, j int) bool {
+	return l[i] < l[j]
+}
+
+func (l durationList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
@@ -0,0 +1,98 @@
+package tracer_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+)
+
+func TestServiceSummaryStats(t *testing.T) {
+	summary := tracer.ServiceSummary{}
+	summary.SetCalls(200, 50)
+	if summary.ErrorRate != 0.25 {
+		t.Fatalf("Expected error rate to be 0.25; got %f", summary.ErrorRate)
+	}
+	summary.SetCalls(0, 0)
+	if summary.ErrorRate != 0 {
+		t.Fatalf("Expected error rate to be 0 when there are no calls; got %f", summary.ErrorRate)
+	}
+
+	latencies := make([]time.Duration, 0)
+	for index := 100; index > 0; index-- {
+		latencies = append(latencies, time.Duration(index)*time.Millisecond)
+	}
+	summary.SetLatencies(latencies)
+	if summary.P50 != 50*time.Millisecond {
+		t.Fatalf("Expected p50 to be 50ms; got %v", summary.P50)
+	}
+	if summary.P99 != 99*time.Millisecond {
+		t.Fatalf("Expected p99 to be 99ms; got %v", summary.P99)
+	}
+	if latencies[0] != 100*time.Millisecond {
+		t.Fatalf("Expected SetLatencies not to modify the supplied latencies")
+	}
+
+	summary.SetLatencies(nil)
+	if summary.P50 != 0 || summary.P99 != 0 {
+		t.Fatalf("Expected percentiles to be 0 when there are no latencies")
+	}
+}
+
+func TestRecordServedBy(t *testing.T) {
+	specs := []struct {
+		rec     tracer.Record
+		service string
+	}{
+		{tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2"}, "com.service2"},
+		{tracer.Record{Type: tracer.Response, From: "com.service2", To: "com.service1"}, "com.service2"},
+		{tracer.Record{Type: tracer.Request, Kind: tracer.Client, From: "com.service1", To: "com.service2"}, ""},
+		{tracer.NewTruncationMarker("trace", 10), ""},
+	}
+
+	for index, spec := range specs {
+		if service := spec.rec.ServedBy(); service != spec.service {
+			t.Fatalf("[spec %d] Expected record to be served by %q; got %q", index, spec.service, service)
+		}
+	}
+}
+
+func TestServiceCatalogAdapter(t *testing.T) {
+	backend := &unpagedStorage{storage.Memory}
+	defer backend.Close()
+
+	records := []tracer.Record{
+		{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: time.Now()},
+		{Type: tracer.Request, From: "com.service1", To: "com.service3", Timestamp: time.Now()},
+		{Type: tracer.Request, From: "com.service2", To: "com.service3", Timestamp: time.Now()},
+	}
+	for _, rec := range records {
+		backend.Store(&rec, 0)
+	}
+
+	services, err := tracer.NewServiceCatalog(backend).GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expCallers := map[string][]string{
+		"com.service1": {},
+		"com.service2": {"com.service1"},
+		"com.service3": {"com.service1", "com.service2"},
+	}
+	if len(services) != len(expCallers) {
+		t.Fatalf("Expected %d services; got %d", len(expCallers), len(services))
+	}
+	for _, srv := range services {
+		if !reflect.DeepEqual(srv.Callers, expCallers[srv.Service]) {
+			t.Fatalf("Expected callers of %s to be %v; got %v", srv.Service, expCallers[srv.Service], srv.Callers)
+		}
+		if srv.Calls != 0 {
+			t.Fatalf("Expected adapter summaries not to include call stats")
+		}
+	}
+}
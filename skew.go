@@ -0,0 +1,209 @@
+package tracer
+
+import (
+	"sort"
+	"time"
+)
+
+// A SkewAdjustment describes the offset that was added to the timestamps of
+// all records emitted by a particular host.
+type SkewAdjustment struct {
+	Host   string        `json:"host"`
+	Offset time.Duration `json:"offset"`
+}
+
+// A call is a pair of server REQ/RES records that share the same CorrelationId.
+type call struct {
+	req, res *Record
+}
+
+// The range of clock offsets for a host that satisfy the causal constraints
+// imposed by the calls it serves.
+type offsetRange struct {
+	lo, hi time.Duration
+}
+
+// Adjust trace timestamps to compensate for clock skew between the hosts that
+// emitted the trace records.
+//
+// Each call that is served by a host must start after and finish before the call
+// that invoked it. Using the REQ/RES pairs for each CorrelationId, this method
+// estimates the clock offset of each host relative to the host that served the
+// root request. Timestamps are only shifted for hosts whose records violate
+// causality; the records of those hosts are shifted so that each call is
+// centered within the call that invoked it. The trace is then sorted.
+//
+// The method returns the list of adjustments (sorted by host name) that were applied
+// to the trace. If no adjustment was required, an empty list is returned.
+func (t Trace) AdjustSkew() []SkewAdjustment {
+	adjustments := make([]SkewAdjustment, 0)
+
+	// Pair requests and responses
+	calls := make(map[string]*call)
+	order := make([]string, 0)
+	for index := range t {
+		rec := &t[index]
+		if rec.Kind != Server || (rec.Type != Request && rec.Type != Response) {
+			continue
+		}
+		c, exists := calls[rec.CorrelationId]
+		if !exists {
+			c = &call{}
+			calls[rec.CorrelationId] = c
+			order = append(order, rec.CorrelationId)
+		}
+		if rec.Type == Request {
+			c.req = rec
+		} else {
+			c.res = rec
+		}
+	}
+
+	// Index complete calls by the service that served them
+	served := make(map[string][]*call)
+	complete := make([]*call, 0)
+	for _, corrId := range order {
+		c := calls[corrId]
+		if c.req == nil || c.res == nil {
+			continue
+		}
+		served[c.req.To] = append(served[c.req.To], c)
+		complete = append(complete, c)
+	}
+	if len(complete) == 0 {
+		return adjustments
+	}
+
+	// The root call is the earliest call whose caller did not serve any calls
+	var root *call
+	for _, c := range complete {
+		if _, isServer := served[c.req.From]; isServer {
+			continue
+		}
+		if root == nil || c.req.Timestamp.Before(root.req.Timestamp) {
+			root = c
+		}
+	}
+	if root == nil {
+		root = complete[0]
+	}
+
+	// Collect offset constraints between the host of each call and the host of its caller
+	constraints := make(map[string]map[string]*offsetRange)
+	for _, child := range complete {
+		parent := findParentCall(child, served[child.req.From])
+		if parent == nil || parent.req.Host == child.req.Host {
+			continue
+		}
+
+		lo := parent.req.Timestamp.Sub(child.req.Timestamp)
+		hi := parent.res.Timestamp.Sub(child.res.Timestamp)
+		if constraints[parent.req.Host] == nil {
+			constraints[parent.req.Host] = make(map[string]*offsetRange)
+		}
+		r, exists := constraints[parent.req.Host][child.req.Host]
+		if !exists {
+			constraints[parent.req.Host][child.req.Host] = &offsetRange{lo, hi}
+			continue
+		}
+		if lo > r.lo {
+			r.lo = lo
+		}
+		if hi < r.hi {
+			r.hi = hi
+		}
+	}
+
+	// Walk the host graph starting from the root host and accumulate offsets
+	offsets := map[string]time.Duration{root.req.Host: 0}
+	queue := []string{root.req.Host}
+	for len(queue) > 0 {
+		parentHost := queue[0]
+		queue = queue[1:]
+
+		childHosts := make([]string, 0, len(constraints[parentHost]))
+		for childHost := range constraints[parentHost] {
+			childHosts = append(childHosts, childHost)
+		}
+		sort.Strings(childHosts)
+
+		for _, childHost := range childHosts {
+			if _, visited := offsets[childHost]; visited {
+				continue
+			}
+			r := constraints[parentHost][childHost]
+			offsets[childHost] = pickOffset(r.lo+offsets[parentHost], r.hi+offsets[parentHost])
+			queue = append(queue, childHost)
+		}
+	}
+
+	for host, offset := range offsets {
+		if offset != 0 {
+			adjustments = append(adjustments, SkewAdjustment{Host: host, Offset: offset})
+		}
+	}
+	if len(adjustments) == 0 {
+		return adjustments
+	}
+	sort.Sort(skewAdjustmentsByHost(adjustments))
+
+	// Apply offsets and sort
+	for index := range t {
+		if offset, exists := offsets[t[index].Host]; exists && offset != 0 {
+			t[index].Timestamp = t[index].Timestamp.Add(offset)
+		}
+	}
+	sort.Sort(t)
+
+	return adjustments
+}
+
+// Find the call that most likely invoked a child call. When several calls served by
+// the caller are candidates, the one requiring the smallest clock adjustment is selected.
+func findParentCall(child *call, candidates []*call) *call {
+	var parent *call
+	var parentCost time.Duration
+	for _, candidate := range candidates {
+		if candidate == child {
+			continue
+		}
+
+		offset := pickOffset(
+			candidate.req.Timestamp.Sub(child.req.Timestamp),
+			candidate.res.Timestamp.Sub(child.res.Timestamp),
+		)
+		if offset < 0 {
+			offset = -offset
+		}
+		if parent == nil || offset < parentCost {
+			parent = candidate
+			parentCost = offset
+		}
+	}
+	return parent
+}
+
+// Pick an offset within the [lo, hi] range. If the range includes zero then no
+// adjustment is required. Otherwise, the midpoint is returned so that the child
+// call is centered within its parent call.
+func pickOffset(lo, hi time.Duration) time.Duration {
+	if lo <= 0 && hi >= 0 {
+		return 0
+	}
+	return lo + (hi-lo)/2
+}
+
+// Sort skew adjustments by host. Implements sort.Interface
+type skewAdjustmentsByHost []SkewAdjustment
+
+func (s skewAdjustmentsByHost) Len() int {
+	return len(s)
+}
+
+func (s skewAdjustmentsByHost) Less(l, r int) bool {
+	return s[l].Host < s[r].Host
+}
+
+func (s skewAdjustmentsByHost) Swap(l, r int) {
+	s[l], s[r] = s[r], s[l]
+}
@@ -0,0 +1,87 @@
+package tracer_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func TestAdjustSkew(t *testing.T) {
+	now := time.Now()
+	skew := -time.Second
+
+	// host-b runs 1 sec behind host-a
+	trace := tracer.Trace{
+		tracer.Record{Type: tracer.Request, CorrelationId: "1", From: "api", To: "svcA", Host: "host-a", Timestamp: now},
+		tracer.Record{Type: tracer.Request, CorrelationId: "2", From: "svcA", To: "svcB", Host: "host-b", Timestamp: now.Add(10*time.Millisecond + skew)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "2", From: "svcB", To: "svcA", Host: "host-b", Timestamp: now.Add(50*time.Millisecond + skew)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "1", From: "svcA", To: "api", Host: "host-a", Timestamp: now.Add(100 * time.Millisecond)},
+	}
+
+	adjustments := trace.AdjustSkew()
+	expAdjustments := []tracer.SkewAdjustment{
+		{Host: "host-b", Offset: 1020 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(expAdjustments, adjustments) {
+		t.Fatalf("Expected adjustments to be %v; got %v", expAdjustments, adjustments)
+	}
+
+	expOrder := []string{"1", "2", "2", "1"}
+	for index, rec := range trace {
+		if rec.CorrelationId != expOrder[index] {
+			t.Fatalf("Expected record %d to have correlation id %s; got %s", index, expOrder[index], rec.CorrelationId)
+		}
+	}
+	if !trace[1].Timestamp.Equal(now.Add(30 * time.Millisecond)) {
+		t.Fatalf("Expected adjusted request timestamp to be %v; got %v", now.Add(30*time.Millisecond), trace[1].Timestamp)
+	}
+}
+
+func TestAdjustSkewWithoutSkew(t *testing.T) {
+	now := time.Now()
+
+	trace := tracer.Trace{
+		tracer.Record{Type: tracer.Request, CorrelationId: "1", From: "api", To: "svcA", Host: "host-a", Timestamp: now},
+		tracer.Record{Type: tracer.Request, CorrelationId: "2", From: "svcA", To: "svcB", Host: "host-b", Timestamp: now.Add(10 * time.Millisecond)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "2", From: "svcB", To: "svcA", Host: "host-b", Timestamp: now.Add(50 * time.Millisecond)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "1", From: "svcA", To: "api", Host: "host-a", Timestamp: now.Add(100 * time.Millisecond)},
+	}
+	expTrace := make(tracer.Trace, len(trace))
+	copy(expTrace, trace)
+
+	adjustments := trace.AdjustSkew()
+	if len(adjustments) != 0 {
+		t.Fatalf("Expected no adjustments; got %v", adjustments)
+	}
+	if !reflect.DeepEqual(expTrace, trace) {
+		t.Fatalf("Expected trace to remain unchanged; got %v", trace)
+	}
+}
+
+func TestAdjustSkewMultipleHops(t *testing.T) {
+	now := time.Now()
+
+	// host-b runs 2 sec ahead of host-a and host-c runs 3 sec ahead of host-b
+	trace := tracer.Trace{
+		tracer.Record{Type: tracer.Request, CorrelationId: "1", From: "api", To: "svcA", Host: "host-a", Timestamp: now},
+		tracer.Record{Type: tracer.Request, CorrelationId: "2", From: "svcA", To: "svcB", Host: "host-b", Timestamp: now.Add(2*time.Second + 10*time.Millisecond)},
+		tracer.Record{Type: tracer.Request, CorrelationId: "3", From: "svcB", To: "svcC", Host: "host-c", Timestamp: now.Add(5*time.Second + 20*time.Millisecond)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "3", From: "svcC", To: "svcB", Host: "host-c", Timestamp: now.Add(5*time.Second + 30*time.Millisecond)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "2", From: "svcB", To: "svcA", Host: "host-b", Timestamp: now.Add(2*time.Second + 40*time.Millisecond)},
+		tracer.Record{Type: tracer.Response, CorrelationId: "1", From: "svcA", To: "api", Host: "host-a", Timestamp: now.Add(50 * time.Millisecond)},
+	}
+
+	adjustments := trace.AdjustSkew()
+	if len(adjustments) != 2 {
+		t.Fatalf("Expected 2 adjustments; got %v", adjustments)
+	}
+
+	expOrder := []string{"1", "2", "3", "3", "2", "1"}
+	for index, rec := range trace {
+		if rec.CorrelationId != expOrder[index] {
+			t.Fatalf("Expected record %d to have correlation id %s; got %s (trace: %v)", index, expOrder[index], rec.CorrelationId, trace)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package tracer
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/net/context"
+)
+
+// Keys used for propagating trace details via contexts and carriers. The trace id
+// key matches the header used by the usrv middleware so that spans and usrv
+// endpoints can participate in the same trace.
+const (
+	TraceIdKey = "trace_id"
+	ServiceKey = "trace_service"
+)
+
+type ctxKey int
+
+const (
+	ctxSpan ctxKey = iota
+	ctxSpanContext
+	ctxCollector
+)
+
+// The Carrier interface is implemented by objects that can transport trace
+// details across process boundaries (message headers, queue metadata e.t.c).
+type Carrier interface {
+	// Get the value for a key. Returns an empty string if the key is not defined.
+	Get(key string) string
+
+	// Set the value for a key.
+	Set(key, value string)
+}
+
+// A Carrier backed by a map.
+type MapCarrier map[string]string
+
+// Get the value for a key.
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+// Set the value for a key.
+func (c MapCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// A Carrier backed by a set of http headers.
+type HeaderCarrier http.Header
+
+// Get the value for a key.
+func (c HeaderCarrier) Get(key string) string {
+	return http.Header(c).Get(key)
+}
+
+// Set the value for a key.
+func (c HeaderCarrier) Set(key, value string) {
+	http.Header(c).Set(key, value)
+}
+
+// The SpanContext contains the trace details that are propagated to remote processes.
+type SpanContext struct {
+	// The trace id.
+	TraceId string
+
+	// The name of the service that sent the request.
+	Service string
+}
+
+// A Span represents a unit of work that is part of a trace. Starting a span emits a
+// Request record and finishing it emits the matching Response record.
+type Span struct {
+	TraceId       string
+	CorrelationId string
+
+	// The name of the caller and the name of the span.
+	From string
+	Name string
+
+	// The time the span was started.
+	Start time.Time
+
+	collector *Collector
+	finish    sync.Once
+}
+
+var (
+	hostname     string
+	hostnameOnce sync.Once
+)
+
+// Start a new span and return a context that includes it. The span inherits the
+// trace id from the span (or remote SpanContext) included in the supplied context.
+// If the context does not contain any trace details, a new trace id is allocated.
+//
+// Trace records are emitted to the Collector attached to the context via
+// ContextWithCollector. If no collector is available, no records are emitted.
+func StartSpan(ctx context.Context, name string) (*Span, context.Context) {
+	span := &Span{
+		CorrelationId: uuid.New(),
+		Name:          name,
+		Start:         time.Now(),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.From = parent.Name
+		span.collector = parent.collector
+	} else if sc, ok := ctx.Value(ctxSpanContext).(SpanContext); ok {
+		span.TraceId = sc.TraceId
+		span.From = sc.Service
+	} else if traceId, ok := ctx.Value(TraceIdKey).(string); ok {
+		// Trace id injected by the usrv middleware
+		span.TraceId = traceId
+	}
+
+	if span.TraceId == "" {
+		span.TraceId = uuid.New()
+	}
+	if collector, ok := ctx.Value(ctxCollector).(*Collector); ok {
+		span.collector = collector
+	}
+
+	// Trace span start. This call is non-blocking
+	if span.collector != nil {
+		span.collector.Add(&Record{
+			Timestamp:     span.Start,
+			TraceId:       span.TraceId,
+			CorrelationId: span.CorrelationId,
+			Type:          Request,
+			From:          span.From,
+			To:            span.Name,
+			Host:          getHostname(),
+		})
+	}
+
+	// Also store the trace id using the same key as the usrv middleware so that
+	// any usrv client requests that use this context are linked to the trace.
+	ctx = context.WithValue(ctx, ctxSpan, span)
+	ctx = context.WithValue(ctx, TraceIdKey, span.TraceId)
+	return span, ctx
+}
+
+// Finish the span and emit a Response record. If err is not nil, its message is
+// recorded as the span error. Calling Finish more than once has no effect.
+func (s *Span) Finish(err error) {
+	s.finish.Do(func() {
+		if s.collector == nil {
+			return
+		}
+
+		var errMsg string
+		if err != nil {
+			errMsg = err.Error()
+		}
+
+		// Trace span end. This call is non-blocking
+		s.collector.Add(&Record{
+			Timestamp:     time.Now(),
+			TraceId:       s.TraceId,
+			CorrelationId: s.CorrelationId,
+			Type:          Response,
+			From:          s.Name, // when responding we switch From/To
+			To:            s.From,
+			Host:          getHostname(),
+			Duration:      time.Since(s.Start).Nanoseconds(),
+			Error:         errMsg,
+			ErrorInfo:     ClassifyError(err),
+		})
+	})
+}
+
+// Get the span stored in a context. Returns nil if the context does not contain a span.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(ctxSpan).(*Span)
+	return span
+}
+
+// Attach a collector to the context. Spans started from the returned context
+// (and their child spans) will emit their records to this collector.
+func ContextWithCollector(ctx context.Context, collector *Collector) context.Context {
+	return context.WithValue(ctx, ctxCollector, collector)
+}
+
+// Attach a SpanContext obtained via Extract to a context so that spans started from
+// the returned context join the remote trace.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	ctx = context.WithValue(ctx, ctxSpanContext, sc)
+	return context.WithValue(ctx, TraceIdKey, sc.TraceId)
+}
+
+// Inject the trace details of the span stored in ctx into a carrier. If ctx does not
+// contain a span, the SpanContext or the trace id (if any) injected by the usrv
+// middleware are used instead.
+func Inject(ctx context.Context, carrier Carrier) {
+	if span := SpanFromContext(ctx); span != nil {
+		carrier.Set(TraceIdKey, span.TraceId)
+		carrier.Set(ServiceKey, span.Name)
+		return
+	}
+
+	if sc, ok := ctx.Value(ctxSpanContext).(SpanContext); ok {
+		carrier.Set(TraceIdKey, sc.TraceId)
+		if sc.Service != "" {
+			carrier.Set(ServiceKey, sc.Service)
+		}
+		return
+	}
+
+	if traceId, ok := ctx.Value(TraceIdKey).(string); ok && traceId != "" {
+		carrier.Set(TraceIdKey, traceId)
+	}
+}
+
+// Extract trace details from a carrier. The method returns false if the carrier
+// does not contain a trace id.
+func Extract(carrier Carrier) (SpanContext, bool) {
+	sc := SpanContext{
+		TraceId: carrier.Get(TraceIdKey),
+		Service: carrier.Get(ServiceKey),
+	}
+	return sc, sc.TraceId != ""
+}
+
+// Get the hostname for emitted records.
+func getHostname() string {
+	hostnameOnce.Do(func() {
+		hostname, _ = os.Hostname()
+	})
+	return hostname
+}
@@ -0,0 +1,173 @@
+package tracer_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+	"golang.org/x/net/context"
+)
+
+func TestSpans(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	defer storage.AfterStore(nil)
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracer.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ctx := tracer.ContextWithCollector(context.Background(), collector)
+	parent, ctx := tracer.StartSpan(ctx, "batch-job")
+	child, _ := tracer.StartSpan(ctx, "process-item")
+
+	if tracer.SpanFromContext(ctx) != parent {
+		t.Fatalf("Expected context to contain the parent span")
+	}
+	if ctx.Value(tracer.TraceIdKey) != parent.TraceId {
+		t.Fatalf("Expected context to contain trace id %s; got %v", parent.TraceId, ctx.Value(tracer.TraceIdKey))
+	}
+	if child.TraceId != parent.TraceId {
+		t.Fatalf("Expected child span trace id to be %s; got %s", parent.TraceId, child.TraceId)
+	}
+	if child.From != parent.Name {
+		t.Fatalf("Expected child span From to be %s; got %s", parent.Name, child.From)
+	}
+
+	child.Finish(errors.New("item failed"))
+	child.Finish(nil)
+	parent.Finish(nil)
+
+	// Block till all entries are processed
+	for i := 0; i < 4; i++ {
+		<-processedChan
+	}
+
+	traceLog, err := storage.GetTrace(parent.TraceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace: %v", err)
+	}
+	if len(traceLog) != 4 {
+		t.Fatalf("Expected trace len to be 4; got %d", len(traceLog))
+	}
+
+	for _, rec := range traceLog {
+		if rec.Type != tracer.Response || rec.CorrelationId != child.CorrelationId {
+			continue
+		}
+		if rec.From != "process-item" || rec.To != "batch-job" {
+			t.Fatalf("Expected child response From/To to be process-item/batch-job; got %s/%s", rec.From, rec.To)
+		}
+		if rec.Error != "item failed" {
+			t.Fatalf("Expected child response Error to be 'item failed'; got %q", rec.Error)
+		}
+	}
+}
+
+func TestSpanWithoutCollector(t *testing.T) {
+	span, ctx := tracer.StartSpan(context.Background(), "job")
+	if span.TraceId == "" {
+		t.Fatalf("Expected span to be assigned a trace id")
+	}
+	if tracer.SpanFromContext(ctx) != span {
+		t.Fatalf("Expected context to contain span")
+	}
+	span.Finish(nil)
+}
+
+func TestSpanWithUsrvTraceId(t *testing.T) {
+	ctx := context.WithValue(context.Background(), tracer.TraceIdKey, "0-0-0-0")
+	span, _ := tracer.StartSpan(ctx, "job")
+	if span.TraceId != "0-0-0-0" {
+		t.Fatalf("Expected span to reuse trace id 0-0-0-0; got %s", span.TraceId)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	span, ctx := tracer.StartSpan(context.Background(), "producer")
+
+	carriers := []tracer.Carrier{
+		make(tracer.MapCarrier),
+		tracer.HeaderCarrier(make(http.Header)),
+	}
+
+	for index, carrier := range carriers {
+		if _, ok := tracer.Extract(carrier); ok {
+			t.Fatalf("[carrier %d] Expected Extract to fail for empty carrier", index)
+		}
+
+		tracer.Inject(ctx, carrier)
+		sc, ok := tracer.Extract(carrier)
+		if !ok {
+			t.Fatalf("[carrier %d] Expected Extract to succeed", index)
+		}
+		if sc.TraceId != span.TraceId || sc.Service != span.Name {
+			t.Fatalf("[carrier %d] Expected extracted span context to be {%s %s}; got %v", index, span.TraceId, span.Name, sc)
+		}
+
+		// Spans started in the remote process join the trace
+		remoteCtx := tracer.ContextWithSpanContext(context.Background(), sc)
+		remote, _ := tracer.StartSpan(remoteCtx, "consumer")
+		if remote.TraceId != span.TraceId || remote.From != span.Name {
+			t.Fatalf("[carrier %d] Expected remote span to have trace id %s and From %s; got %s and %s", index, span.TraceId, span.Name, remote.TraceId, remote.From)
+		}
+	}
+}
+
+func TestRootSpanIndexing(t *testing.T) {
+	processedChan := make(chan struct{}, 10)
+
+	storage := storage.Memory
+	defer storage.Close()
+	defer storage.AfterStore(nil)
+	storage.AfterStore(func() {
+		processedChan <- struct{}{}
+	})
+
+	collector, err := tracer.NewCollector(storage, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ctx := tracer.ContextWithCollector(context.Background(), collector)
+	parent, ctx := tracer.StartSpan(ctx, "batch-job")
+	child, _ := tracer.StartSpan(ctx, "process-item")
+	child.Finish(nil)
+	parent.Finish(nil)
+
+	// Block till all entries are processed
+	for i := 0; i < 4; i++ {
+		<-processedChan
+	}
+
+	// The root span has no caller; it should not add an unnamed service to the index
+	deps, err := storage.GetDependencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 2 || deps[0].Service != "batch-job" || deps[1].Service != "process-item" {
+		t.Fatalf("Unexpected dependencies: %v", deps)
+	}
+	if len(deps[0].Dependencies) != 1 || deps[0].Dependencies[0] != "process-item" {
+		t.Fatalf("Expected batch-job to depend on process-item; got %v", deps[0].Dependencies)
+	}
+
+	services, err := tracer.NewServiceCatalog(storage).GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, summary := range services {
+		if summary.Service == "" {
+			t.Fatalf("Expected service catalog not to include an unnamed service; got %v", services)
+		}
+	}
+}
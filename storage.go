@@ -2,6 +2,8 @@ package tracer
 
 import (
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // The Storage interface is implemented by providers that can store and query trace data.
@@ -20,6 +22,130 @@ type Storage interface {
 	// specified then the response will include all services currently known to the storage.
 	GetDependencies(srvFilter ...string) ([]Dependencies, error)
 
+	// Get the services that depend on (call) each service optionally filtered by a set of service
+	// names. The Dependencies field of each returned entry lists the dependents of the service. If
+	// no filters are specified then the response will include all services currently known to the storage.
+	GetDependents(srvFilter ...string) ([]Dependencies, error)
+
+	// Shutdown the storage.
+	Close()
+}
+
+// The ContextStorage interface is implemented by providers that can store and query
+// trace data while honoring the cancellation and deadline of a context. Use
+// NewContextStorage to obtain a ContextStorage for any Storage implementation.
+type ContextStorage interface {
+	// Dial the storage.
+	DialContext(ctx context.Context) error
+
+	// Store a trace entry and set a TTL on it. If the ttl is 0 then the
+	// trace record will never expire.
+	StoreContext(ctx context.Context, logEntry *Record, ttl time.Duration) error
+
+	// Fetch a set of time-ordered trace entries with the given trace-id.
+	GetTraceContext(ctx context.Context, traceId string) (Trace, error)
+
+	// Get service dependencies optionally filtered by a set of service names. If no filters are
+	// specified then the response will include all services currently known to the storage.
+	GetDependenciesContext(ctx context.Context, srvFilter ...string) ([]Dependencies, error)
+
+	// Get the services that depend on (call) each service optionally filtered by a set of service
+	// names. The Dependencies field of each returned entry lists the dependents of the service. If
+	// no filters are specified then the response will include all services currently known to the storage.
+	GetDependentsContext(ctx context.Context, srvFilter ...string) ([]Dependencies, error)
+
 	// Shutdown the storage.
 	Close()
 }
+
+// Get a ContextStorage for a storage. If the storage natively implements the
+// ContextStorage interface it is returned as is. Otherwise, it is wrapped by an
+// adapter that runs each call in a separate go-routine and returns the context
+// error as soon as the context is canceled or its deadline expires. Note that the
+// adapter cannot abort the wrapped call; it will keep running in the background
+// until the underlying storage returns.
+func NewContextStorage(storage Storage) ContextStorage {
+	if ctxStorage, ok := storage.(ContextStorage); ok {
+		return ctxStorage
+	}
+	return &contextAdapter{storage}
+}
+
+// An adapter for using Storage implementations as a ContextStorage.
+type contextAdapter struct {
+	Storage
+}
+
+func (a *contextAdapter) DialContext(ctx context.Context) error {
+	return runWithContext(ctx, a.Storage.Dial)
+}
+
+func (a *contextAdapter) StoreContext(ctx context.Context, logEntry *Record, ttl time.Duration) error {
+	return runWithContext(ctx, func() error {
+		return a.Storage.Store(logEntry, ttl)
+	})
+}
+
+func (a *contextAdapter) GetTraceContext(ctx context.Context, traceId string) (Trace, error) {
+	var trace Trace
+	err := runWithContext(ctx, func() error {
+		var err error
+		trace, err = a.Storage.GetTrace(traceId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+func (a *contextAdapter) GetDependenciesContext(ctx context.Context, srvFilter ...string) ([]Dependencies, error) {
+	var deps []Dependencies
+	err := runWithContext(ctx, func() error {
+		var err error
+		deps, err = a.Storage.GetDependencies(srvFilter...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+func (a *contextAdapter) GetDependentsContext(ctx context.Context, srvFilter ...string) ([]Dependencies, error) {
+	var deps []Dependencies
+	err := runWithContext(ctx, func() error {
+		var err error
+		deps, err = a.Storage.GetDependents(srvFilter...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// Invoke fn and wait for it to return or for the context to be done, whichever
+// happens first.
+func runWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Contexts that can never be canceled do not require a go-routine
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
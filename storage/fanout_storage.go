@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+var (
+	ErrNoBackends = errors.New("fanout: no storage backends specified")
+	ErrQueueFull  = errors.New("fanout: backend queue is full")
+	ErrClosed     = errors.New("fanout: storage is closed")
+)
+
+// A BackendError describes a failure of one of the backends of a FanoutStorage.
+type BackendError struct {
+	// The index of the failed backend. The primary backend has index 0.
+	Backend int
+
+	// The error reported by the backend.
+	Err error
+}
+
+func (e BackendError) Error() string {
+	return fmt.Sprintf("backend %d: %v", e.Backend, e.Err)
+}
+
+// The FanoutError is returned when one or more backends of a FanoutStorage fail.
+type FanoutError []BackendError
+
+func (e FanoutError) Error() string {
+	msgs := make([]string, len(e))
+	for index, backendErr := range e {
+		msgs[index] = backendErr.Error()
+	}
+	return "fanout: " + strings.Join(msgs, "; ")
+}
+
+// A Store request queued for an asynchronous backend.
+type storeRequest struct {
+	rec *tracer.Record
+	ttl time.Duration
+}
+
+// The FanoutStorage writes trace records to multiple storage backends (e.g. while
+// migrating from one backend to another). Queries are served by the primary
+// backend and fall back to the remaining backends (in the order they were
+// specified) if the primary fails.
+//
+// By default, records are written to all backends in parallel and Store waits for
+// all backends to complete. In async mode, Store only waits for the primary backend;
+// records are queued for the remaining backends and written in the background.
+type FanoutStorage struct {
+	backends []tracer.Storage
+
+	// Async mode settings. Each secondary backend has its own queue so a slow
+	// backend does not block the others. The mutex guards the queues and the
+	// closed flag against concurrent Store and Close calls.
+	mutex     sync.RWMutex
+	closed    bool
+	queueSize int
+	queues    []chan storeRequest
+	workers   sync.WaitGroup
+
+	// A callback invoked whenever a backend fails.
+	onError func(backend int, err error)
+}
+
+// Create a new storage that writes to all supplied backends. The first backend is
+// the primary backend that is used for serving queries.
+func NewFanout(primary tracer.Storage, secondaries ...tracer.Storage) *FanoutStorage {
+	return &FanoutStorage{
+		backends: append([]tracer.Storage{primary}, secondaries...),
+	}
+}
+
+// Write to the secondary backends asynchronously. Each secondary backend is assigned
+// a queue that can hold up to queueSize records; if a queue is full, the record is
+// dropped and ErrQueueFull is reported for that backend. This method must be invoked
+// before dialing the storage.
+func (s *FanoutStorage) SetAsync(queueSize int) {
+	s.queueSize = queueSize
+}
+
+// Set a callback to be invoked whenever a backend fails. The callback receives the
+// index of the failed backend (the primary backend has index 0) and the error.
+// It is invoked for failures of both synchronous and asynchronous writes.
+func (s *FanoutStorage) OnError(callback func(backend int, err error)) {
+	s.onError = callback
+}
+
+// Dial all backends. Failures of secondary backends are reported via the OnError
+// callback but do not prevent the storage from being used. Implements the Storage
+// interface.
+func (s *FanoutStorage) Dial() error {
+	if len(s.backends) == 0 || s.backends[0] == nil {
+		return ErrNoBackends
+	}
+
+	var primaryErr error
+	for index, backend := range s.backends {
+		err := backend.Dial()
+		if err == nil {
+			continue
+		}
+		s.reportError(index, err)
+		if index == 0 {
+			primaryErr = err
+		}
+	}
+	if primaryErr != nil {
+		return primaryErr
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = false
+	if s.queueSize > 0 && s.queues == nil {
+		s.queues = make([]chan storeRequest, len(s.backends))
+		for index := 1; index < len(s.backends); index++ {
+			s.queues[index] = make(chan storeRequest, s.queueSize)
+			s.workers.Add(1)
+			go s.worker(index, s.queues[index])
+		}
+	}
+
+	return nil
+}
+
+// Store a trace entry to all backends. In synchronous mode, a FanoutError listing
+// the failed backends is returned if any backend fails. In async mode, only
+// failures of the primary backend are returned. Returns ErrClosed if the storage
+// has been closed. Implements the Storage interface.
+func (s *FanoutStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	if s.queues != nil {
+		for index := 1; index < len(s.backends); index++ {
+			select {
+			case s.queues[index] <- storeRequest{logEntry, ttl}:
+			default:
+				s.reportError(index, ErrQueueFull)
+			}
+		}
+
+		err := s.backends[0].Store(logEntry, ttl)
+		if err != nil {
+			s.reportError(0, err)
+			return FanoutError{{Backend: 0, Err: err}}
+		}
+		return nil
+	}
+
+	errs := make([]error, len(s.backends))
+	var wg sync.WaitGroup
+	wg.Add(len(s.backends))
+	for index, backend := range s.backends {
+		go func(index int, backend tracer.Storage) {
+			defer wg.Done()
+			errs[index] = backend.Store(logEntry, ttl)
+		}(index, backend)
+	}
+	wg.Wait()
+
+	var fanoutErr FanoutError
+	for index, err := range errs {
+		if err != nil {
+			s.reportError(index, err)
+			fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+		}
+	}
+	if fanoutErr != nil {
+		return fanoutErr
+	}
+	return nil
+}
+
+// Fetch a set of time-ordered trace entries with the given trace-id. The trace is
+// fetched from the primary backend. If the primary backend fails or does not
+// contain the trace (e.g. because it was stored before a migration), the
+// remaining backends are queried in order. Implements the Storage interface.
+func (s *FanoutStorage) GetTrace(traceId string) (tracer.Trace, error) {
+	var fanoutErr FanoutError
+	var trace tracer.Trace
+	for index, backend := range s.backends {
+		backendTrace, err := backend.GetTrace(traceId)
+		if err != nil {
+			s.reportError(index, err)
+			fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+			continue
+		}
+		if len(backendTrace) > 0 {
+			return backendTrace, nil
+		}
+		if trace == nil {
+			trace = backendTrace
+		}
+	}
+
+	// If at least one backend responded, report an empty trace
+	if trace != nil {
+		return trace, nil
+	}
+	return nil, fanoutErr
+}
+
+// Fetch up to limit records of the trace with the given trace-id starting at cursor.
+// Pages are fetched using the same fallback rules as GetTrace. Implements the
+// PagedStorage interface.
+func (s *FanoutStorage) GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (tracer.TracePage, error) {
+	var fanoutErr FanoutError
+	var page *tracer.TracePage
+	for index, backend := range s.backends {
+		backendPage, err := tracer.NewPagedStorage(backend).GetTracePage(ctx, traceId, cursor, limit)
+		if err == tracer.ErrInvalidCursor || err == tracer.ErrInvalidPageSize {
+			return tracer.TracePage{}, err
+		}
+		if err != nil {
+			s.reportError(index, err)
+			fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+			continue
+		}
+		if backendPage.Total > 0 {
+			return backendPage, nil
+		}
+		if page == nil {
+			page = &backendPage
+		}
+	}
+
+	// If at least one backend responded, report an empty page
+	if page != nil {
+		return *page, nil
+	}
+	return tracer.TracePage{}, fanoutErr
+}
+
+// Get service dependencies optionally filtered by a set of service names. The
+// dependencies are fetched from the primary backend; if it fails, the remaining
+// backends are queried in order. Implements the Storage interface.
+func (s *FanoutStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
+	var fanoutErr FanoutError
+	for index, backend := range s.backends {
+		deps, err := backend.GetDependencies(srvFilter...)
+		if err == nil {
+			return deps, nil
+		}
+		s.reportError(index, err)
+		fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+	}
+	return nil, fanoutErr
+}
+
+// Get the services that depend on each service optionally filtered by a set of service
+// names. The dependents are fetched from the primary backend; if it fails, the remaining
+// backends are queried in order. Implements the Storage interface.
+func (s *FanoutStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	var fanoutErr FanoutError
+	for index, backend := range s.backends {
+		deps, err := backend.GetDependents(srvFilter...)
+		if err == nil {
+			return deps, nil
+		}
+		s.reportError(index, err)
+		fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+	}
+	return nil, fanoutErr
+}
+
+// Get the summaries of all known services. The summaries are fetched from the
+// primary backend; if it fails, the remaining backends are queried in order.
+// Implements the ServiceCatalog interface.
+func (s *FanoutStorage) GetServices(ctx context.Context) ([]tracer.ServiceSummary, error) {
+	var fanoutErr FanoutError
+	for index, backend := range s.backends {
+		summaries, err := tracer.NewServiceCatalog(backend).GetServices(ctx)
+		if err == nil {
+			return summaries, nil
+		}
+		s.reportError(index, err)
+		fanoutErr = append(fanoutErr, BackendError{Backend: index, Err: err})
+	}
+	return nil, fanoutErr
+}
+
+// Wait for any queued records to be written and shutdown all backends. Any further
+// Store calls fail with ErrClosed.
+func (s *FanoutStorage) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	for index := 1; index < len(s.queues); index++ {
+		close(s.queues[index])
+	}
+	s.queues = nil
+	s.mutex.Unlock()
+	s.workers.Wait()
+
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+}
+
+// Write the records queued for an asynchronous backend.
+func (s *FanoutStorage) worker(index int, queue <-chan storeRequest) {
+	defer s.workers.Done()
+	for req := range queue {
+		err := s.backends[index].Store(req.rec, req.ttl)
+		if err != nil {
+			s.reportError(index, err)
+		}
+	}
+}
+
+func (s *FanoutStorage) reportError(backend int, err error) {
+	if s.onError != nil {
+		s.onError(backend, err)
+	}
+}
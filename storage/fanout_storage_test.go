@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// A storage that fails all operations with the same error.
+type failingStorage struct {
+	err error
+}
+
+func (s *failingStorage) Dial() error {
+	return s.err
+}
+
+func (s *failingStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	return s.err
+}
+
+func (s *failingStorage) GetTrace(traceId string) (tracer.Trace, error) {
+	return nil, s.err
+}
+
+func (s *failingStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
+	return nil, s.err
+}
+
+func (s *failingStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	return nil, s.err
+}
+
+func (s *failingStorage) Close() {
+}
+
+// A memory storage whose Store method blocks until the unblock channel is closed.
+type blockingStorage struct {
+	*memoryStorage
+	unblock chan struct{}
+	stored  int32
+}
+
+func (s *blockingStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	<-s.unblock
+	atomic.AddInt32(&s.stored, 1)
+	return s.memoryStorage.Store(logEntry, ttl)
+}
+
+// Collect the errors reported by a fanout storage.
+type errorLog struct {
+	sync.Mutex
+	errors map[int][]error
+}
+
+func (l *errorLog) add(backend int, err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.errors[backend] = append(l.errors[backend], err)
+}
+
+func (l *errorLog) count(backend int) int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.errors[backend])
+}
+
+func newErrorLog(s *FanoutStorage) *errorLog {
+	log := &errorLog{errors: make(map[int][]error)}
+	s.OnError(log.add)
+	return log
+}
+
+func TestFanoutStorageSync(t *testing.T) {
+	primary, secondary := newMemoryStorage(), newMemoryStorage()
+	failErr := errors.New("connection refused")
+	s := NewFanout(primary, secondary, &failingStorage{failErr})
+	errLog := newErrorLog(s)
+
+	err := s.Dial()
+	if err != nil {
+		t.Fatalf("Expected dial to succeed when only a secondary backend fails; got %v", err)
+	}
+	defer s.Close()
+	if errLog.count(2) != 1 {
+		t.Fatalf("Expected dial failure of backend 2 to be reported")
+	}
+
+	rec := &tracer.Record{Type: tracer.Request, TraceId: "abcd", From: "com.service1", To: "com.service2", Timestamp: time.Now()}
+	err = s.Store(rec, 0)
+	fanoutErr, ok := err.(FanoutError)
+	if !ok || len(fanoutErr) != 1 || fanoutErr[0].Backend != 2 || fanoutErr[0].Err != failErr {
+		t.Fatalf("Expected a FanoutError for backend 2; got %v", err)
+	}
+	if errLog.count(2) != 2 || errLog.count(0) != 0 || errLog.count(1) != 0 {
+		t.Fatalf("Expected only backend 2 failures to be reported; got %v", errLog.errors)
+	}
+
+	for index, backend := range []*memoryStorage{primary, secondary} {
+		trace, _ := backend.GetTrace("abcd")
+		if len(trace) != 1 {
+			t.Fatalf("Expected backend %d to store the record; got %v", index, trace)
+		}
+	}
+}
+
+func TestFanoutStorageReadFallback(t *testing.T) {
+	readErr := errors.New("read failed")
+	secondary := newMemoryStorage()
+	secondary.Store(&tracer.Record{Type: tracer.Request, TraceId: "abcd", From: "com.service1", To: "com.service2"}, 0)
+
+	// Fallback when the primary fails
+	s := NewFanout(&failingStorage{readErr}, secondary)
+	errLog := newErrorLog(s)
+	trace, err := s.GetTrace("abcd")
+	if err != nil || len(trace) != 1 {
+		t.Fatalf("Expected trace to be read from the secondary backend; got %v, %v", trace, err)
+	}
+	deps, err := s.GetDependencies()
+	if err != nil || len(deps) != 1 || deps[0].Service != "com.service1" {
+		t.Fatalf("Expected dependencies to be read from the secondary backend; got %v, %v", deps, err)
+	}
+	if errLog.count(0) != 2 {
+		t.Fatalf("Expected primary read failures to be reported")
+	}
+
+	// Fallback when the primary does not contain the trace
+	s = NewFanout(newMemoryStorage(), secondary)
+	trace, err = s.GetTrace("abcd")
+	if err != nil || len(trace) != 1 {
+		t.Fatalf("Expected trace to be read from the secondary backend; got %v, %v", trace, err)
+	}
+	trace, err = s.GetTrace("unknown")
+	if err != nil || trace == nil || len(trace) != 0 {
+		t.Fatalf("Expected an empty trace for unknown trace ids; got %v, %v", trace, err)
+	}
+
+	// All backends fail
+	s = NewFanout(&failingStorage{readErr}, &failingStorage{readErr})
+	_, err = s.GetTrace("abcd")
+	if fanoutErr, ok := err.(FanoutError); !ok || len(fanoutErr) != 2 {
+		t.Fatalf("Expected a FanoutError for both backends; got %v", err)
+	}
+}
+
+func TestFanoutStorageAsync(t *testing.T) {
+	primary := newMemoryStorage()
+	slow := &blockingStorage{memoryStorage: newMemoryStorage(), unblock: make(chan struct{})}
+	s := NewFanout(primary, slow)
+	s.SetAsync(2)
+	errLog := newErrorLog(s)
+
+	err := s.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	// Store should not wait for the slow backend. The first record is picked up by
+	// the worker and the next two fill the queue.
+	done := make(chan struct{})
+	go func() {
+		for _, traceId := range []string{"1", "2", "3", "4", "5"} {
+			s.Store(&tracer.Record{Type: tracer.Request, TraceId: traceId, From: "a", To: "b"}, 0)
+			<-time.After(10 * time.Millisecond)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected async Store not to block on slow backends")
+	}
+
+	if errLog.count(1) == 0 {
+		t.Fatalf("Expected ErrQueueFull to be reported for the slow backend")
+	}
+	if errLog.errors[1][0] != ErrQueueFull {
+		t.Fatalf("Expected error to be ErrQueueFull; got %v", errLog.errors[1][0])
+	}
+	for _, traceId := range []string{"1", "2", "3", "4", "5"} {
+		if trace, _ := primary.GetTrace(traceId); len(trace) != 1 {
+			t.Fatalf("Expected primary to store trace %s", traceId)
+		}
+	}
+
+	// Close should wait for queued records to be written
+	close(slow.unblock)
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Close to return after queued records are written")
+	}
+	if stored := atomic.LoadInt32(&slow.stored); stored != 3 {
+		t.Fatalf("Expected the 3 queued records to be written to the slow backend; got %d", stored)
+	}
+}
+
+func TestFanoutStorageConcurrentStoreAndClose(t *testing.T) {
+	s := NewFanout(newMemoryStorage(), newMemoryStorage())
+	s.SetAsync(10)
+
+	err := s.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := 0; index < 100; index++ {
+				err := s.Store(&tracer.Record{Type: tracer.Request, TraceId: "1", From: "a", To: "b"}, 0)
+				if err != nil && err != ErrClosed {
+					t.Errorf("Unexpected Store error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	s.Close()
+	wg.Wait()
+
+	err = s.Store(&tracer.Record{Type: tracer.Request, TraceId: "1", From: "a", To: "b"}, 0)
+	if err != ErrClosed {
+		t.Fatalf("Expected Store after Close to return %v; got %v", ErrClosed, err)
+	}
+}
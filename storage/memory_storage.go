@@ -3,6 +3,8 @@ package storage
 import (
 	"time"
 
+	"golang.org/x/net/context"
+
 	"sort"
 
 	"sync"
@@ -15,21 +17,46 @@ var Memory *memoryStorage
 
 // Initialize the service using default values
 func init() {
-	Memory = &memoryStorage{
-		traces:      make(map[string]tracer.Trace),
-		services:    make(map[string]string),
-		serviceDeps: make(map[string]*tracer.Dependencies),
+	Memory = newMemoryStorage()
+}
+
+// Create a new memory storage instance.
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		traces:            make(map[string]tracer.Trace),
+		services:          make(map[string]string),
+		serviceDeps:       make(map[string]*tracer.Dependencies),
+		serviceDependents: make(map[string]*tracer.Dependencies),
+		stats:             make(map[string]*serviceStats),
 	}
 }
 
+// The activity of a service.
+type serviceStats struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	hosts     map[string]struct{}
+	calls     int64
+	errors    int64
+
+	// A ring buffer with the durations of the most recent calls.
+	latencies []time.Duration
+	next      int
+}
+
 // This storage backend stores data in memory. It is meant to be used for running tests.
 // The backend does not support TTL on keys.
 type memoryStorage struct {
 	sync.Mutex
-	traces      map[string]tracer.Trace
-	services    map[string]string
-	serviceDeps map[string]*tracer.Dependencies
-	afterStore  func()
+	traces            map[string]tracer.Trace
+	services          map[string]string
+	serviceDeps       map[string]*tracer.Dependencies
+	serviceDependents map[string]*tracer.Dependencies
+	stats             map[string]*serviceStats
+	afterStore        func()
+
+	// The maximum number of records per trace. A value of 0 indicates no limit.
+	maxRecords int
 }
 
 // Dial the storage.
@@ -42,51 +69,150 @@ func (s *memoryStorage) AfterStore(callback func()) {
 	s.afterStore = callback
 }
 
+// Set the maximum number of records that are stored for each trace. Once a trace
+// reaches this limit, a truncation marker is appended to it and any further records
+// are discarded. A value of 0 (the default) disables the limit.
+func (s *memoryStorage) SetMaxTraceRecords(maxRecords int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxRecords = maxRecords
+}
+
 // Store a trace entry and set a TTL on it. If the ttl is 0 then the
 // trace record will never expire. Implements the Storage interface.
 func (s *memoryStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
 	s.Lock()
 	defer s.Unlock()
 
-	_, exists := s.traces[logEntry.TraceId]
+	traceLog, exists := s.traces[logEntry.TraceId]
 	if !exists {
-		s.traces[logEntry.TraceId] = make(tracer.Trace, 0)
+		traceLog = make(tracer.Trace, 0)
 	}
-	s.traces[logEntry.TraceId] = append(s.traces[logEntry.TraceId], *logEntry)
+	switch {
+	case s.maxRecords <= 0 || len(traceLog) < s.maxRecords:
+		traceLog = append(traceLog, *logEntry)
+	case len(traceLog) == s.maxRecords:
+		traceLog = append(traceLog, tracer.NewTruncationMarker(logEntry.TraceId, s.maxRecords))
+	}
+	s.traces[logEntry.TraceId] = traceLog
 
-	s.services[logEntry.From] = logEntry.From
-	if logEntry.Type == tracer.Request {
-		_, exists = s.serviceDeps[logEntry.From]
-		if !exists {
-			s.serviceDeps[logEntry.From] = &tracer.Dependencies{
-				Service:      logEntry.From,
-				Dependencies: make([]string, 0),
-			}
-		}
-		// Append dependency if new
-		exists = false
-		for _, srvName := range s.serviceDeps[logEntry.From].Dependencies {
-			if srvName == logEntry.To {
-				exists = true
-				break
-			}
-		}
-		if !exists {
-			s.serviceDeps[logEntry.From].Dependencies = append(s.serviceDeps[logEntry.From].Dependencies, logEntry.To)
+	// Client records duplicate the calls traced by the server and their origin
+	// may be unknown so they are not indexed. Neither are records without an
+	// origin (e.g. the records of root spans)
+	if logEntry.Kind != tracer.Client && logEntry.From != "" {
+		s.services[logEntry.From] = logEntry.From
+		if logEntry.Type == tracer.Request {
+			addEdge(s.serviceDeps, logEntry.From, logEntry.To)
+			addEdge(s.serviceDependents, logEntry.To, logEntry.From)
 		}
 	}
+	s.updateStats(logEntry)
 	if s.afterStore != nil {
 		s.afterStore()
 	}
 	return nil
 }
 
+// Update the activity of the service that served a record.
+func (s *memoryStorage) updateStats(logEntry *tracer.Record) {
+	service := logEntry.ServedBy()
+	if service == "" {
+		return
+	}
+
+	stats, exists := s.stats[service]
+	if !exists {
+		stats = &serviceStats{
+			firstSeen: logEntry.Timestamp,
+			lastSeen:  logEntry.Timestamp,
+			hosts:     make(map[string]struct{}),
+			latencies: make([]time.Duration, 0),
+		}
+		s.stats[service] = stats
+	}
+	if logEntry.Timestamp.Before(stats.firstSeen) {
+		stats.firstSeen = logEntry.Timestamp
+	}
+	if logEntry.Timestamp.After(stats.lastSeen) {
+		stats.lastSeen = logEntry.Timestamp
+	}
+	if logEntry.Host != "" {
+		stats.hosts[logEntry.Host] = struct{}{}
+	}
+
+	if logEntry.Type != tracer.Response {
+		return
+	}
+	stats.calls++
+	if logEntry.ErrorCategory() != "" {
+		stats.errors++
+	}
+	latency := time.Duration(logEntry.Duration)
+	if len(stats.latencies) < tracer.LatencySampleSize {
+		stats.latencies = append(stats.latencies, latency)
+	} else {
+		stats.latencies[stats.next] = latency
+	}
+	stats.next = (stats.next + 1) % tracer.LatencySampleSize
+}
+
+// Get the summaries of all known services sorted by service name. Implements the
+// ServiceCatalog interface.
+func (s *memoryStorage) GetServices(ctx context.Context) ([]tracer.ServiceSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deps, err := s.GetDependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	summaries := make(map[string]*tracer.ServiceSummary)
+	for service, stats := range s.stats {
+		summary := &tracer.ServiceSummary{
+			Service:   service,
+			FirstSeen: stats.firstSeen,
+			LastSeen:  stats.lastSeen,
+			Hosts:     make([]string, 0, len(stats.hosts)),
+		}
+		for host := range stats.hosts {
+			summary.Hosts = append(summary.Hosts, host)
+		}
+		summary.SetCalls(stats.calls, stats.errors)
+		summary.SetLatencies(stats.latencies)
+		summaries[service] = summary
+	}
+
+	return tracer.SummarizeServices(summaries, deps), nil
+}
+
 // Get service dependencies optionally filtered by a set of service names. If no filters are
 // specified then the response will include all services currently known to the storage.
 func (s *memoryStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	return s.lookupEdges(s.serviceDeps, srvFilter), nil
+}
+
+// Get the services that depend on each service optionally filtered by a set of service
+// names. If no filters are specified then the response will include all services
+// currently known to the storage. Implements the Storage interface.
+func (s *memoryStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lookupEdges(s.serviceDependents, srvFilter), nil
+}
+
+// Lookup the edges of a set of services in a dependency index. If no filters are specified
+// then all services currently known to the storage are looked up.
+func (s *memoryStorage) lookupEdges(index map[string]*tracer.Dependencies, srvFilter []string) []tracer.Dependencies {
 	if len(srvFilter) == 0 {
 		srvFilter = make([]string, 0)
 		for _, srvName := range s.services {
@@ -99,19 +225,35 @@ func (s *memoryStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependenc
 
 	replyCount := len(srvFilter)
 	serviceDeps := make([]tracer.Dependencies, replyCount)
-	for index, srvName := range srvFilter {
-		dep, exists := s.serviceDeps[srvName]
+	for i, srvName := range srvFilter {
+		dep, exists := index[srvName]
 		if !exists {
 			dep = &tracer.Dependencies{
 				Service:      srvName,
 				Dependencies: make([]string, 0),
 			}
 		}
-		serviceDeps[index] = *dep
+		serviceDeps[i] = *dep
 	}
 
-	return serviceDeps, nil
+	return serviceDeps
+}
 
+// Add an edge from service to dep to a dependency index unless it already exists.
+func addEdge(index map[string]*tracer.Dependencies, service, dep string) {
+	_, exists := index[service]
+	if !exists {
+		index[service] = &tracer.Dependencies{
+			Service:      service,
+			Dependencies: make([]string, 0),
+		}
+	}
+	for _, srvName := range index[service].Dependencies {
+		if srvName == dep {
+			return
+		}
+	}
+	index[service].Dependencies = append(index[service].Dependencies, dep)
 }
 
 // Fetch a set of time-ordered trace entries with the given trace-id.
@@ -129,9 +271,33 @@ func (s *memoryStorage) GetTrace(traceId string) (tracer.Trace, error) {
 	return traceLog, nil
 }
 
+// Fetch up to limit time-ordered records of the trace with the given trace-id
+// starting at cursor. Implements the PagedStorage interface.
+func (s *memoryStorage) GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (tracer.TracePage, error) {
+	if err := ctx.Err(); err != nil {
+		return tracer.TracePage{}, err
+	}
+	offset, err := tracer.ParseCursor(cursor, limit)
+	if err != nil {
+		return tracer.TracePage{}, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	traceLog := s.traces[traceId]
+	sort.Sort(traceLog)
+
+	page := tracer.NewTracePage(traceLog, offset, limit)
+	page.Records = append(make(tracer.Trace, 0, len(page.Records)), page.Records...)
+	return page, nil
+}
+
 // Shutdown the storage.
 func (s *memoryStorage) Close() {
 	s.traces = make(map[string]tracer.Trace)
 	s.services = make(map[string]string)
 	s.serviceDeps = make(map[string]*tracer.Dependencies)
+	s.serviceDependents = make(map[string]*tracer.Dependencies)
+	s.stats = make(map[string]*serviceStats)
 }
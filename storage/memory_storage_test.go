@@ -4,6 +4,8 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/achilleasa/usrv-tracer"
 
 	"reflect"
@@ -11,6 +13,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"sort"
+	"strconv"
 )
 
 func TestMemoryStorage(t *testing.T) {
@@ -123,3 +126,221 @@ func TestMemoryStorage(t *testing.T) {
 		t.Fatalf("AfterStore callback never invoked")
 	}
 }
+
+// Check that a storage engine satisfies the PagedStorage contract: fetching all
+// pages yields every trace record exactly once and the records of each page are
+// sorted by timestamp. The records are stored out of timestamp order.
+func testPagedStorageContract(t *testing.T, storage interface {
+	tracer.Storage
+	tracer.PagedStorage
+}, traceId string) {
+	now := time.Now()
+	offsets := []int{3, 0, 6, 1, 5, 2, 4}
+	for index, offset := range offsets {
+		rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now.Add(time.Duration(offset) * time.Second), TraceId: traceId, CorrelationId: strconv.Itoa(offset)}
+		err := storage.Store(&rec, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	cursor := ""
+	seen := make(map[string]bool)
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("Expected trace to be fetched in 3 pages")
+		}
+		page, err := storage.GetTracePage(context.Background(), traceId, cursor, 3)
+		if err != nil {
+			t.Fatalf("Error retrieving trace page: %v", err)
+		}
+		if page.Total != len(offsets) {
+			t.Fatalf("Expected page total to be %d; got %d", len(offsets), page.Total)
+		}
+		for index, rec := range page.Records {
+			if seen[rec.CorrelationId] {
+				t.Fatalf("Record %s was returned more than once", rec.CorrelationId)
+			}
+			seen[rec.CorrelationId] = true
+			if index > 0 && rec.Timestamp.Before(page.Records[index-1].Timestamp) {
+				t.Fatalf("Expected records of page %d to be sorted by timestamp", pages)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != len(offsets) {
+		t.Fatalf("Expected to fetch %d records; got %d", len(offsets), len(seen))
+	}
+}
+
+func TestMemoryStoragePagingContract(t *testing.T) {
+	storage := newMemoryStorage()
+	defer storage.Close()
+
+	testPagedStorageContract(t, storage, "abcd-1234-1234-1234")
+}
+
+func TestMemoryStoragePaging(t *testing.T) {
+	storage := newMemoryStorage()
+	defer storage.Close()
+
+	now := time.Now()
+	traceId := "abcd-1234-1234-1234"
+	for index := 0; index < 5; index++ {
+		rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now.Add(time.Duration(index) * time.Second), TraceId: traceId}
+		storage.Store(&rec, 0)
+	}
+
+	ctx := context.Background()
+	cursor := ""
+	loaded := make(tracer.Trace, 0)
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("Expected trace to be fetched in 3 pages")
+		}
+		page, err := storage.GetTracePage(ctx, traceId, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 5 {
+			t.Fatalf("Expected page total to be 5; got %d", page.Total)
+		}
+		loaded = append(loaded, page.Records...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(loaded) != 5 {
+		t.Fatalf("Expected to load 5 records; got %d", len(loaded))
+	}
+	for index, rec := range loaded {
+		if !rec.Timestamp.Equal(now.Add(time.Duration(index) * time.Second)) {
+			t.Fatalf("Expected record %d to be in timestamp order", index)
+		}
+	}
+
+	_, err := storage.GetTracePage(ctx, traceId, "bogus", 2)
+	if err != tracer.ErrInvalidCursor {
+		t.Fatalf("Expected to get ErrInvalidCursor; got %v", err)
+	}
+}
+
+func TestMemoryStorageMaxTraceRecords(t *testing.T) {
+	storage := newMemoryStorage()
+	defer storage.Close()
+	storage.SetMaxTraceRecords(3)
+
+	traceId := "abcd-1234-1234-1234"
+	for index := 0; index < 10; index++ {
+		rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: time.Now(), TraceId: traceId}
+		storage.Store(&rec, 0)
+	}
+
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traceLog) != 4 {
+		t.Fatalf("Expected trace to contain 3 records and a truncation marker; got %d records", len(traceLog))
+	}
+	if !traceLog.IsTruncated() {
+		t.Fatalf("Expected trace to be truncated")
+	}
+	marker := traceLog[len(traceLog)-1]
+	if marker.Type != tracer.Truncated || marker.Tags[tracer.MaxRecordsTag] != "3" {
+		t.Fatalf("Expected last record to be a truncation marker; got %v", marker)
+	}
+}
+
+func TestMemoryStorageServices(t *testing.T) {
+	storage := newMemoryStorage()
+	defer storage.Close()
+
+	now := time.Now()
+	records := []tracer.Record{
+		{Type: tracer.Request, From: "com.service1", To: "com.service2", Host: "host-b", Timestamp: now},
+		{Type: tracer.Response, From: "com.service2", To: "com.service1", Host: "host-b", Timestamp: now.Add(time.Second), Duration: int64(10 * time.Millisecond)},
+		{Type: tracer.Request, From: "com.service1", To: "com.service2", Host: "host-a", Timestamp: now.Add(2 * time.Second)},
+		{Type: tracer.Response, From: "com.service2", To: "com.service1", Host: "host-a", Timestamp: now.Add(3 * time.Second), Duration: int64(30 * time.Millisecond), Error: "oops"},
+		// Client records should not be included in the stats
+		{Type: tracer.Response, Kind: tracer.Client, From: "com.service2", To: "com.service1", Host: "host-c", Timestamp: now.Add(4 * time.Second)},
+		// Client records should not be indexed; the caller of this one is unknown
+		{Type: tracer.Request, Kind: tracer.Client, From: "", To: "com.service3", Timestamp: now.Add(5 * time.Second)},
+	}
+	for _, rec := range records {
+		storage.Store(&rec, 0)
+	}
+
+	services, err := storage.GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services; got %d", len(services))
+	}
+
+	srv := services[1]
+	if srv.Service != "com.service2" {
+		t.Fatalf("Expected services to be sorted by name; got %s", srv.Service)
+	}
+	if !srv.FirstSeen.Equal(now) || !srv.LastSeen.Equal(now.Add(3*time.Second)) {
+		t.Fatalf("Unexpected first/last seen timestamps: %v, %v", srv.FirstSeen, srv.LastSeen)
+	}
+	if !reflect.DeepEqual(srv.Hosts, []string{"host-a", "host-b"}) {
+		t.Fatalf("Unexpected hosts: %v", srv.Hosts)
+	}
+	if srv.Calls != 2 || srv.Errors != 1 || srv.ErrorRate != 0.5 {
+		t.Fatalf("Unexpected call stats: calls %d, errors %d, error rate %f", srv.Calls, srv.Errors, srv.ErrorRate)
+	}
+	if srv.P50 != 10*time.Millisecond || srv.P99 != 30*time.Millisecond {
+		t.Fatalf("Unexpected latency percentiles: p50 %v, p99 %v", srv.P50, srv.P99)
+	}
+	if !reflect.DeepEqual(srv.Callers, []string{"com.service1"}) || len(srv.Dependencies) != 0 {
+		t.Fatalf("Unexpected callers/dependencies: %v, %v", srv.Callers, srv.Dependencies)
+	}
+	if !reflect.DeepEqual(services[0].Dependencies, []string{"com.service2"}) {
+		t.Fatalf("Unexpected dependencies for com.service1: %v", services[0].Dependencies)
+	}
+}
+
+func TestMemoryStorageDependents(t *testing.T) {
+	storage := newMemoryStorage()
+	defer storage.Close()
+
+	records := []tracer.Record{
+		{Type: tracer.Request, From: "com.service1", To: "com.service3"},
+		{Type: tracer.Request, From: "com.service2", To: "com.service3"},
+		{Type: tracer.Request, From: "com.service2", To: "com.service3"},
+		{Type: tracer.Response, From: "com.service3", To: "com.service2"},
+	}
+	for _, rec := range records {
+		storage.Store(&rec, 0)
+	}
+
+	dependents, err := storage.GetDependents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expDependents := []tracer.Dependencies{
+		{Service: "com.service1", Dependencies: []string{}},
+		{Service: "com.service2", Dependencies: []string{}},
+		{Service: "com.service3", Dependencies: []string{"com.service1", "com.service2"}},
+	}
+	if !reflect.DeepEqual(dependents, expDependents) {
+		t.Fatalf("Expected dependents to be %v; got %v", expDependents, dependents)
+	}
+
+	dependents, err = storage.GetDependents("com.service3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dependents, expDependents[2:]) {
+		t.Fatalf("Expected filtered dependents to be %v; got %v", expDependents[2:], dependents)
+	}
+}
@@ -3,25 +3,110 @@ package storage
 import (
 	"time"
 
-	"encoding/json"
 	"fmt"
 
 	"sort"
 
+	"net"
+
+	"strconv"
+
+	"sync"
+
+	"strings"
+
+	"golang.org/x/net/context"
+
 	redisAdapter "github.com/achilleasa/usrv-service-adapters/service/redis"
 	"github.com/achilleasa/usrv-tracer"
 	"github.com/garyburd/redigo/redis"
 )
 
+// The keys of the sets that hold the dependencies and the dependents of each service.
+const (
+	depsKeyFormat       = "tracer.%s.deps"
+	dependentsKeyFormat = "tracer.%s.dependents"
+)
+
 // Redis is a singleton instance of a redis-backed storage service
 var Redis *redisStorage = &redisStorage{
 	redisSrv: redisAdapter.Adapter,
+	codec:    tracer.JSONCodec,
 }
 
 // This storage backend is built on top of Redis. Internally it uses
 // a connection pool to provide thread-safe access.
 type redisStorage struct {
 	redisSrv *redisAdapter.Redis
+
+	// The codec used for encoding new trace entries.
+	codec tracer.Codec
+
+	// If set, completed traces are compacted into a single compressed blob.
+	compaction bool
+
+	// The maximum number of records per trace. A value of 0 indicates no limit.
+	maxRecords int
+
+	// The redis endpoint used for dialing dedicated connections for context-aware
+	// operations. If empty, context-aware operations use pooled connections.
+	directEndpoint string
+	directPassword string
+	directDb       int
+
+	// Idle dedicated connections that can be reused by context-aware operations.
+	directMutex sync.Mutex
+	directIdle  []*directConn
+}
+
+// The maximum number of idle dedicated connections kept by the storage.
+const maxIdleDirectConns = 8
+
+// A dedicated redis connection. The underlying network connection is kept so that
+// its deadline can be set to the deadline of each operation.
+type directConn struct {
+	netConn net.Conn
+	conn    redis.Conn
+}
+
+// Set the codec used for encoding new trace entries. Existing entries are always
+// decoded using the codec that was used to encode them so the codec can be
+// switched without migrating any stored data.
+func (r *redisStorage) SetCodec(codec tracer.Codec) {
+	r.codec = codec
+}
+
+// Enable or disable trace compaction. When enabled, the storage keeps track of
+// pending requests for each trace. Once the response to the root request has
+// been stored, all trace entries are packed into a single compressed blob. Packed
+// and unpacked traces can be read back transparently via GetTrace.
+func (r *redisStorage) SetCompaction(enabled bool) {
+	r.compaction = enabled
+}
+
+// Set the maximum number of records that are stored for each trace. Once a trace
+// reaches this limit, a truncation marker is appended to it and any further records
+// are discarded. Service and dependency information is still updated for discarded
+// records. A value of 0 (the default) disables the limit.
+func (r *redisStorage) SetMaxTraceRecords(maxRecords int) {
+	r.maxRecords = maxRecords
+}
+
+// Set the redis endpoint used by the context-aware (*Context) methods. The pooled
+// connections of the redis service adapter do not support per-operation timeouts.
+// When an endpoint is set, operations whose context has a deadline or can be
+// canceled use a dedicated connection whose read and write deadlines are set to
+// the context deadline; the connection is closed as soon as the context is done,
+// unblocking any pending reads or writes. Connections are reused by subsequent
+// operations unless an operation fails or its context is done.
+//
+// If no endpoint is set, context-aware operations check the context before using a
+// pooled connection but cannot abort a pending operation.
+func (r *redisStorage) SetDirectEndpoint(endpoint, password string, db int) {
+	r.closeIdleDirectConns()
+	r.directEndpoint = endpoint
+	r.directPassword = password
+	r.directDb = db
 }
 
 // Dial the storage
@@ -29,75 +114,240 @@ func (r *redisStorage) Dial() error {
 	return r.redisSrv.Dial()
 }
 
+// Dial the storage. Implements the ContextStorage interface.
+func (r *redisStorage) DialContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.redisSrv.Dial()
+}
+
 // Store a trace entry and set a TTL on it. If the ttl is 0 then the
 // trace record will never expire. Implements the Storage interface.
 func (r *redisStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
-	json, err := json.Marshal(logEntry)
+	return r.StoreContext(context.Background(), logEntry, ttl)
+}
+
+// Store a trace entry and set a TTL on it. If the ttl is 0 then the trace record will
+// never expire. Implements the ContextStorage interface.
+func (r *redisStorage) StoreContext(ctx context.Context, logEntry *tracer.Record, ttl time.Duration) error {
+	data, err := r.codec.Marshal(logEntry)
 	if err != nil {
 		return err
 	}
 
-	conn, err := r.redisSrv.GetConnection()
-	if err != nil {
-		return err
+	return r.withConnection(ctx, func(conn redis.Conn) error {
+		return r.store(conn, logEntry, data, ttl)
+	})
+}
+
+// Store an encoded trace entry using the supplied connection.
+func (r *redisStorage) store(conn redis.Conn, logEntry *tracer.Record, data []byte, ttl time.Duration) error {
+	// When a record cap is set, keep track of the number of records stored for each
+	// trace. The record that exceeds the cap is replaced by a truncation marker and
+	// any further records are discarded.
+	countKey := fmt.Sprintf("tracer.%s.count", logEntry.TraceId)
+	if r.maxRecords > 0 {
+		count, err := redis.Int(conn.Do("INCR", countKey))
+		if err != nil {
+			return err
+		}
+		switch {
+		case count == r.maxRecords+1:
+			marker := tracer.NewTruncationMarker(logEntry.TraceId, r.maxRecords)
+			data, err = r.codec.Marshal(&marker)
+			if err != nil {
+				return err
+			}
+		case count > r.maxRecords+1:
+			data = nil
+		}
 	}
-	defer conn.Close()
 
 	conn.Send("MULTI")
 
 	// Append log entry to a list that shares the same traceId
 	// and set a TTL
 	traceKey := fmt.Sprintf("tracer.%s", logEntry.TraceId)
-	conn.Send("LPUSH", traceKey, json)
+	if data != nil {
+		conn.Send("LPUSH", traceKey, data)
+	}
 	if ttl > time.Second {
 		conn.Send("EXPIRE", traceKey, ttl.Seconds())
+		if r.maxRecords > 0 {
+			conn.Send("EXPIRE", countKey, ttl.Seconds())
+		}
+	}
+
+	// Add logEntry.From to the set of known services. Client records duplicate the
+	// calls traced by the server and their origin may be unknown so they are not indexed.
+	// Neither are records without an origin (e.g. the records of root spans)
+	if logEntry.Kind != tracer.Client && logEntry.From != "" {
+		conn.Send("SADD", "tracer.services", logEntry.From)
+
+		// If this is an outgoing request, add the destination to the dependency set
+		// for the origin and the origin to the dependent set of the destination
+		if logEntry.Type == tracer.Request {
+			conn.Send("SADD", fmt.Sprintf(depsKeyFormat, logEntry.From), logEntry.To)
+			conn.Send("SADD", fmt.Sprintf(dependentsKeyFormat, logEntry.To), logEntry.From)
+		}
 	}
 
-	// Add logEntry.From to the set of known services
-	conn.Send("SADD", "tracer.services", logEntry.From)
+	// Update the activity of the service that served the record
+	if service := logEntry.ServedBy(); service != "" {
+		statsKey := fmt.Sprintf("tracer.%s.stats", service)
+		ts := logEntry.Timestamp.UnixNano()
+		conn.Send("HSETNX", statsKey, "first_seen", ts)
+		conn.Send("HSET", statsKey, "last_seen", ts)
+		if logEntry.Host != "" {
+			conn.Send("SADD", fmt.Sprintf("tracer.%s.hosts", service), logEntry.Host)
+		}
+		if logEntry.Type == tracer.Response {
+			latencyKey := fmt.Sprintf("tracer.%s.latency", service)
+			conn.Send("HINCRBY", statsKey, "calls", 1)
+			if logEntry.ErrorCategory() != "" {
+				conn.Send("HINCRBY", statsKey, "errors", 1)
+			}
+			conn.Send("LPUSH", latencyKey, logEntry.Duration)
+			conn.Send("LTRIM", latencyKey, 0, tracer.LatencySampleSize-1)
+		}
+	}
 
-	// If this is an outgoing request, add the destination to the dependency set
-	// for the origin
-	if logEntry.Type == tracer.Request {
-		conn.Send("SADD", fmt.Sprintf("tracer.%s.deps", logEntry.From), logEntry.To)
+	// When compaction is enabled keep track of the number of pending requests.
+	// INCR/DECR create the counter if it does not exist so its TTL must be set after
+	// the counter update. These must be the last commands in the pipeline.
+	pendingKey := fmt.Sprintf("tracer.%s.pending", logEntry.TraceId)
+	trackPending := r.compaction && (logEntry.Type == tracer.Request || logEntry.Type == tracer.Response)
+	pendingReply := 1
+	if trackPending {
+		if logEntry.Type == tracer.Request {
+			conn.Send("INCR", pendingKey)
+		} else {
+			conn.Send("DECR", pendingKey)
+		}
+		if ttl > time.Second {
+			conn.Send("EXPIRE", pendingKey, ttl.Seconds())
+			pendingReply = 2
+		}
 	}
 
 	// Exec pipeline
-	_, err = conn.Do("EXEC")
-	return err
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil || !trackPending || logEntry.Type != tracer.Response {
+		return err
+	}
+
+	// If there are no more pending requests, check whether the root request has
+	// completed and compact the trace
+	pending, err := redis.Int(replies[len(replies)-pendingReply], nil)
+	if err != nil || pending > 0 {
+		return err
+	}
+	return r.compactTrace(conn, logEntry.TraceId, ttl)
 }
 
-// Fetch a set of time-ordered trace entries with the given trace-id.
-func (r *redisStorage) GetTrace(traceId string) (tracer.Trace, error) {
+// Pack the trace entries into a single compressed blob if the trace root has completed.
+func (r *redisStorage) compactTrace(conn redis.Conn, traceId string, ttl time.Duration) error {
+	traceKey := fmt.Sprintf("tracer.%s", traceId)
+	packedKey := fmt.Sprintf("tracer.%s.packed", traceId)
 
-	conn, err := r.redisSrv.GetConnection()
+	// Abort compaction if another process updates the packed trace while we compact it.
+	_, err := conn.Do("WATCH", packedKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer conn.Close()
 
-	// Get the number of records
-	traceKey := fmt.Sprintf("tracer.%s", traceId)
-	len, err := redis.Int(conn.Do("LLEN", traceKey))
+	traceLog, listLen, err := r.loadTrace(conn, traceId)
+	if err != nil || listLen == 0 || !traceLog.Completeness().RootFinished {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	packed, err := tracer.PackTrace(traceLog)
 	if err != nil {
-		return nil, err
+		conn.Do("UNWATCH")
+		return err
 	}
 
-	// Fetch all records
-	rawRows, err := redis.Strings(conn.Do("LRANGE", traceKey, 0, len))
+	conn.Send("MULTI")
+	if ttl > time.Second {
+		conn.Send("SET", packedKey, packed, "EX", int(ttl.Seconds()))
+	} else {
+		conn.Send("SET", packedKey, packed)
+	}
+
+	// Entries that were appended to the list while we were compacting the trace
+	// are pushed to the head of the list; trim the entries we just packed.
+	conn.Send("LTRIM", traceKey, 0, -(listLen + 1))
+	conn.Send("DEL", fmt.Sprintf("tracer.%s.pending", traceId))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Load both packed and unpacked trace entries. Returns the unsorted trace and the
+// number of unpacked entries that were loaded.
+func (r *redisStorage) loadTrace(conn redis.Conn, traceId string) (tracer.Trace, int, error) {
+	traceKey := fmt.Sprintf("tracer.%s", traceId)
+	packedKey := fmt.Sprintf("tracer.%s.packed", traceId)
+
+	// Get the number of records
+	count, err := redis.Int(conn.Do("LLEN", traceKey))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	// Fetch all records. New records are pushed to the head of the list so we
+	// fetch the records from the tail to get a consistent view.
+	rawRows := make([]string, 0)
+	if count > 0 {
+		rawRows, err = redis.Strings(conn.Do("LRANGE", traceKey, -count, -1))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Fetch packed records
+	traceLog := make(tracer.Trace, 0, count)
+	packed, err := redis.Bytes(conn.Do("GET", packedKey))
+	if err != nil && err != redis.ErrNil {
+		return nil, 0, err
+	}
+	if packed != nil {
+		traceLog, err = tracer.UnpackTrace(packed)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 
 	// Unmarshal raw data
-	traceLog := make(tracer.Trace, len)
-	for index, rawRow := range rawRows {
+	for _, rawRow := range rawRows {
 		entry := tracer.Record{}
-		err = json.Unmarshal([]byte(rawRow), &entry)
+		err = tracer.UnmarshalRecord([]byte(rawRow), &entry)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		traceLog[index] = entry
+		traceLog = append(traceLog, entry)
+	}
+
+	return traceLog, count, nil
+}
+
+// Fetch a set of time-ordered trace entries with the given trace-id.
+func (r *redisStorage) GetTrace(traceId string) (tracer.Trace, error) {
+	return r.GetTraceContext(context.Background(), traceId)
+}
+
+// Fetch a set of time-ordered trace entries with the given trace-id. Implements
+// the ContextStorage interface.
+func (r *redisStorage) GetTraceContext(ctx context.Context, traceId string) (tracer.Trace, error) {
+	var traceLog tracer.Trace
+	err := r.withConnection(ctx, func(conn redis.Conn) error {
+		var err error
+		traceLog, _, err = r.loadTrace(conn, traceId)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Sort the trace so entries appear in insertion order
@@ -106,15 +356,222 @@ func (r *redisStorage) GetTrace(traceId string) (tracer.Trace, error) {
 	return traceLog, nil
 }
 
+// Fetch up to limit records of the trace with the given trace-id starting at cursor.
+// Records are paged in the order they were stored; packed records (see SetCompaction)
+// precede any unpacked records. The records of each page are sorted by timestamp.
+// Compacting a trace changes the position of its records; cursors issued before the
+// trace was compacted are rejected with ErrInvalidCursor. Implements the PagedStorage
+// interface.
+func (r *redisStorage) GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (tracer.TracePage, error) {
+	pos, err := parsePageCursor(cursor, limit)
+	if err != nil {
+		return tracer.TracePage{}, err
+	}
+
+	var page tracer.TracePage
+	err = r.withConnection(ctx, func(conn redis.Conn) error {
+		var err error
+		page, err = r.loadTracePage(conn, traceId, pos, limit)
+		return err
+	})
+	if err != nil {
+		return tracer.TracePage{}, err
+	}
+	return page, nil
+}
+
+// The position of a trace page. Besides the record offset, the position holds the
+// number of packed records and unpacked records at the time the position was
+// issued. New records are appended to the unpacked records without affecting the
+// offsets of existing records, but compaction moves unpacked records to the packed
+// records.
+type pagePosition struct {
+	offset    int
+	packedLen int
+	listLen   int
+}
+
+// Parse a cursor returned by GetTracePage into a page position and validate the page
+// size. An empty cursor selects the first page.
+func parsePageCursor(cursor string, limit int) (pagePosition, error) {
+	if cursor == "" {
+		_, err := tracer.ParseCursor(cursor, limit)
+		return pagePosition{}, err
+	}
+
+	parts := strings.Split(cursor, ":")
+	if len(parts) != 3 {
+		return pagePosition{}, tracer.ErrInvalidCursor
+	}
+	offset, err := tracer.ParseCursor(parts[0], limit)
+	if err != nil {
+		return pagePosition{}, err
+	}
+	packedLen, err := strconv.Atoi(parts[1])
+	if err != nil || packedLen < 0 {
+		return pagePosition{}, tracer.ErrInvalidCursor
+	}
+	listLen, err := strconv.Atoi(parts[2])
+	if err != nil || listLen < 0 {
+		return pagePosition{}, tracer.ErrInvalidCursor
+	}
+	return pagePosition{offset: offset, packedLen: packedLen, listLen: listLen}, nil
+}
+
+func (p pagePosition) String() string {
+	return fmt.Sprintf("%d:%d:%d", p.offset, p.packedLen, p.listLen)
+}
+
+// Load a page of trace entries starting at the supplied position. Returns
+// ErrInvalidCursor if the trace was compacted after the position was issued.
+func (r *redisStorage) loadTracePage(conn redis.Conn, traceId string, pos pagePosition, limit int) (tracer.TracePage, error) {
+	traceKey := fmt.Sprintf("tracer.%s", traceId)
+	packedKey := fmt.Sprintf("tracer.%s.packed", traceId)
+
+	count, err := redis.Int(conn.Do("LLEN", traceKey))
+	if err != nil {
+		return tracer.TracePage{}, err
+	}
+
+	packedLog := make(tracer.Trace, 0)
+	packed, err := redis.Bytes(conn.Do("GET", packedKey))
+	if err != nil && err != redis.ErrNil {
+		return tracer.TracePage{}, err
+	}
+	if packed != nil {
+		packedLog, err = tracer.UnpackTrace(packed)
+		if err != nil {
+			return tracer.TracePage{}, err
+		}
+		sort.Sort(packedLog)
+	}
+
+	// Offsets are only valid while the packed records remain the same and the
+	// unpacked records are only appended to
+	packedLen := len(packedLog)
+	if pos.offset > 0 && (pos.packedLen != packedLen || pos.listLen > count) {
+		return tracer.TracePage{}, tracer.ErrInvalidCursor
+	}
+	offset := pos.offset
+
+	// Select packed records
+	records := make(tracer.Trace, 0, limit)
+	if offset < packedLen {
+		end := offset + limit
+		if end > packedLen {
+			end = packedLen
+		}
+		records = append(records, packedLog[offset:end]...)
+	}
+
+	// Select unpacked records. New records are pushed to the head of the list so
+	// the i-th stored record is located at index -(i+1).
+	listStart := offset - packedLen
+	if listStart < 0 {
+		listStart = 0
+	}
+	listEnd := offset + limit - packedLen
+	if listEnd > count {
+		listEnd = count
+	}
+	if listStart < listEnd {
+		rawRows, err := redis.Strings(conn.Do("LRANGE", traceKey, -listEnd, -(listStart + 1)))
+		if err != nil {
+			return tracer.TracePage{}, err
+		}
+		for _, rawRow := range rawRows {
+			entry := tracer.Record{}
+			err = tracer.UnmarshalRecord([]byte(rawRow), &entry)
+			if err != nil {
+				return tracer.TracePage{}, err
+			}
+			records = append(records, entry)
+		}
+	}
+
+	sort.Sort(records)
+	page := tracer.TracePage{
+		Records: records,
+		Total:   packedLen + count,
+	}
+	if next := offset + len(records); next < page.Total {
+		page.NextCursor = pagePosition{offset: next, packedLen: packedLen, listLen: count}.String()
+	}
+	return page, nil
+}
+
 // Get service dependencies optionally filtered by a set of service names. If no filters are
 // specified then the response will include all services currently known to the storage.
 func (r *redisStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
-	conn, err := r.redisSrv.GetConnection()
+	return r.GetDependenciesContext(context.Background(), srvFilter...)
+}
+
+// Get service dependencies optionally filtered by a set of service names. Implements
+// the ContextStorage interface.
+func (r *redisStorage) GetDependenciesContext(ctx context.Context, srvFilter ...string) ([]tracer.Dependencies, error) {
+	var serviceDeps []tracer.Dependencies
+	err := r.withConnection(ctx, func(conn redis.Conn) error {
+		var err error
+		serviceDeps, err = r.getEdges(conn, depsKeyFormat, srvFilter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serviceDeps, nil
+}
+
+// Get the services that depend on each service optionally filtered by a set of service
+// names. If no filters are specified then the response will include all services
+// currently known to the storage. Implements the Storage interface.
+func (r *redisStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	return r.GetDependentsContext(context.Background(), srvFilter...)
+}
+
+// Get the services that depend on each service optionally filtered by a set of service
+// names. Implements the ContextStorage interface.
+func (r *redisStorage) GetDependentsContext(ctx context.Context, srvFilter ...string) ([]tracer.Dependencies, error) {
+	var serviceDeps []tracer.Dependencies
+	err := r.withConnection(ctx, func(conn redis.Conn) error {
+		var err error
+		serviceDeps, err = r.getEdges(conn, dependentsKeyFormat, srvFilter)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return serviceDeps, nil
+}
+
+// Rebuild the dependent sets from the dependency sets. Dependent sets are only
+// maintained for records stored by this version of the storage; this method should
+// be invoked once to index the dependencies of records stored by older versions.
+func (r *redisStorage) RebuildDependents() error {
+	conn, err := r.redisSrv.GetConnection()
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
+	deps, err := r.getEdges(conn, depsKeyFormat, nil)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, dep := range deps {
+		for _, target := range dep.Dependencies {
+			conn.Send("SADD", fmt.Sprintf(dependentsKeyFormat, target), dep.Service)
+		}
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Fetch the edges of a set of services using the supplied connection. The keyFormat
+// specifies the key of the set that holds the edges of each service.
+func (r *redisStorage) getEdges(conn redis.Conn, keyFormat string, srvFilter []string) ([]tracer.Dependencies, error) {
+	var err error
 	if len(srvFilter) == 0 {
 		srvFilter, err = redis.Strings(conn.Do("SMEMBERS", "tracer.services"))
 		if err != nil {
@@ -126,7 +583,7 @@ func (r *redisStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependenci
 	// Fetch deps in a single batch
 	conn.Send("MULTI")
 	for _, serviceName := range srvFilter {
-		conn.Send("SMEMBERS", fmt.Sprintf("tracer.%s.deps", serviceName))
+		conn.Send("SMEMBERS", fmt.Sprintf(keyFormat, serviceName))
 	}
 	replies, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
@@ -147,7 +604,215 @@ func (r *redisStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependenci
 	return serviceDeps, nil
 }
 
+// Get the summaries of all known services sorted by service name. As redis does
+// not support conditional updates without scripting, the first and last seen
+// timestamps of each service are the timestamps of the first and last stored
+// records. Implements the ServiceCatalog interface.
+func (r *redisStorage) GetServices(ctx context.Context) ([]tracer.ServiceSummary, error) {
+	var summaries []tracer.ServiceSummary
+	err := r.withConnection(ctx, func(conn redis.Conn) error {
+		var err error
+		summaries, err = r.getServices(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// Fetch service summaries using the supplied connection.
+func (r *redisStorage) getServices(conn redis.Conn) ([]tracer.ServiceSummary, error) {
+	deps, err := r.getEdges(conn, depsKeyFormat, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the activity of all services in a single batch
+	conn.Send("MULTI")
+	for _, dep := range deps {
+		conn.Send("HGETALL", fmt.Sprintf("tracer.%s.stats", dep.Service))
+		conn.Send("SMEMBERS", fmt.Sprintf("tracer.%s.hosts", dep.Service))
+		conn.Send("LRANGE", fmt.Sprintf("tracer.%s.latency", dep.Service), 0, -1)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]*tracer.ServiceSummary)
+	for index, dep := range deps {
+		rawStats, _ := redis.StringMap(replies[3*index], nil)
+		stats := make(map[string]int64, len(rawStats))
+		for field, rawVal := range rawStats {
+			stats[field], _ = strconv.ParseInt(rawVal, 10, 64)
+		}
+		hosts, _ := redis.Strings(replies[3*index+1], nil)
+		rawLatencies, _ := redis.Values(replies[3*index+2], nil)
+
+		latencies := make([]time.Duration, 0, len(rawLatencies))
+		for _, rawLatency := range rawLatencies {
+			latency, err := redis.Int64(rawLatency, nil)
+			if err == nil {
+				latencies = append(latencies, time.Duration(latency))
+			}
+		}
+
+		summary := &tracer.ServiceSummary{
+			Service: dep.Service,
+			Hosts:   hosts,
+		}
+		if ts, exists := stats["first_seen"]; exists {
+			summary.FirstSeen = time.Unix(0, ts)
+		}
+		if ts, exists := stats["last_seen"]; exists {
+			summary.LastSeen = time.Unix(0, ts)
+		}
+		summary.SetCalls(stats["calls"], stats["errors"])
+		summary.SetLatencies(latencies)
+		summaries[dep.Service] = summary
+	}
+
+	return tracer.SummarizeServices(summaries, deps), nil
+}
+
 // Shutdown the storage.
 func (r *redisStorage) Close() {
+	r.closeIdleDirectConns()
 	r.redisSrv.Close()
 }
+
+// Obtain a connection and invoke fn with it, honoring the cancellation and deadline
+// of the supplied context.
+func (r *redisStorage) withConnection(ctx context.Context, fn func(conn redis.Conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Contexts that can never be canceled can safely use a pooled connection. So
+	// do all contexts if no direct endpoint is set; pooled connections do not
+	// support deadlines so the operation is not aborted when the context is done.
+	if ctx.Done() == nil || r.directEndpoint == "" {
+		conn, err := r.redisSrv.GetConnection()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return ctxError(ctx, fn(conn))
+	}
+
+	return r.withDirectConnection(ctx, fn)
+}
+
+// Invoke fn with a dedicated connection whose read and write deadlines match the
+// context deadline. The connection is closed when the context is done; otherwise it
+// is returned to the idle connection list once fn returns successfully.
+func (r *redisStorage) withDirectConnection(ctx context.Context, fn func(conn redis.Conn) error) error {
+	deadline, _ := ctx.Deadline()
+
+	dc, isNew := r.idleDirectConn(), false
+	if dc == nil {
+		dialer := net.Dialer{Deadline: deadline}
+		netConn, err := dialer.Dial("tcp", r.directEndpoint)
+		if err != nil {
+			return deadlineError(ctx, err)
+		}
+
+		// Timeouts are enforced via the connection deadline
+		dc, isNew = &directConn{netConn: netConn, conn: redis.NewConn(netConn, 0, 0)}, true
+	}
+	dc.netConn.SetDeadline(deadline)
+
+	// Unblock pending reads and writes when the context is canceled
+	stopWatch := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			dc.netConn.Close()
+		case <-stopWatch:
+		}
+	}()
+
+	var err error
+	if isNew && r.directPassword != "" {
+		_, err = dc.conn.Do("AUTH", r.directPassword)
+	}
+	if isNew && err == nil && r.directDb != 0 {
+		_, err = dc.conn.Do("SELECT", r.directDb)
+	}
+	if err == nil {
+		err = fn(dc.conn)
+	}
+
+	close(stopWatch)
+	<-watchDone
+
+	// Failed operations may leave unread replies behind so their connections are
+	// never reused
+	if err != nil || ctx.Err() != nil {
+		dc.conn.Close()
+		return deadlineError(ctx, err)
+	}
+	dc.netConn.SetDeadline(time.Time{})
+	r.releaseDirectConn(dc)
+	return nil
+}
+
+// Get an idle dedicated connection or nil if there are no idle connections.
+func (r *redisStorage) idleDirectConn() *directConn {
+	r.directMutex.Lock()
+	defer r.directMutex.Unlock()
+
+	if len(r.directIdle) == 0 {
+		return nil
+	}
+	dc := r.directIdle[len(r.directIdle)-1]
+	r.directIdle = r.directIdle[:len(r.directIdle)-1]
+	return dc
+}
+
+// Add a dedicated connection to the idle connection list or close it if the list
+// is full.
+func (r *redisStorage) releaseDirectConn(dc *directConn) {
+	r.directMutex.Lock()
+	defer r.directMutex.Unlock()
+
+	if len(r.directIdle) >= maxIdleDirectConns {
+		dc.conn.Close()
+		return
+	}
+	r.directIdle = append(r.directIdle, dc)
+}
+
+// Close all idle dedicated connections.
+func (r *redisStorage) closeIdleDirectConns() {
+	r.directMutex.Lock()
+	defer r.directMutex.Unlock()
+
+	for _, dc := range r.directIdle {
+		dc.conn.Close()
+	}
+	r.directIdle = nil
+}
+
+// Report the context error instead of err if the context is done or its deadline
+// has passed. Connection deadlines may expire slightly before the context is done.
+func deadlineError(ctx context.Context, err error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if err != nil && ctx.Err() == nil && hasDeadline && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return ctxError(ctx, err)
+}
+
+// Report the context error instead of err if the context is done. Errors caused by
+// expired connection deadlines or closed connections are thus reported as
+// context.DeadlineExceeded or context.Canceled.
+func ctxError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -13,6 +13,10 @@ import (
 	"bytes"
 	"encoding/json"
 
+	"net"
+
+	"golang.org/x/net/context"
+
 	"github.com/achilleasa/usrv-service-adapters/service/redis"
 	"github.com/achilleasa/usrv-tracer"
 )
@@ -127,3 +131,467 @@ func TestRedisStorage(t *testing.T) {
 		t.Fatalf("Expected dependency set %v; got %v", depTests, deps)
 	}
 }
+
+func TestRedisStorageCodecFallback(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+	defer storage.SetCodec(tracer.JSONCodec)
+
+	now := time.Now()
+	traceId := "ab5bd1f4-d4a6-4b9c-9bd5-3d4e6a9f0c11"
+	dataSet := tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now, TraceId: traceId, CorrelationId: "c-1111"},
+		tracer.Record{Type: tracer.Response, From: "com.service2", To: "com.service1", Timestamp: now.Add(time.Second), TraceId: traceId, CorrelationId: "c-1111", Duration: 1000},
+	}
+
+	// Store the first entry as JSON and the second one using the binary codec
+	codecs := []tracer.Codec{tracer.JSONCodec, tracer.BinaryCodec}
+	for index, entry := range dataSet {
+		storage.SetCodec(codecs[index])
+		err := storage.Store(&entry, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace: %v", err)
+	}
+
+	l, _ := json.Marshal(dataSet)
+	r, _ := json.Marshal(traceLog)
+	if bytes.Compare(l, r) != 0 {
+		t.Fatalf("Expected retrieved trace to be equal to %v; got %v", dataSet, traceLog)
+	}
+}
+
+func TestRedisStorageCompaction(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+	storage.SetCompaction(true)
+	defer storage.SetCompaction(false)
+
+	now := time.Now()
+	traceId := "5d0b8a5e-52ad-4e5b-8d32-6c1b0a5b2f3e"
+	dataSet := tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now, TraceId: traceId, CorrelationId: "c-1111"},
+		tracer.Record{Type: tracer.Request, From: "com.service2", To: "com.service3", Timestamp: now.Add(time.Second), TraceId: traceId, CorrelationId: "c-2222"},
+		tracer.Record{Type: tracer.Response, From: "com.service3", To: "com.service2", Timestamp: now.Add(2 * time.Second), TraceId: traceId, CorrelationId: "c-2222"},
+		tracer.Record{Type: tracer.Response, From: "com.service2", To: "com.service1", Timestamp: now.Add(3 * time.Second), TraceId: traceId, CorrelationId: "c-1111"},
+	}
+
+	for index, entry := range dataSet {
+		err := storage.Store(&entry, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	// The root response has been stored; the trace should be compacted
+	conn, err := redis.Adapter.GetConnection()
+	if err != nil {
+		t.Fatalf("Error connecting to redis db: %v", err)
+	}
+	defer conn.Close()
+
+	listLen, err := conn.Do("LLEN", "tracer."+traceId)
+	if err != nil {
+		t.Fatalf("Error querying trace list: %v", err)
+	}
+	if listLen.(int64) != 0 {
+		t.Fatalf("Expected trace list to be empty after compaction; got %d entries", listLen)
+	}
+
+	// Entries stored after compaction should be merged with the packed trace
+	late := tracer.Record{Type: tracer.Request, From: "com.service3", To: "com.service4", Timestamp: now.Add(4 * time.Second), TraceId: traceId, CorrelationId: "c-3333"}
+	err = storage.Store(&late, time.Hour)
+	if err != nil {
+		t.Fatalf("Error while storing late entry: %v", err)
+	}
+	dataSet = append(dataSet, late)
+
+	// The pending counter re-created by the late request should expire with the trace
+	ttl, err := conn.Do("TTL", "tracer."+traceId+".pending")
+	if err != nil {
+		t.Fatalf("Error querying pending counter TTL: %v", err)
+	}
+	if ttl.(int64) <= 0 {
+		t.Fatalf("Expected pending counter to have a TTL; got %d", ttl)
+	}
+
+	traceLog, err := storage.GetTrace(traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace: %v", err)
+	}
+
+	l, _ := json.Marshal(dataSet)
+	r, _ := json.Marshal(traceLog)
+	if bytes.Compare(l, r) != 0 {
+		t.Fatalf("Expected retrieved trace to be equal to %v; got %v", dataSet, traceLog)
+	}
+}
+
+func TestRedisStorageContext(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+	storage.SetDirectEndpoint(redisEndpoint, "", 0)
+	defer storage.SetDirectEndpoint("", "", 0)
+
+	traceId := "9a1f3c2e-0d4b-4c7e-a5b6-3f2e1d0c9b8a"
+	rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: time.Now(), TraceId: traceId, CorrelationId: "c-1111"}
+
+	// Canceled contexts should fail without contacting redis
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = storage.StoreContext(canceledCtx, &rec, time.Hour)
+	if err != context.Canceled {
+		t.Fatalf("Expected StoreContext to return context.Canceled; got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = storage.StoreContext(ctx, &rec, time.Hour)
+	if err != nil {
+		t.Fatalf("Error while storing entry: %v", err)
+	}
+
+	traceLog, err := storage.GetTraceContext(ctx, traceId)
+	if err != nil {
+		t.Fatalf("Error retrieving trace: %v", err)
+	}
+	if len(traceLog) == 0 {
+		t.Fatalf("Expected trace to contain the stored entry")
+	}
+
+	deps, err := storage.GetDependenciesContext(ctx, "com.service1")
+	if err != nil {
+		t.Fatalf("Error retrieving dependencies: %v", err)
+	}
+	if len(deps) != 1 || len(deps[0].Dependencies) != 1 {
+		t.Fatalf("Unexpected dependencies: %v", deps)
+	}
+}
+
+func TestRedisStoragePaging(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+	storage.SetMaxTraceRecords(5)
+	defer storage.SetMaxTraceRecords(0)
+
+	now := time.Now()
+	traceId := "3c6f1a2b-7d8e-4f90-a1b2-c3d4e5f60718"
+	for index := 0; index < 8; index++ {
+		rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now.Add(time.Duration(index) * time.Second), TraceId: traceId, CorrelationId: "c-1111"}
+		err = storage.Store(&rec, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	// Fetch trace in pages; the trace should contain 5 records and a truncation marker
+	cursor := ""
+	traceLog := make(tracer.Trace, 0)
+	for {
+		page, err := storage.GetTracePage(context.Background(), traceId, cursor, 4)
+		if err != nil {
+			t.Fatalf("Error retrieving trace page: %v", err)
+		}
+		if page.Total != 6 {
+			t.Fatalf("Expected page total to be 6; got %d", page.Total)
+		}
+		traceLog = append(traceLog, page.Records...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(traceLog) != 6 {
+		t.Fatalf("Expected to fetch 6 records; got %d", len(traceLog))
+	}
+	for index := 0; index < 5; index++ {
+		if !traceLog[index].Timestamp.Equal(now.Add(time.Duration(index) * time.Second)) {
+			t.Fatalf("Expected record %d to be in insertion order", index)
+		}
+	}
+	if traceLog[5].Type != tracer.Truncated {
+		t.Fatalf("Expected last record to be a truncation marker; got %v", traceLog[5])
+	}
+}
+
+func TestRedisStoragePagingContract(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+
+	testPagedStorageContract(t, storage, "5e7d9c1a-2b3f-4a6e-8d0c-1f2e3a4b5c6d")
+}
+
+func TestRedisStoragePagingCompaction(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+	storage.SetCompaction(true)
+	defer storage.SetCompaction(false)
+
+	now := time.Now()
+	traceId := "8b7e6d5c-4f3a-4b2c-9d1e-0f9a8b7c6d5e"
+	dataSet := tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: now, TraceId: traceId, CorrelationId: "c-1111"},
+		tracer.Record{Type: tracer.Request, From: "com.service2", To: "com.service3", Timestamp: now.Add(time.Second), TraceId: traceId, CorrelationId: "c-2222"},
+	}
+	for index, entry := range dataSet {
+		err := storage.Store(&entry, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	page, err := storage.GetTracePage(context.Background(), traceId, "", 1)
+	if err != nil {
+		t.Fatalf("Error retrieving trace page: %v", err)
+	}
+
+	// Appending records should not invalidate the cursor
+	rec := tracer.Record{Type: tracer.Response, From: "com.service3", To: "com.service2", Timestamp: now.Add(2 * time.Second), TraceId: traceId, CorrelationId: "c-2222"}
+	err = storage.Store(&rec, time.Hour)
+	if err != nil {
+		t.Fatalf("Error while storing entry: %v", err)
+	}
+	page, err = storage.GetTracePage(context.Background(), traceId, page.NextCursor, 1)
+	if err != nil {
+		t.Fatalf("Error retrieving trace page: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].CorrelationId != "c-2222" || page.NextCursor == "" {
+		t.Fatalf("Unexpected page: %v", page)
+	}
+
+	// Compacting the trace should invalidate the cursor
+	rec = tracer.Record{Type: tracer.Response, From: "com.service2", To: "com.service1", Timestamp: now.Add(3 * time.Second), TraceId: traceId, CorrelationId: "c-1111"}
+	err = storage.Store(&rec, time.Hour)
+	if err != nil {
+		t.Fatalf("Error while storing entry: %v", err)
+	}
+	_, err = storage.GetTracePage(context.Background(), traceId, page.NextCursor, 1)
+	if err != tracer.ErrInvalidCursor {
+		t.Fatalf("Expected error %v; got %v", tracer.ErrInvalidCursor, err)
+	}
+}
+
+func TestParsePageCursor(t *testing.T) {
+	pos, err := parsePageCursor(pagePosition{offset: 4, packedLen: 3, listLen: 2}.String(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != (pagePosition{offset: 4, packedLen: 3, listLen: 2}) {
+		t.Fatalf("Unexpected page position: %+v", pos)
+	}
+
+	for _, cursor := range []string{"4", "4:3", "a:3:2", "4:-1:2", "4:3:b"} {
+		if _, err := parsePageCursor(cursor, 10); err != tracer.ErrInvalidCursor {
+			t.Fatalf("[cursor %q] Expected error %v; got %v", cursor, tracer.ErrInvalidCursor, err)
+		}
+	}
+	if _, err := parsePageCursor("", 0); err != tracer.ErrInvalidPageSize {
+		t.Fatalf("Expected error %v; got %v", tracer.ErrInvalidPageSize, err)
+	}
+}
+
+func TestRedisStorageServices(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+
+	now := time.Now()
+	traceId := "6e2d4c1b-9a8f-4e7d-b6c5-a4b3c2d1e0f9"
+	dataSet := tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.catalog1", To: "com.catalog2", Host: "host-a", Timestamp: now, TraceId: traceId, CorrelationId: "c-1111"},
+		tracer.Record{Type: tracer.Response, From: "com.catalog2", To: "com.catalog1", Host: "host-a", Timestamp: now.Add(time.Second), TraceId: traceId, CorrelationId: "c-1111", Duration: int64(10 * time.Millisecond), Error: "oops"},
+		// Client records should not be indexed; the caller of this one is unknown
+		tracer.Record{Type: tracer.Request, Kind: tracer.Client, From: "", To: "com.catalog3", Timestamp: now.Add(2 * time.Second), TraceId: traceId, CorrelationId: "c-2222"},
+	}
+	for index, entry := range dataSet {
+		err := storage.Store(&entry, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	services, err := storage.GetServices(context.Background())
+	if err != nil {
+		t.Fatalf("Error retrieving services: %v", err)
+	}
+
+	var srv *tracer.ServiceSummary
+	for index := range services {
+		if services[index].Service == "com.catalog2" {
+			srv = &services[index]
+		}
+	}
+	if srv == nil {
+		t.Fatalf("Expected service catalog to include com.catalog2")
+	}
+	for _, summary := range services {
+		if summary.Service == "" || summary.Service == "com.catalog3" {
+			t.Fatalf("Expected client records not to be indexed; got service %q", summary.Service)
+		}
+	}
+	if srv.Calls != 1 || srv.Errors != 1 || srv.P50 != 10*time.Millisecond {
+		t.Fatalf("Unexpected service stats: %v", srv)
+	}
+	if !reflect.DeepEqual(srv.Hosts, []string{"host-a"}) || !reflect.DeepEqual(srv.Callers, []string{"com.catalog1"}) {
+		t.Fatalf("Unexpected hosts/callers: %v, %v", srv.Hosts, srv.Callers)
+	}
+	if !srv.FirstSeen.Equal(time.Unix(0, now.UnixNano())) {
+		t.Fatalf("Expected first seen timestamp to be %v; got %v", now, srv.FirstSeen)
+	}
+}
+
+func TestRedisStorageDependents(t *testing.T) {
+	redis.Adapter.Config(map[string]string{"endpoint": redisEndpoint})
+
+	storage := Redis
+	err := storage.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer storage.Close()
+
+	traceId := "1b2c3d4e-5f60-4718-92a3-b4c5d6e7f809"
+	dataSet := tracer.Trace{
+		tracer.Record{Type: tracer.Request, From: "com.upstream1", To: "com.upstream3", Timestamp: time.Now(), TraceId: traceId},
+		tracer.Record{Type: tracer.Request, From: "com.upstream2", To: "com.upstream3", Timestamp: time.Now(), TraceId: traceId},
+	}
+	for index, entry := range dataSet {
+		err := storage.Store(&entry, time.Hour)
+		if err != nil {
+			t.Fatalf("Error while storing entry #%d: %v", index, err)
+		}
+	}
+
+	// Remove the dependent set and rebuild it from the dependency sets
+	conn, err := redis.Adapter.GetConnection()
+	if err != nil {
+		t.Fatalf("Error connecting to redis db: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", "tracer.com.upstream3.dependents")
+	if err != nil {
+		t.Fatalf("Error deleting dependent set: %v", err)
+	}
+	err = storage.RebuildDependents()
+	if err != nil {
+		t.Fatalf("Error rebuilding dependents: %v", err)
+	}
+
+	dependents, err := storage.GetDependents("com.upstream3")
+	if err != nil {
+		t.Fatalf("Error retrieving dependents: %v", err)
+	}
+	if len(dependents) != 1 {
+		t.Fatalf("Expected 1 entry; got %d", len(dependents))
+	}
+	sort.Strings(dependents[0].Dependencies)
+	if !reflect.DeepEqual(dependents[0].Dependencies, []string{"com.upstream1", "com.upstream2"}) {
+		t.Fatalf("Unexpected dependents: %v", dependents[0].Dependencies)
+	}
+}
+
+func TestDirectConnectionDeadline(t *testing.T) {
+	// A redis endpoint that accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error creating listener: %v", err)
+	}
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		listener.Close()
+		for conn := range accepted {
+			conn.Close()
+		}
+	}()
+
+	storage := &redisStorage{codec: tracer.JSONCodec}
+	storage.SetDirectEndpoint(listener.Addr().String(), "", 0)
+	defer storage.closeIdleDirectConns()
+	rec := tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", Timestamp: time.Now(), TraceId: "abcd"}
+
+	// Pending operations should be aborted once the deadline expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = storage.StoreContext(ctx, &rec, time.Hour)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected StoreContext to return context.DeadlineExceeded; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected StoreContext to return once the deadline expired; took %v", elapsed)
+	}
+
+	// Pending operations should be aborted once the context is canceled
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = storage.GetTraceContext(ctx, "abcd")
+	if err != context.Canceled {
+		t.Fatalf("Expected GetTraceContext to return context.Canceled; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected GetTraceContext to return once the context was canceled; took %v", elapsed)
+	}
+
+	// Aborted connections should not be reused
+	if len(storage.directIdle) != 0 {
+		t.Fatalf("Expected aborted connections to be closed; got %d idle connections", len(storage.directIdle))
+	}
+}
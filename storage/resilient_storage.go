@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+var (
+	ErrCircuitOpen   = errors.New("resilient: circuit breaker is open")
+	ErrRecordExpired = errors.New("resilient: record expired while spooled")
+)
+
+type BreakerState int
+
+// The states of the circuit breaker used by the ResilientStorage.
+const (
+	// Requests are sent to the backend.
+	BreakerClosed BreakerState = iota
+
+	// The backend is considered unavailable and requests fail fast.
+	BreakerOpen
+
+	// A single probe request is sent to the backend to check whether it has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// The ResilientStorage wraps a storage backend and protects against transient
+// backend failures.
+//
+// Failed Store calls are retried with an exponential backoff. After a number of
+// consecutive failures, a circuit breaker opens and requests fail fast (without
+// spawning retries) until the backend recovers. While the backend is unavailable,
+// records are written to a bounded spool. Once the backend recovers, the spooled
+// records are replayed in the background.
+type ResilientStorage struct {
+	backend tracer.Storage
+	spool   Spool
+
+	// Retry settings.
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// Circuit breaker settings.
+	failureThreshold int
+	openTimeout      time.Duration
+
+	// Circuit breaker state.
+	mutex     sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	replaying bool
+	replayWg  sync.WaitGroup
+	closing   chan struct{}
+
+	// A callback invoked when a spooled record cannot be replayed or spooled.
+	onDrop func(rec *tracer.Record, err error)
+
+	// Stubbed by tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Wrap a storage backend. The returned storage retries each failed Store call up to
+// 3 times with a backoff between 50ms and 1s, opens its circuit breaker after 5
+// consecutive failures for 30s and spools up to 10000 records in memory.
+func NewResilient(backend tracer.Storage) *ResilientStorage {
+	return &ResilientStorage{
+		backend:          backend,
+		spool:            NewMemorySpool(10000),
+		maxRetries:       3,
+		minBackoff:       50 * time.Millisecond,
+		maxBackoff:       time.Second,
+		failureThreshold: 5,
+		openTimeout:      30 * time.Second,
+		closing:          make(chan struct{}),
+		now:              time.Now,
+		sleep:            time.Sleep,
+	}
+}
+
+// Set the number of retries for failed Store calls and the backoff between them. The
+// backoff starts at minBackoff and doubles after each retry up to maxBackoff.
+func (s *ResilientStorage) SetRetries(maxRetries int, minBackoff, maxBackoff time.Duration) {
+	s.maxRetries = maxRetries
+	s.minBackoff = minBackoff
+	s.maxBackoff = maxBackoff
+}
+
+// Configure the circuit breaker. The breaker opens after failureThreshold consecutive
+// failed Store calls. After openTimeout elapses, a single probe request is allowed
+// through; if it succeeds the breaker closes, otherwise it opens again.
+func (s *ResilientStorage) SetCircuitBreaker(failureThreshold int, openTimeout time.Duration) {
+	s.failureThreshold = failureThreshold
+	s.openTimeout = openTimeout
+}
+
+// Set the spool used for buffering records while the backend is unavailable (see
+// NewMemorySpool and NewDiskSpool). This method must be invoked before the storage
+// is used.
+func (s *ResilientStorage) SetSpool(spool Spool) {
+	s.spool = spool
+}
+
+// Set a callback to be invoked when a record is dropped because it could neither be
+// stored nor spooled (e.g. because the spool is full) or because its TTL expired
+// while it was spooled.
+func (s *ResilientStorage) OnDrop(callback func(rec *tracer.Record, err error)) {
+	s.onDrop = callback
+}
+
+// Get the current circuit breaker state.
+func (s *ResilientStorage) State() BreakerState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == BreakerOpen && s.now().Sub(s.openedAt) >= s.openTimeout {
+		return BreakerHalfOpen
+	}
+	return s.state
+}
+
+// Dial the backend. If the spool contains records from a previous run, they are
+// replayed in the background. Implements the Storage interface.
+func (s *ResilientStorage) Dial() error {
+	err := s.backend.Dial()
+	if err != nil {
+		return err
+	}
+
+	s.startReplay()
+	return nil
+}
+
+// Store a trace entry. Failed attempts are retried with backoff. If all attempts
+// fail or the circuit breaker is open, the record is spooled and replayed once the
+// backend recovers. An error is only returned if the record could not be spooled.
+// Implements the Storage interface.
+func (s *ResilientStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	attempts, allowed := s.acquire()
+	if allowed {
+		var err error
+		backoff := s.minBackoff
+		for attempt := 0; attempt < attempts; attempt++ {
+			if attempt > 0 {
+				s.sleep(backoff)
+				backoff *= 2
+				if backoff > s.maxBackoff {
+					backoff = s.maxBackoff
+				}
+			}
+
+			err = s.backend.Store(logEntry, ttl)
+			if err == nil {
+				s.recordSuccess()
+				s.startReplay()
+				return nil
+			}
+		}
+		s.recordFailure()
+	}
+
+	// Spool record so it can be replayed when the backend recovers
+	err := s.spool.Push(SpoolEntry{Record: *logEntry, TTL: ttl, SpooledAt: s.now()})
+	if err != nil {
+		s.drop(logEntry, err)
+		return err
+	}
+	return nil
+}
+
+// Fetch a set of time-ordered trace entries with the given trace-id. Returns
+// ErrCircuitOpen if the circuit breaker is open. Implements the Storage interface.
+func (s *ResilientStorage) GetTrace(traceId string) (tracer.Trace, error) {
+	if s.State() == BreakerOpen {
+		return nil, ErrCircuitOpen
+	}
+	return s.backend.GetTrace(traceId)
+}
+
+// Fetch up to limit records of the trace with the given trace-id starting at cursor.
+// Returns ErrCircuitOpen if the circuit breaker is open. Implements the PagedStorage
+// interface.
+func (s *ResilientStorage) GetTracePage(ctx context.Context, traceId string, cursor string, limit int) (tracer.TracePage, error) {
+	if s.State() == BreakerOpen {
+		return tracer.TracePage{}, ErrCircuitOpen
+	}
+	return tracer.NewPagedStorage(s.backend).GetTracePage(ctx, traceId, cursor, limit)
+}
+
+// Get the summaries of all known services. Returns ErrCircuitOpen if the circuit
+// breaker is open. Implements the ServiceCatalog interface.
+func (s *ResilientStorage) GetServices(ctx context.Context) ([]tracer.ServiceSummary, error) {
+	if s.State() == BreakerOpen {
+		return nil, ErrCircuitOpen
+	}
+	return tracer.NewServiceCatalog(s.backend).GetServices(ctx)
+}
+
+// Get service dependencies optionally filtered by a set of service names. Returns
+// ErrCircuitOpen if the circuit breaker is open. Implements the Storage interface.
+func (s *ResilientStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
+	if s.State() == BreakerOpen {
+		return nil, ErrCircuitOpen
+	}
+	return s.backend.GetDependencies(srvFilter...)
+}
+
+// Get the services that depend on each service optionally filtered by a set of service
+// names. Returns ErrCircuitOpen if the circuit breaker is open. Implements the Storage
+// interface.
+func (s *ResilientStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	if s.State() == BreakerOpen {
+		return nil, ErrCircuitOpen
+	}
+	return s.backend.GetDependents(srvFilter...)
+}
+
+// Stop replaying spooled records and shutdown the backend. Records that have not
+// been replayed remain in the spool.
+func (s *ResilientStorage) Close() {
+	s.mutex.Lock()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	s.mutex.Unlock()
+
+	s.replayWg.Wait()
+	s.spool.Close()
+	s.backend.Close()
+}
+
+// Check whether a request may be sent to the backend and return the number of
+// attempts it may perform. When the breaker is half-open only a single probe
+// request with no retries is allowed.
+func (s *ResilientStorage) acquire() (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case BreakerClosed:
+		return s.maxRetries + 1, true
+	case BreakerOpen:
+		if s.now().Sub(s.openedAt) < s.openTimeout {
+			return 0, false
+		}
+		s.state = BreakerHalfOpen
+		return 1, true
+	default:
+		// A probe is already in progress
+		return 0, false
+	}
+}
+
+func (s *ResilientStorage) recordSuccess() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = BreakerClosed
+	s.failures = 0
+}
+
+func (s *ResilientStorage) recordFailure() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failures++
+	if s.state == BreakerHalfOpen || s.failures >= s.failureThreshold {
+		s.state = BreakerOpen
+		s.openedAt = s.now()
+	}
+}
+
+// Start replaying spooled records unless a replay is already in progress or the
+// breaker is not closed.
+func (s *ResilientStorage) startReplay() {
+	if s.spool.Len() == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+	if s.replaying || s.state != BreakerClosed {
+		return
+	}
+	s.replaying = true
+	s.replayWg.Add(1)
+	go s.replay()
+}
+
+// Replay spooled records in order. Replaying stops if the backend fails; it is
+// restarted by the next successful Store call.
+func (s *ResilientStorage) replay() {
+	defer func() {
+		s.mutex.Lock()
+		s.replaying = false
+		s.mutex.Unlock()
+		s.replayWg.Done()
+	}()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+
+		entry, ok, err := s.spool.Peek()
+		if err != nil {
+			// Skip entries that cannot be read
+			s.drop(nil, err)
+			if s.spool.Remove() != nil {
+				return
+			}
+			continue
+		}
+		if !ok {
+			return
+		}
+
+		// Adjust TTL for the time the record spent in the spool and drop expired records.
+		// Storage engines use a whole second TTL resolution and ignore TTLs of up to a
+		// second so records with a second or less left are also dropped; otherwise they
+		// would never expire. Records spooled with such a TTL are replayed as-is
+		ttl := entry.TTL
+		if ttl > time.Second {
+			ttl -= s.now().Sub(entry.SpooledAt)
+			if ttl <= time.Second {
+				s.drop(&entry.Record, ErrRecordExpired)
+				s.spool.Remove()
+				continue
+			}
+		}
+
+		err = s.backend.Store(&entry.Record, ttl)
+		if err != nil {
+			s.recordFailure()
+			return
+		}
+		s.spool.Remove()
+	}
+}
+
+func (s *ResilientStorage) drop(rec *tracer.Record, err error) {
+	if s.onDrop != nil {
+		s.onDrop(rec, err)
+	}
+}
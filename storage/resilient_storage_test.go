@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// A memory storage that can be switched to failing mode.
+type flakyStorage struct {
+	*memoryStorage
+	mutex   sync.Mutex
+	failing bool
+	calls   int
+}
+
+func (s *flakyStorage) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func (s *flakyStorage) callCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+func (s *flakyStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	s.mutex.Lock()
+	s.calls++
+	failing := s.failing
+	s.mutex.Unlock()
+
+	if failing {
+		return errors.New("connection reset")
+	}
+	return s.memoryStorage.Store(logEntry, ttl)
+}
+
+func newTestResilient(backend tracer.Storage) (*ResilientStorage, *time.Time, *[]time.Duration) {
+	now := time.Unix(1436818515, 0)
+	sleeps := make([]time.Duration, 0)
+	s := NewResilient(backend)
+	s.now = func() time.Time { return now }
+	s.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return s, &now, &sleeps
+}
+
+func waitForTrace(t *testing.T, storage tracer.Storage, traceId string, count int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		trace, _ := storage.GetTrace(traceId)
+		if len(trace) == count {
+			return
+		}
+		<-time.After(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected trace %s to contain %d records", traceId, count)
+}
+
+func TestResilientStorageRetry(t *testing.T) {
+	backend := &flakyStorage{memoryStorage: newMemoryStorage(), failing: true}
+	s, _, sleeps := newTestResilient(backend)
+	s.SetRetries(4, 10*time.Millisecond, 50*time.Millisecond)
+
+	err := s.Store(&tracer.Record{TraceId: "abcd"}, 0)
+	if err != nil {
+		t.Fatalf("Expected record to be spooled; got %v", err)
+	}
+	if backend.callCount() != 5 {
+		t.Fatalf("Expected 5 store attempts; got %d", backend.callCount())
+	}
+	expSleeps := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	if len(*sleeps) != len(expSleeps) {
+		t.Fatalf("Expected backoff to be %v; got %v", expSleeps, *sleeps)
+	}
+	for index, d := range expSleeps {
+		if (*sleeps)[index] != d {
+			t.Fatalf("Expected backoff to be %v; got %v", expSleeps, *sleeps)
+		}
+	}
+	if s.spool.Len() != 1 {
+		t.Fatalf("Expected failed record to be spooled")
+	}
+}
+
+func TestResilientStorageCircuitBreaker(t *testing.T) {
+	backend := &flakyStorage{memoryStorage: newMemoryStorage(), failing: true}
+	s, now, _ := newTestResilient(backend)
+	s.SetRetries(0, 0, 0)
+	s.SetCircuitBreaker(3, time.Minute)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		s.Store(&tracer.Record{TraceId: "abcd"}, 0)
+	}
+	if s.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to be open; got %s", s.State())
+	}
+
+	// While open, records are spooled without hitting the backend
+	s.Store(&tracer.Record{TraceId: "abcd"}, 0)
+	if backend.callCount() != 3 {
+		t.Fatalf("Expected open breaker not to call the backend; got %d calls", backend.callCount())
+	}
+	if _, err := s.GetTrace("abcd"); err != ErrCircuitOpen {
+		t.Fatalf("Expected GetTrace to fail with ErrCircuitOpen; got %v", err)
+	}
+
+	// A failed probe re-opens the breaker
+	*now = now.Add(time.Minute)
+	if s.State() != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be half-open; got %s", s.State())
+	}
+	s.Store(&tracer.Record{TraceId: "abcd"}, 0)
+	if s.State() != BreakerOpen || backend.callCount() != 4 {
+		t.Fatalf("Expected a single failed probe to re-open the breaker; got %s after %d calls", s.State(), backend.callCount())
+	}
+
+	// A successful probe closes the breaker and replays the spooled records
+	*now = now.Add(time.Minute)
+	backend.setFailing(false)
+	err := s.Store(&tracer.Record{TraceId: "abcd"}, 0)
+	if err != nil {
+		t.Fatalf("Expected probe to succeed; got %v", err)
+	}
+	if s.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to be closed; got %s", s.State())
+	}
+	waitForTrace(t, backend, "abcd", 6)
+}
+
+func TestResilientStorageSpool(t *testing.T) {
+	backend := &flakyStorage{memoryStorage: newMemoryStorage(), failing: true}
+	s, now, _ := newTestResilient(backend)
+	s.SetRetries(0, 0, 0)
+	s.SetCircuitBreaker(1, time.Minute)
+	s.SetSpool(NewMemorySpool(4))
+	var dropped []error
+	var droppedIds []string
+	s.OnDrop(func(rec *tracer.Record, err error) {
+		dropped = append(dropped, err)
+		droppedIds = append(droppedIds, rec.TraceId)
+	})
+	defer s.Close()
+
+	s.Store(&tracer.Record{TraceId: "expired"}, 30*time.Second)
+	s.Store(&tracer.Record{TraceId: "almost-expired"}, time.Minute+500*time.Millisecond)
+	s.Store(&tracer.Record{TraceId: "kept"}, time.Hour)
+	s.Store(&tracer.Record{TraceId: "sub-second"}, 500*time.Millisecond)
+	err := s.Store(&tracer.Record{TraceId: "dropped"}, 0)
+	if err != ErrSpoolFull {
+		t.Fatalf("Expected ErrSpoolFull; got %v", err)
+	}
+	if len(dropped) != 1 || dropped[0] != ErrSpoolFull {
+		t.Fatalf("Expected drop callback to be invoked with ErrSpoolFull; got %v", dropped)
+	}
+
+	// Records whose TTL expired (or has a second or less left) while spooled are
+	// dropped instead of being replayed. Records spooled with a sub-second TTL are
+	// still replayed
+	*now = now.Add(time.Minute)
+	backend.setFailing(false)
+	s.Store(&tracer.Record{TraceId: "kept"}, time.Hour)
+	waitForTrace(t, backend, "kept", 2)
+	waitForTrace(t, backend, "sub-second", 1)
+	for _, traceId := range []string{"expired", "almost-expired"} {
+		if trace, _ := backend.GetTrace(traceId); len(trace) != 0 {
+			t.Fatalf("Expected record %s not to be replayed", traceId)
+		}
+	}
+	if len(droppedIds) != 3 || droppedIds[1] != "expired" || droppedIds[2] != "almost-expired" {
+		t.Fatalf("Expected expired records to be reported as dropped; got %v", droppedIds)
+	}
+	if dropped[1] != ErrRecordExpired || dropped[2] != ErrRecordExpired {
+		t.Fatalf("Expected drop callback to be invoked with ErrRecordExpired; got %v", dropped)
+	}
+}
+
+func TestDiskSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := NewDiskSpool(dir, 2)
+	if err != nil {
+		t.Fatalf("Error creating disk spool: %v", err)
+	}
+	now := time.Unix(1436818515, 0).UTC()
+	for _, traceId := range []string{"1", "2", "3"} {
+		err = spool.Push(SpoolEntry{Record: tracer.Record{TraceId: traceId}, TTL: time.Hour, SpooledAt: now})
+		if traceId == "3" && err != ErrSpoolFull {
+			t.Fatalf("Expected ErrSpoolFull; got %v", err)
+		} else if traceId != "3" && err != nil {
+			t.Fatalf("Error pushing entry: %v", err)
+		}
+	}
+	spool.Close()
+
+	// Entries should survive re-opening the spool
+	spool, err = NewDiskSpool(dir, 2)
+	if err != nil {
+		t.Fatalf("Error re-opening disk spool: %v", err)
+	}
+	if spool.Len() != 2 {
+		t.Fatalf("Expected spool to contain 2 entries; got %d", spool.Len())
+	}
+	for _, traceId := range []string{"1", "2"} {
+		entry, ok, err := spool.Peek()
+		if err != nil || !ok {
+			t.Fatalf("Error peeking entry: %v", err)
+		}
+		if entry.Record.TraceId != traceId || entry.TTL != time.Hour || !entry.SpooledAt.Equal(now) {
+			t.Fatalf("Expected entry for trace %s; got %v", traceId, entry)
+		}
+		err = spool.Remove()
+		if err != nil {
+			t.Fatalf("Error removing entry: %v", err)
+		}
+	}
+	if _, ok, _ := spool.Peek(); ok {
+		t.Fatalf("Expected spool to be empty")
+	}
+}
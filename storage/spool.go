@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+var (
+	ErrSpoolFull = errors.New("spool: spool is full")
+)
+
+// A SpoolEntry contains a trace record that could not be stored together with the
+// details required for replaying it.
+type SpoolEntry struct {
+	Record tracer.Record `json:"record"`
+
+	// The TTL requested for the record and the time the record was spooled.
+	TTL       time.Duration `json:"ttl"`
+	SpooledAt time.Time     `json:"spooled_at"`
+}
+
+// The Spool interface is implemented by bounded FIFO buffers that hold trace
+// records while a storage backend is unavailable. Implementations must be safe
+// for concurrent use.
+type Spool interface {
+	// Append an entry to the spool. Returns ErrSpoolFull if the spool is full.
+	Push(entry SpoolEntry) error
+
+	// Get the oldest entry without removing it. The second return value is false
+	// if the spool is empty.
+	Peek() (SpoolEntry, bool, error)
+
+	// Remove the oldest entry.
+	Remove() error
+
+	// Get the number of spooled entries.
+	Len() int
+
+	// Release any resources held by the spool.
+	Close() error
+}
+
+// A Spool that keeps entries in memory.
+type memorySpool struct {
+	sync.Mutex
+	entries []SpoolEntry
+	size    int
+}
+
+// Create a Spool that keeps up to size entries in memory.
+func NewMemorySpool(size int) Spool {
+	return &memorySpool{
+		entries: make([]SpoolEntry, 0),
+		size:    size,
+	}
+}
+
+func (s *memorySpool) Push(entry SpoolEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.entries) >= s.size {
+		return ErrSpoolFull
+	}
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memorySpool) Peek() (SpoolEntry, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.entries) == 0 {
+		return SpoolEntry{}, false, nil
+	}
+	return s.entries[0], true, nil
+}
+
+func (s *memorySpool) Remove() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.entries) > 0 {
+		s.entries[0] = SpoolEntry{}
+		s.entries = s.entries[1:]
+	}
+	return nil
+}
+
+func (s *memorySpool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.entries)
+}
+
+func (s *memorySpool) Close() error {
+	return nil
+}
+
+// The file extension used by disk spool entries.
+const spoolFileExt = ".spool"
+
+// A Spool that stores each entry as a separate file in a directory. Entries are
+// named after a monotonically increasing sequence number so they survive process
+// restarts and are replayed in order. Entries are synced to disk before Push
+// returns so they also survive crashes. Removals are not synced; an entry removed
+// shortly before a crash may be replayed again.
+type diskSpool struct {
+	sync.Mutex
+	dir  string
+	size int
+
+	// The sequence numbers of the spooled entries in ascending order.
+	seqs    []uint64
+	nextSeq uint64
+}
+
+// Create a Spool that keeps up to size entries in the supplied directory. The
+// directory is created if it does not exist. Entries left over by a previous
+// process are loaded so they can be replayed.
+func NewDiskSpool(dir string, size int) (Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &diskSpool{
+		dir:  dir,
+		size: size,
+		seqs: make([]uint64, 0),
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.seqs = append(s.seqs, seq)
+	}
+	sort.Sort(seqList(s.seqs))
+	if len(s.seqs) > 0 {
+		s.nextSeq = s.seqs[len(s.seqs)-1] + 1
+	}
+
+	return s, nil
+}
+
+func (s *diskSpool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileExt))
+}
+
+func (s *diskSpool) Push(entry SpoolEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.seqs) >= s.size {
+		return ErrSpoolFull
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it so partially written entries are never loaded
+	seq := s.nextSeq
+	tmpFile := s.path(seq) + ".tmp"
+	err = writeFileSync(tmpFile, data, 0600)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	err = os.Rename(tmpFile, s.path(seq))
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	// Sync the directory so the rename is persisted
+	err = syncDir(s.dir)
+	if err != nil {
+		os.Remove(s.path(seq))
+		return err
+	}
+
+	s.nextSeq++
+	s.seqs = append(s.seqs, seq)
+	return nil
+}
+
+func (s *diskSpool) Peek() (SpoolEntry, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var entry SpoolEntry
+	if len(s.seqs) == 0 {
+		return entry, false, nil
+	}
+
+	data, err := ioutil.ReadFile(s.path(s.seqs[0]))
+	if err != nil {
+		return entry, false, err
+	}
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return entry, false, err
+	}
+	return entry, true, nil
+}
+
+func (s *diskSpool) Remove() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.seqs) == 0 {
+		return nil
+	}
+	err := os.Remove(s.path(s.seqs[0]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.seqs = s.seqs[1:]
+	return nil
+}
+
+func (s *diskSpool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.seqs)
+}
+
+func (s *diskSpool) Close() error {
+	return nil
+}
+
+// Write data to a file and sync it to disk before closing it.
+func writeFileSync(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync a directory so that entries created or renamed in it are persisted.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Sort sequence numbers. Implements sort.Interface
+type seqList []uint64
+
+func (l seqList) Len() int {
+	return len(l)
+}
+
+func (l seqList) Less(i, j int) bool {
+	return l[i] < l[j]
+}
+
+func (l seqList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
@@ -0,0 +1,232 @@
+package tracer_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/achilleasa/usrv-tracer"
+	"github.com/achilleasa/usrv-tracer/storage"
+)
+
+// A storage whose methods block until the release channel is closed.
+type blockingStorage struct {
+	release chan struct{}
+}
+
+func (s *blockingStorage) Dial() error {
+	<-s.release
+	return nil
+}
+
+func (s *blockingStorage) Store(logEntry *tracer.Record, ttl time.Duration) error {
+	<-s.release
+	return nil
+}
+
+func (s *blockingStorage) GetTrace(traceId string) (tracer.Trace, error) {
+	<-s.release
+	return tracer.Trace{}, nil
+}
+
+func (s *blockingStorage) GetDependencies(srvFilter ...string) ([]tracer.Dependencies, error) {
+	<-s.release
+	return []tracer.Dependencies{}, nil
+}
+
+func (s *blockingStorage) GetDependents(srvFilter ...string) ([]tracer.Dependencies, error) {
+	<-s.release
+	return []tracer.Dependencies{}, nil
+}
+
+func (s *blockingStorage) Close() {}
+
+// A storage that natively implements the ContextStorage interface.
+type nativeContextStorage struct {
+	blockingStorage
+}
+
+func (s *nativeContextStorage) DialContext(ctx context.Context) error {
+	return nil
+}
+
+func (s *nativeContextStorage) StoreContext(ctx context.Context, logEntry *tracer.Record, ttl time.Duration) error {
+	return nil
+}
+
+func (s *nativeContextStorage) GetTraceContext(ctx context.Context, traceId string) (tracer.Trace, error) {
+	return nil, nil
+}
+
+func (s *nativeContextStorage) GetDependenciesContext(ctx context.Context, srvFilter ...string) ([]tracer.Dependencies, error) {
+	return nil, nil
+}
+
+func (s *nativeContextStorage) GetDependentsContext(ctx context.Context, srvFilter ...string) ([]tracer.Dependencies, error) {
+	return nil, nil
+}
+
+// A ContextStorage whose store operations block until their context is done.
+type blockingContextStorage struct {
+	nativeContextStorage
+}
+
+func (s *blockingContextStorage) StoreContext(ctx context.Context, logEntry *tracer.Record, ttl time.Duration) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestContextStorageAdapter(t *testing.T) {
+	backend := &blockingStorage{release: make(chan struct{})}
+	defer close(backend.release)
+	ctxStorage := tracer.NewContextStorage(backend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := ctxStorage.DialContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected DialContext to return context.DeadlineExceeded; got %v", err)
+	}
+	err = ctxStorage.StoreContext(ctx, &tracer.Record{}, 0)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected StoreContext to return context.DeadlineExceeded; got %v", err)
+	}
+	trace, err := ctxStorage.GetTraceContext(ctx, "trace")
+	if err != context.DeadlineExceeded || trace != nil {
+		t.Fatalf("Expected GetTraceContext to return context.DeadlineExceeded and a nil trace; got %v, %v", trace, err)
+	}
+
+	// Canceled contexts should fail without invoking the storage
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	deps, err := ctxStorage.GetDependenciesContext(cancelCtx)
+	if err != context.Canceled || deps != nil {
+		t.Fatalf("Expected GetDependenciesContext to return context.Canceled and nil deps; got %v, %v", deps, err)
+	}
+}
+
+func TestContextStorageAdapterCompletes(t *testing.T) {
+	ctxStorage := tracer.NewContextStorage(storage.Memory)
+	defer ctxStorage.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ctxStorage.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &tracer.Record{Type: tracer.Request, From: "com.service1", To: "com.service2", TraceId: "trace", Timestamp: time.Now()}
+	err = ctxStorage.StoreContext(ctx, rec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contexts without a deadline should also work
+	trace, err := ctxStorage.GetTraceContext(context.Background(), "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 1 {
+		t.Fatalf("Expected trace to contain 1 record; got %d", len(trace))
+	}
+
+	deps, err := ctxStorage.GetDependenciesContext(ctx, "com.service1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || len(deps[0].Dependencies) != 1 || deps[0].Dependencies[0] != "com.service2" {
+		t.Fatalf("Unexpected dependencies: %v", deps)
+	}
+
+	dependents, err := ctxStorage.GetDependentsContext(ctx, "com.service2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dependents) != 1 || len(dependents[0].Dependencies) != 1 || dependents[0].Dependencies[0] != "com.service1" {
+		t.Fatalf("Unexpected dependents: %v", dependents)
+	}
+}
+
+func TestNewContextStorageNative(t *testing.T) {
+	native := &nativeContextStorage{}
+	if tracer.NewContextStorage(native) != native {
+		t.Fatalf("Expected storages implementing ContextStorage to be returned as is")
+	}
+}
+
+func TestCollectorStoreTimeout(t *testing.T) {
+	collector, err := tracer.NewCollector(storage.Memory, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	defer collector.Storage.Close()
+
+	collector.Storage = &blockingContextStorage{}
+	collector.SetStoreTimeout(10 * time.Millisecond)
+
+	wait := make(chan struct{}, 10)
+	collector.OnTraceAdded = func(rec *tracer.Record) {
+		wait <- struct{}{}
+	}
+
+	// The collector should give up on the blocked storage and release its token
+	for i := 0; i < 2; i++ {
+		if !collector.Add(&tracer.Record{TraceId: "trace"}) {
+			t.Fatalf("Expected trace #%d to be successfully queued", i)
+		}
+
+		select {
+		case <-wait:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("trace #%d was not handled after 5 sec", i)
+		}
+
+		// Wait for the token to be returned
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollectorStoreTimeoutWithoutContextStorage(t *testing.T) {
+	collector, err := tracer.NewCollector(storage.Memory, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	defer collector.Storage.Close()
+
+	backend := &blockingStorage{release: make(chan struct{})}
+	collector.Storage = backend
+	collector.SetStoreTimeout(10 * time.Millisecond)
+
+	wait := make(chan struct{}, 10)
+	collector.OnTraceAdded = func(rec *tracer.Record) {
+		wait <- struct{}{}
+	}
+
+	// The storage cannot abort the store operation so the collector should hold
+	// on to its token until the operation completes
+	if !collector.Add(&tracer.Record{TraceId: "trace"}) {
+		t.Fatalf("Expected trace to be successfully queued")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if collector.Add(&tracer.Record{TraceId: "trace"}) {
+		t.Fatalf("Expected trace to be discarded while the store operation is pending")
+	}
+
+	close(backend.release)
+	select {
+	case <-wait:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("trace was not handled after 5 sec")
+	}
+
+	// Wait for the token to be returned
+	time.Sleep(10 * time.Millisecond)
+	if !collector.Add(&tracer.Record{TraceId: "trace"}) {
+		t.Fatalf("Expected trace to be successfully queued once the store operation completed")
+	}
+	<-wait
+}
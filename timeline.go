@@ -0,0 +1,300 @@
+package tracer
+
+import (
+	"sort"
+	"time"
+)
+
+// A TimelineSpan describes a call of a trace and its position on the trace timeline.
+type TimelineSpan struct {
+	CorrelationId string `json:"correlation_id"`
+
+	// The correlation id of the call that invoked this call. It is empty for root calls.
+	Parent string `json:"parent,omitempty"`
+
+	// The caller and the called service.
+	From string `json:"from"`
+	To   string `json:"to"`
+	Host string `json:"host"`
+
+	// The start and end of the call relative to the start of the trace.
+	Start    time.Duration `json:"start"`
+	End      time.Duration `json:"end"`
+	Duration time.Duration `json:"duration"`
+
+	// The nesting level of the call. Root calls have a depth of 0.
+	Depth int `json:"depth"`
+
+	// True if the response of the call has not been recorded yet. Pending calls
+	// extend to the end of the trace.
+	Pending bool `json:"pending"`
+
+	// The category of the error returned by the call.
+	ErrorCategory ErrorCategory `json:"error_category,omitempty"`
+}
+
+// A Timeline positions the calls of a trace on a common time axis.
+type Timeline struct {
+	// The timestamp of the earliest trace record and the trace duration.
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	// The spans ordered so that each span is followed by the spans of the calls it
+	// invoked (sorted by start time).
+	Spans []TimelineSpan `json:"spans"`
+}
+
+// A FlameNode aggregates the calls that share the same call path. The root node
+// represents the entire trace.
+type FlameNode struct {
+	// The called service.
+	Name string `json:"name"`
+
+	// The number of aggregated calls and their total duration.
+	Calls int           `json:"calls"`
+	Total time.Duration `json:"total"`
+
+	// The time spent by the service itself rather than waiting for the calls it invoked.
+	Self time.Duration `json:"self"`
+
+	Children []*FlameNode `json:"children"`
+}
+
+// Convert the request/response pairs of a trace into timeline spans. Calls are
+// described by their server records; calls that were only traced by the client
+// (e.g. calls to services that do not emit trace records) are described by their
+// client records. Responses without a matching request start at the response
+// timestamp minus the call duration.
+//
+// Trace records do not reference the call that invoked them so the parent of each
+// call is inferred: it is the latest call served by the caller that started before
+// the call and was still in progress (or pending) when the call started.
+func (t Trace) Timeline() Timeline {
+	timeline := Timeline{Spans: make([]TimelineSpan, 0)}
+
+	// Pair requests and responses; server records take precedence over client records
+	type callRecords struct {
+		kind     Kind
+		req, res *Record
+	}
+	calls := make(map[string]*callRecords)
+	order := make([]string, 0)
+	var start, end time.Time
+	for index := range t {
+		rec := &t[index]
+		if rec.Type != Request && rec.Type != Response {
+			continue
+		}
+		if start.IsZero() || rec.Timestamp.Before(start) {
+			start = rec.Timestamp
+		}
+		if rec.Timestamp.After(end) {
+			end = rec.Timestamp
+		}
+
+		c, exists := calls[rec.CorrelationId]
+		if !exists {
+			c = &callRecords{kind: rec.Kind}
+			calls[rec.CorrelationId] = c
+			order = append(order, rec.CorrelationId)
+		}
+		if c.kind != rec.Kind {
+			if rec.Kind != Server {
+				continue
+			}
+			*c = callRecords{kind: Server}
+		}
+		if rec.Type == Request {
+			c.req = rec
+		} else {
+			c.res = rec
+		}
+	}
+	if len(calls) == 0 {
+		return timeline
+	}
+	timeline.Start = start
+	timeline.Duration = end.Sub(start)
+
+	spans := make([]*TimelineSpan, 0, len(calls))
+	for _, corrId := range order {
+		c := calls[corrId]
+		span := &TimelineSpan{CorrelationId: corrId}
+		switch {
+		case c.req != nil && c.res != nil:
+			span.Start = c.req.Timestamp.Sub(start)
+			span.End = c.res.Timestamp.Sub(start)
+		case c.req != nil:
+			span.Start = c.req.Timestamp.Sub(start)
+			span.End = timeline.Duration
+			span.Pending = true
+		default:
+			span.End = c.res.Timestamp.Sub(start)
+			span.Start = span.End - time.Duration(c.res.Duration)
+		}
+		if span.End < span.Start {
+			span.End = span.Start
+		}
+		span.Duration = span.End - span.Start
+
+		if c.req != nil {
+			span.From, span.To, span.Host = c.req.From, c.req.To, c.req.Host
+		} else {
+			span.From, span.To, span.Host = c.res.To, c.res.From, c.res.Host
+		}
+		if c.res != nil {
+			span.ErrorCategory = c.res.ErrorCategory()
+		}
+		spans = append(spans, span)
+	}
+	sort.Stable(spansByStart(spans))
+
+	// Infer the parent of each span
+	children := make(map[string][]*TimelineSpan)
+	roots := make([]*TimelineSpan, 0)
+	served := make(map[string][]*TimelineSpan)
+	for _, span := range spans {
+		var parent *TimelineSpan
+		for _, candidate := range served[span.From] {
+			if candidate.Start <= span.Start && (candidate.End >= span.Start || candidate.Pending) {
+				parent = candidate
+			}
+		}
+		if parent != nil {
+			span.Parent = parent.CorrelationId
+			children[parent.CorrelationId] = append(children[parent.CorrelationId], span)
+		} else {
+			roots = append(roots, span)
+		}
+		served[span.To] = append(served[span.To], span)
+	}
+
+	// Order spans depth-first
+	var visit func(span *TimelineSpan, depth int)
+	visit = func(span *TimelineSpan, depth int) {
+		span.Depth = depth
+		timeline.Spans = append(timeline.Spans, *span)
+		for _, child := range children[span.CorrelationId] {
+			visit(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		visit(root, 0)
+	}
+
+	return timeline
+}
+
+// Aggregate the timeline spans into a flame graph. Spans are merged when the
+// services along their call path are the same. The self time of a span is its
+// duration minus the time covered by the calls it invoked; calls that run in
+// parallel are only accounted for once.
+func (tl Timeline) FlameGraph() *FlameNode {
+	root := &FlameNode{
+		Total:    tl.Duration,
+		Children: make([]*FlameNode, 0),
+	}
+
+	children := make(map[string][]TimelineSpan)
+	for _, span := range tl.Spans {
+		if span.Parent != "" {
+			children[span.Parent] = append(children[span.Parent], span)
+		}
+	}
+
+	// Spans are ordered depth-first so the parent of each span has already been
+	// assigned a flame node
+	nodes := make(map[string]*FlameNode)
+	rootSpans := make([]TimelineSpan, 0)
+	for _, span := range tl.Spans {
+		parent := root
+		if span.Parent != "" {
+			parent = nodes[span.Parent]
+		} else {
+			rootSpans = append(rootSpans, span)
+		}
+
+		var node *FlameNode
+		for _, child := range parent.Children {
+			if child.Name == span.To {
+				node = child
+				break
+			}
+		}
+		if node == nil {
+			node = &FlameNode{Name: span.To, Children: make([]*FlameNode, 0)}
+			parent.Children = append(parent.Children, node)
+		}
+		node.Calls++
+		node.Total += span.Duration
+		node.Self += selfTime(span.Duration, children[span.CorrelationId])
+		nodes[span.CorrelationId] = node
+	}
+	root.Calls = len(rootSpans)
+	root.Self = selfTime(root.Total, rootSpans)
+
+	return root
+}
+
+// Calculate the part of a duration that is not covered by a set of child spans.
+// Overlapping child spans are only accounted for once.
+func selfTime(duration time.Duration, children []TimelineSpan) time.Duration {
+	self := duration - coveredTime(children)
+	if self < 0 {
+		return 0
+	}
+	return self
+}
+
+// Calculate the time covered by a set of spans counting overlapping intervals once.
+func coveredTime(spans []TimelineSpan) time.Duration {
+	if len(spans) == 0 {
+		return 0
+	}
+	sorted := append([]TimelineSpan(nil), spans...)
+	sort.Stable(spanValuesByStart(sorted))
+
+	total := time.Duration(0)
+	start, end := sorted[0].Start, sorted[0].End
+	for _, span := range sorted[1:] {
+		if span.Start > end {
+			total += end - start
+			start, end = span.Start, span.End
+			continue
+		}
+		if span.End > end {
+			end = span.End
+		}
+	}
+	return total + end - start
+}
+
+// Sort spans by start time. Implements sort.Interface
+type spansByStart []*TimelineSpan
+
+func (s spansByStart) Len() int {
+	return len(s)
+}
+
+func (s spansByStart) Less(i, j int) bool {
+	return s[i].Start < s[j].Start
+}
+
+func (s spansByStart) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Sort span values by start time. Implements sort.Interface
+type spanValuesByStart []TimelineSpan
+
+func (s spanValuesByStart) Len() int {
+	return len(s)
+}
+
+func (s spanValuesByStart) Less(i, j int) bool {
+	return s[i].Start < s[j].Start
+}
+
+func (s spanValuesByStart) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,151 @@
+package tracer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+// com.a calls com.b which calls com.c twice in parallel and then calls com.d.
+// The call to com.d has not finished yet.
+func timelineTrace() tracer.Trace {
+	now := time.Now()
+	at := func(ms int) time.Time {
+		return now.Add(time.Duration(ms) * time.Millisecond)
+	}
+	return tracer.Trace{
+		{Type: tracer.Request, From: "com.a", To: "com.b", Timestamp: at(0), CorrelationId: "1"},
+		{Type: tracer.Request, From: "com.b", To: "com.c", Timestamp: at(10), CorrelationId: "2"},
+		{Type: tracer.Request, From: "com.b", To: "com.c", Timestamp: at(20), CorrelationId: "3"},
+		{Type: tracer.Response, From: "com.c", To: "com.b", Timestamp: at(40), CorrelationId: "2", ErrorInfo: &tracer.ErrorInfo{Category: tracer.CategoryTimeout}},
+		{Type: tracer.Response, From: "com.c", To: "com.b", Timestamp: at(50), CorrelationId: "3"},
+		// Client records are ignored when server records are available
+		{Type: tracer.Request, Kind: tracer.Client, From: "com.b", To: "com.d", Timestamp: at(59), CorrelationId: "4"},
+		{Type: tracer.Request, From: "com.b", To: "com.d", Timestamp: at(60), CorrelationId: "4"},
+		{Type: tracer.Response, From: "com.b", To: "com.a", Timestamp: at(100), CorrelationId: "1"},
+		tracer.NewTruncationMarker("trace", 8),
+	}
+}
+
+func TestTraceTimeline(t *testing.T) {
+	timeline := timelineTrace().Timeline()
+
+	if timeline.Duration != 100*time.Millisecond {
+		t.Fatalf("Expected timeline duration to be 100ms; got %s", timeline.Duration)
+	}
+
+	type spec struct {
+		corrId  string
+		parent  string
+		start   time.Duration
+		end     time.Duration
+		depth   int
+		pending bool
+		errCat  tracer.ErrorCategory
+	}
+	specs := []spec{
+		{"1", "", 0, 100 * time.Millisecond, 0, false, ""},
+		{"2", "1", 10 * time.Millisecond, 40 * time.Millisecond, 1, false, tracer.CategoryTimeout},
+		{"3", "1", 20 * time.Millisecond, 50 * time.Millisecond, 1, false, ""},
+		{"4", "1", 60 * time.Millisecond, 100 * time.Millisecond, 1, true, ""},
+	}
+	if len(timeline.Spans) != len(specs) {
+		t.Fatalf("Expected %d spans; got %d", len(specs), len(timeline.Spans))
+	}
+	for index, s := range specs {
+		span := timeline.Spans[index]
+		if span.CorrelationId != s.corrId || span.Parent != s.parent {
+			t.Fatalf("[span %d] Expected span %s with parent %q; got span %s with parent %q", index, s.corrId, s.parent, span.CorrelationId, span.Parent)
+		}
+		if span.Start != s.start || span.End != s.end || span.Duration != s.end-s.start {
+			t.Fatalf("[span %d] Expected span to start at %s and end at %s; got %s - %s", index, s.start, s.end, span.Start, span.End)
+		}
+		if span.Depth != s.depth {
+			t.Fatalf("[span %d] Expected depth %d; got %d", index, s.depth, span.Depth)
+		}
+		if span.Pending != s.pending {
+			t.Fatalf("[span %d] Expected pending to be %t", index, s.pending)
+		}
+		if span.ErrorCategory != s.errCat {
+			t.Fatalf("[span %d] Expected error category %q; got %q", index, s.errCat, span.ErrorCategory)
+		}
+	}
+
+	if len(tracer.Trace{}.Timeline().Spans) != 0 {
+		t.Fatal("Expected empty trace to have no spans")
+	}
+}
+
+func TestTraceTimelineUnmatchedResponse(t *testing.T) {
+	now := time.Now()
+	timeline := tracer.Trace{
+		{Type: tracer.Request, From: "com.a", To: "com.b", Timestamp: now, CorrelationId: "1"},
+		{Type: tracer.Response, From: "com.c", To: "com.b", Timestamp: now.Add(30 * time.Millisecond), CorrelationId: "2", Duration: int64(20 * time.Millisecond)},
+		{Type: tracer.Response, From: "com.b", To: "com.a", Timestamp: now.Add(40 * time.Millisecond), CorrelationId: "1"},
+	}.Timeline()
+
+	span := timeline.Spans[1]
+	if span.From != "com.b" || span.To != "com.c" || span.Parent != "1" {
+		t.Fatalf("Unexpected span: %+v", span)
+	}
+	if span.Start != 10*time.Millisecond || span.End != 30*time.Millisecond {
+		t.Fatalf("Expected span to start at 10ms and end at 30ms; got %s - %s", span.Start, span.End)
+	}
+}
+
+func TestTraceTimelineSequentialCalls(t *testing.T) {
+	now := time.Now()
+	at := func(ms int) time.Time {
+		return now.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	// com.b serves two sequential calls from com.a; com.b calls com.c while serving
+	// the second call
+	timeline := tracer.Trace{
+		{Type: tracer.Request, From: "com.a", To: "com.b", Timestamp: at(0), CorrelationId: "1"},
+		{Type: tracer.Response, From: "com.b", To: "com.a", Timestamp: at(10), CorrelationId: "1"},
+		{Type: tracer.Request, From: "com.a", To: "com.b", Timestamp: at(20), CorrelationId: "2"},
+		{Type: tracer.Request, From: "com.b", To: "com.c", Timestamp: at(25), CorrelationId: "3"},
+		{Type: tracer.Response, From: "com.c", To: "com.b", Timestamp: at(30), CorrelationId: "3"},
+		{Type: tracer.Response, From: "com.b", To: "com.a", Timestamp: at(40), CorrelationId: "2"},
+		// A call made by com.b after it has finished serving all calls has no parent
+		{Type: tracer.Request, From: "com.b", To: "com.d", Timestamp: at(50), CorrelationId: "4"},
+		{Type: tracer.Response, From: "com.d", To: "com.b", Timestamp: at(60), CorrelationId: "4"},
+	}.Timeline()
+
+	expParents := map[string]string{"1": "", "2": "", "3": "2", "4": ""}
+	if len(timeline.Spans) != len(expParents) {
+		t.Fatalf("Expected %d spans; got %d", len(expParents), len(timeline.Spans))
+	}
+	for _, span := range timeline.Spans {
+		if span.Parent != expParents[span.CorrelationId] {
+			t.Fatalf("Expected span %s to have parent %q; got %q", span.CorrelationId, expParents[span.CorrelationId], span.Parent)
+		}
+	}
+}
+
+func TestTimelineFlameGraph(t *testing.T) {
+	root := timelineTrace().Timeline().FlameGraph()
+
+	if root.Total != 100*time.Millisecond || root.Self != 0 || root.Calls != 1 {
+		t.Fatalf("Unexpected root node: %+v", root)
+	}
+	if len(root.Children) != 1 {
+		t.Fatalf("Expected 1 root call; got %d", len(root.Children))
+	}
+
+	b := root.Children[0]
+	// com.b waits for com.c between 10ms and 50ms and for com.d between 60ms and 100ms
+	if b.Name != "com.b" || b.Calls != 1 || b.Total != 100*time.Millisecond || b.Self != 20*time.Millisecond {
+		t.Fatalf("Unexpected com.b node: %+v", b)
+	}
+	if len(b.Children) != 2 {
+		t.Fatalf("Expected com.b to have 2 children; got %d", len(b.Children))
+	}
+
+	c := b.Children[0]
+	if c.Name != "com.c" || c.Calls != 2 || c.Total != 60*time.Millisecond || c.Self != 60*time.Millisecond {
+		t.Fatalf("Unexpected com.c node: %+v", c)
+	}
+}
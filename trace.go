@@ -8,6 +8,19 @@ type TraceType string
 const (
 	Request  TraceType = "REQ"
 	Response TraceType = "RES"
+
+	// A marker that is stored by storage engines in place of the records of a
+	// trace that exceed the per-trace record cap.
+	Truncated TraceType = "TRUNCATED"
+)
+
+type Kind string
+
+// The kinds of components that emit trace records. Records emitted by the Tracer
+// middleware do not specify a kind and are treated as Server records.
+const (
+	Server Kind = ""
+	Client Kind = "CLIENT"
 )
 
 // The ServiceDependencies describes a service and its dependencies.
@@ -23,11 +36,24 @@ type Record struct {
 	TraceId       string    `json:"trace_id"`
 	CorrelationId string    `json:"correlation_id"`
 	Type          TraceType `json:"type"`
+	Kind          Kind      `json:"kind,omitempty"`
 	From          string    `json:"from"`
 	To            string    `json:"to"`
 	Host          string    `json:"host"`
 	Duration      int64     `json:"duration,omitempty"`
 	Error         string    `json:"error,omitempty"`
+
+	// The classification of the reported error.
+	ErrorInfo *ErrorInfo `json:"error_info,omitempty"`
+
+	// The size (in bytes) of the request or response payload and, optionally, a
+	// fingerprint and a truncated preview of its contents.
+	PayloadSize    int64  `json:"payload_size,omitempty"`
+	PayloadHash    string `json:"payload_hash,omitempty"`
+	PayloadPreview string `json:"payload_preview,omitempty"`
+
+	// Optional key/value pairs with additional record details.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // A Trace is a list of TraceLog entries.
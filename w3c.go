@@ -0,0 +1,132 @@
+package tracer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The header names defined by the W3C Trace Context specification.
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+)
+
+// The flag that indicates that the caller has recorded the trace.
+const TraceFlagSampled byte = 0x01
+
+var (
+	ErrInvalidTraceParent = errors.New("tracer: invalid traceparent header")
+)
+
+// A TraceParent contains the details of a W3C traceparent header.
+type TraceParent struct {
+	// The 128-bit trace id as a 32-character lower-case hex string.
+	TraceId string
+
+	// The 64-bit id of the caller as a 16-character lower-case hex string.
+	ParentId string
+
+	// The trace flags.
+	Flags byte
+}
+
+// Parse a traceparent header value. Only version 00 of the specification is fully
+// supported; for future versions, the fields defined by version 00 are parsed and
+// any additional fields are ignored as mandated by the specification.
+func ParseTraceParent(val string) (*TraceParent, error) {
+	val = strings.TrimSpace(val)
+	parts := strings.Split(val, "-")
+	if len(parts) < 4 {
+		return nil, ErrInvalidTraceParent
+	}
+
+	version, traceId, parentId, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || !isLowerHex(version) || version == "ff" {
+		return nil, ErrInvalidTraceParent
+	}
+	if version == "00" && len(parts) != 4 {
+		return nil, ErrInvalidTraceParent
+	}
+	if len(traceId) != 32 || !isLowerHex(traceId) || strings.Trim(traceId, "0") == "" {
+		return nil, ErrInvalidTraceParent
+	}
+	if len(parentId) != 16 || !isLowerHex(parentId) || strings.Trim(parentId, "0") == "" {
+		return nil, ErrInvalidTraceParent
+	}
+	if len(flags) != 2 || !isLowerHex(flags) {
+		return nil, ErrInvalidTraceParent
+	}
+
+	flagBytes, _ := hex.DecodeString(flags)
+	return &TraceParent{
+		TraceId:  traceId,
+		ParentId: parentId,
+		Flags:    flagBytes[0],
+	}, nil
+}
+
+// Create a TraceParent for a trace id used by trace records. The parent id is
+// randomly generated.
+func NewTraceParent(traceId string) *TraceParent {
+	return &TraceParent{
+		TraceId:  W3CTraceId(traceId),
+		ParentId: newParentId(),
+		Flags:    TraceFlagSampled,
+	}
+}
+
+// Format the TraceParent as a version 00 traceparent header value.
+func (p *TraceParent) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", p.TraceId, p.ParentId, p.Flags)
+}
+
+// Get the trace id in the format used by trace records.
+func (p *TraceParent) RecordTraceId() string {
+	return RecordTraceId(p.TraceId)
+}
+
+// Convert a 32-character W3C trace id to the UUID format used by trace records.
+func RecordTraceId(w3cTraceId string) string {
+	raw, err := hex.DecodeString(w3cTraceId)
+	if err != nil || len(raw) != 16 {
+		return w3cTraceId
+	}
+	return unpackUUID(raw)
+}
+
+// Convert a trace id used by trace records into a 128-bit W3C trace id. UUIDs
+// are converted losslessly. Any other trace id is hashed so the same trace id
+// is always mapped to the same W3C trace id.
+func W3CTraceId(traceId string) string {
+	if raw, ok := packUUID(strings.ToLower(traceId)); ok && strings.Trim(hex.EncodeToString(raw), "0") != "" {
+		return hex.EncodeToString(raw)
+	}
+
+	sum := sha256.Sum256([]byte(traceId))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Generate a random, non-zero parent id.
+func newParentId() string {
+	b := make([]byte, 8)
+	for {
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+		if strings.Trim(id, "0") != "" {
+			return id
+		}
+	}
+}
+
+func isLowerHex(val string) bool {
+	for _, c := range val {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
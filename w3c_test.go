@@ -0,0 +1,83 @@
+package tracer_test
+
+import (
+	"testing"
+
+	"github.com/achilleasa/usrv-tracer"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	type spec struct {
+		input    string
+		expected *tracer.TraceParent
+	}
+
+	testCases := []spec{
+		{
+			input:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expected: &tracer.TraceParent{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", ParentId: "00f067aa0ba902b7", Flags: 0x01},
+		},
+		{
+			input:    "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future",
+			expected: &tracer.TraceParent{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", ParentId: "00f067aa0ba902b7", Flags: 0x00},
+		},
+		{input: ""},
+		{input: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{input: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{input: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{input: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{input: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{input: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+	}
+
+	for index, testCase := range testCases {
+		parent, err := tracer.ParseTraceParent(testCase.input)
+		if testCase.expected == nil {
+			if err != tracer.ErrInvalidTraceParent {
+				t.Fatalf("[case %d] expected error %v; got %v", index, tracer.ErrInvalidTraceParent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[case %d] error parsing traceparent: %v", index, err)
+		}
+		if *parent != *testCase.expected {
+			t.Fatalf("[case %d] expected parsed traceparent to be %v; got %v", index, testCase.expected, parent)
+		}
+	}
+}
+
+func TestTraceParentFormat(t *testing.T) {
+	val := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, _ := tracer.ParseTraceParent(val)
+	if parent.String() != val {
+		t.Fatalf("expected formatted traceparent to be %s; got %s", val, parent.String())
+	}
+}
+
+func TestTraceIdConversion(t *testing.T) {
+	recTraceId := "4bf92f35-77b3-4da6-a3ce-929d0e0e4736"
+	w3cTraceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	if tracer.W3CTraceId(recTraceId) != w3cTraceId {
+		t.Fatalf("expected W3C trace id to be %s; got %s", w3cTraceId, tracer.W3CTraceId(recTraceId))
+	}
+	if tracer.RecordTraceId(w3cTraceId) != recTraceId {
+		t.Fatalf("expected record trace id to be %s; got %s", recTraceId, tracer.RecordTraceId(w3cTraceId))
+	}
+
+	// Non-UUID trace ids are hashed
+	legacyId := tracer.W3CTraceId("0-0-0-0")
+	if len(legacyId) != 32 || legacyId != tracer.W3CTraceId("0-0-0-0") {
+		t.Fatalf("expected legacy trace id to be consistently mapped to a 32-char id; got %s", legacyId)
+	}
+
+	parent := tracer.NewTraceParent(recTraceId)
+	parsed, err := tracer.ParseTraceParent(parent.String())
+	if err != nil {
+		t.Fatalf("error parsing generated traceparent %s: %v", parent.String(), err)
+	}
+	if parsed.RecordTraceId() != recTraceId {
+		t.Fatalf("expected generated traceparent to reference trace id %s; got %s", recTraceId, parsed.RecordTraceId())
+	}
+}